@@ -0,0 +1,94 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+// Package clock provides an abstraction over the current time, so time
+// dependent code can be tested with a fake clock.
+package clock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock returns the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+// Real is a Clock returning the real (system) time.
+type Real struct{}
+
+// Now returns the current system time.
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+// Fake is a Clock that returns a settable time. It's safe for concurrent use.
+type Fake struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+// NewFake returns a new Fake clock set to t.
+func NewFake(t time.Time) *Fake {
+	return &Fake{t: t}
+}
+
+// Now returns the current time of the fake clock.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.t
+}
+
+// Set sets the current time of the fake clock to t.
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.t = t
+}
+
+// Advance moves the current time of the fake clock forward by d.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.t = f.t.Add(d)
+}
+
+// clockKey is the context key for the Clock.
+type clockKey struct{}
+
+// WithClock returns a copy of ctx containing clock c.
+func WithClock(ctx context.Context, c Clock) context.Context {
+	return context.WithValue(ctx, clockKey{}, c)
+}
+
+// ClockValue returns the Clock in ctx, or a Real clock if ctx has none.
+func ClockValue(ctx context.Context) Clock {
+	if c, ok := ctx.Value(clockKey{}).(Clock); ok {
+		return c
+	}
+	return Real{}
+}
+
+// timestampKey is the context key for the timestamp Clock.
+type timestampKey struct{}
+
+// WithTimestampClock returns a copy of ctx containing clock c, used only for
+// timestamps written to external files (E.g., metrics). This allows those
+// timestamps to be fixed without affecting durations and schedules.
+func WithTimestampClock(ctx context.Context, c Clock) context.Context {
+	return context.WithValue(ctx, timestampKey{}, c)
+}
+
+// TimestampValue returns the timestamp Clock in ctx, or ClockValue(ctx) if
+// ctx has none.
+func TimestampValue(ctx context.Context) Clock {
+	if c, ok := ctx.Value(timestampKey{}).(Clock); ok {
+		return c
+	}
+	return ClockValue(ctx)
+}
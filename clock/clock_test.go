@@ -0,0 +1,57 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package clock
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Test the fake clock and context helpers.
+func TestFake(t *testing.T) {
+	start := time.Date(2024, 1, 31, 10, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+
+	if got := f.Now(); !got.Equal(start) {
+		t.Errorf("Now: got %v, want %v", got, start)
+	}
+	f.Advance(time.Hour)
+	if got, want := f.Now(), start.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("Now after Advance: got %v, want %v", got, want)
+	}
+	f.Set(start)
+	if got := f.Now(); !got.Equal(start) {
+		t.Errorf("Now after Set: got %v, want %v", got, start)
+	}
+
+	// Context without a clock returns the real clock.
+	if _, ok := ClockValue(context.Background()).(Real); !ok {
+		t.Errorf("ClockValue on empty context should return a Real clock")
+	}
+	ctx := WithClock(context.Background(), f)
+	if got := ClockValue(ctx).Now(); !got.Equal(start) {
+		t.Errorf("ClockValue(ctx).Now: got %v, want %v", got, start)
+	}
+}
+
+// Test that the timestamp clock falls back to the context clock.
+func TestTimestampValue(t *testing.T) {
+	start := time.Date(2024, 1, 31, 10, 0, 0, 0, time.UTC)
+	stamp := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	ctx := WithClock(context.Background(), NewFake(start))
+	if got := TimestampValue(ctx).Now(); !got.Equal(start) {
+		t.Errorf("TimestampValue(ctx).Now without timestamp clock: got %v, want %v", got, start)
+	}
+	ctx = WithTimestampClock(ctx, NewFake(stamp))
+	if got := TimestampValue(ctx).Now(); !got.Equal(stamp) {
+		t.Errorf("TimestampValue(ctx).Now: got %v, want %v", got, stamp)
+	}
+	if got := ClockValue(ctx).Now(); !got.Equal(start) {
+		t.Errorf("ClockValue(ctx).Now changed by timestamp clock: got %v, want %v", got, start)
+	}
+}
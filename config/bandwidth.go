@@ -0,0 +1,89 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scheduleRegex matches bandwidth schedule entries (HH:MM-HH:MM=RATE).
+var scheduleRegex = regexp.MustCompile(`^(\d\d):(\d\d)-(\d\d):(\d\d)=(\S+)$`)
+
+// BandwidthWindow is a bandwidth limit applied during a daily time window.
+type BandwidthWindow struct {
+	// Start and end of the window, in minutes since midnight. Windows
+	// ending before they start wrap around midnight.
+	Start int
+	End   int
+	// Rate is the bandwidth limit, as passed to the transport.
+	Rate string
+}
+
+// Contains returns true if the time of day of t falls within the window
+// (start inclusive, end exclusive.) Windows with the same start and end
+// cover the whole day.
+func (w BandwidthWindow) Contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	switch {
+	case w.Start == w.End:
+		return true
+	case w.Start < w.End:
+		return m >= w.Start && m < w.End
+	}
+	// Wraps around midnight.
+	return m >= w.Start || m < w.End
+}
+
+// ParseBandwidthSchedule parses a list of bandwidth schedule entries in the
+// HH:MM-HH:MM=RATE format. RATE is a number with an optional K, M, G, or T
+// suffix.
+func ParseBandwidthSchedule(entries []string) ([]BandwidthWindow, error) {
+	var ret []BandwidthWindow
+	for _, e := range entries {
+		m := scheduleRegex.FindStringSubmatch(strings.TrimSpace(e))
+		if m == nil {
+			return nil, fmt.Errorf("invalid bandwidth schedule entry %q (use HH:MM-HH:MM=RATE)", e)
+		}
+		start, err := minutes(m[1], m[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bandwidth schedule entry %q: %v", e, err)
+		}
+		end, err := minutes(m[3], m[4])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bandwidth schedule entry %q: %v", e, err)
+		}
+		if _, err := ParseSize(m[5]); err != nil {
+			return nil, fmt.Errorf("invalid bandwidth schedule entry %q: invalid rate %q", e, m[5])
+		}
+		ret = append(ret, BandwidthWindow{Start: start, End: end, Rate: m[5]})
+	}
+	return ret, nil
+}
+
+// BandwidthLimit returns the rate of the first window in the schedule
+// containing t, or an empty string if no window applies.
+func BandwidthLimit(schedule []BandwidthWindow, t time.Time) string {
+	for _, w := range schedule {
+		if w.Contains(t) {
+			return w.Rate
+		}
+	}
+	return ""
+}
+
+// minutes converts an hour and minute into minutes since midnight.
+func minutes(hh, mm string) (int, error) {
+	h, _ := strconv.Atoi(hh)
+	m, _ := strconv.Atoi(mm)
+	if h > 23 || m > 59 {
+		return 0, fmt.Errorf("invalid time %s:%s", hh, mm)
+	}
+	return h*60 + m, nil
+}
@@ -0,0 +1,56 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package config
+
+import (
+	"fmt"
+)
+
+// Capabilities describes the configuration features supported by a transport.
+type Capabilities struct {
+	// Remote source (source_host) and destination (dest_host) support.
+	SourceHost bool
+	DestHost   bool
+	// Both source_host and dest_host may be set at the same time.
+	BothHosts bool
+	// Include lists and filter rules support.
+	Include bool
+	Filters bool
+}
+
+// transportCapabilities holds the capabilities of each transport. This must
+// be kept in sync with the checkConfig method of each transport.
+var transportCapabilities = map[string]Capabilities{
+	"rclone":       {SourceHost: true, DestHost: true, BothHosts: true, Include: true, Filters: true},
+	"rdiff-backup": {SourceHost: true, DestHost: true, Include: true},
+	"restic":       {DestHost: true},
+	"rsync":        {SourceHost: true, DestHost: true, Include: true, Filters: true},
+	"tar":          {},
+	"test":         {SourceHost: true, DestHost: true, BothHosts: true, Include: true, Filters: true},
+}
+
+// checkCapabilities returns an error if the configuration uses features not
+// supported by its transport. Unknown transports are not checked here; they
+// fail when the transport is created.
+func checkCapabilities(config *Config) error {
+	c, ok := transportCapabilities[config.Transport]
+	if !ok {
+		return nil
+	}
+	switch {
+	case !c.SourceHost && config.SourceHost != "":
+		return fmt.Errorf("source_host is not supported by the %s transport", config.Transport)
+	case !c.DestHost && config.DestHost != "":
+		return fmt.Errorf("dest_host is not supported by the %s transport", config.Transport)
+	case !c.BothHosts && config.SourceHost != "" && config.DestHost != "":
+		return fmt.Errorf("source_host and dest_host cannot be used together with the %s transport", config.Transport)
+	case !c.Include && len(config.Include) != 0:
+		return fmt.Errorf("include is not supported by the %s transport", config.Transport)
+	case !c.Filters && len(config.Filters) != 0:
+		return fmt.Errorf("filters is not supported by the %s transport", config.Transport)
+	}
+	return nil
+}
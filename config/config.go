@@ -6,68 +6,789 @@
 package config
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
 )
 
 const (
-	defaultLogDir = "/var/log/netbackup"
+	defaultLogDir   = "/var/log/netbackup"
+	defaultStateDir = "/var/lib/netbackup"
+
+	// Maximum nesting level for include_config directives.
+	maxIncludeDepth = 10
+)
+
+// Configuration file formats.
+const (
+	FormatTOML = "toml"
+	FormatYAML = "yaml"
 )
 
+// ParseOptions holds the options used by ParseConfig and ParseConfigFile.
+type ParseOptions struct {
+	// Format of the configuration (FormatTOML or FormatYAML). If empty, the
+	// format is detected from the file name and contents.
+	Format string
+	// Name of a file (TOML or YAML) with default values for all
+	// configurations. If set, the configuration is read on top of these
+	// defaults. A missing file is ignored.
+	DefaultsFile string
+	// Allow the "test" transport. The test transport does not copy any data,
+	// so it is refused by default to prevent accidental use in production.
+	EnableTestTransport bool
+}
+
+// resticBackends contains the prefixes of restic repository URLs for
+// non-local backends.
+var resticBackends = []string{"azure:", "b2:", "gs:", "rclone:", "rest:", "s3:", "sftp:", "swift:"}
+
+// IsResticBackend returns true if dir is a restic backend URL (E.g.
+// "s3:host/bucket") instead of a path.
+func IsResticBackend(dir string) bool {
+	for _, prefix := range resticBackends {
+		if strings.HasPrefix(dir, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 // Config represents a configuration file on disk.  The fields in this struct
 // *must* be tagged so we can correctly map them to the fields in the config
 // file and detect extraneous configuration items.
 type Config struct {
-	Name               string   `toml:"name"`
-	SourceHost         string   `toml:"source_host"`
-	DestHost           string   `toml:"dest_host"`
-	DestDev            string   `toml:"dest_dev"`
-	SourceDir          string   `toml:"source_dir"`
-	DestDir            string   `toml:"dest_dir"`
-	ExpireDays         int      `toml:"expire_days"`
-	ExtraArgs          []string `toml:"extra_args" delim:" "`
-	FSCleanup          bool     `toml:"fs_cleanup"`
-	PreCommand         string   `toml:"pre_command"`
-	SourceIsMountPoint bool     `toml:"source_is_mountpoint"`
-	PostCommand        string   `toml:"post_command"`
-	FailCommand        string   `toml:"fail_command"`
-	Transport          string   `toml:"transport"`
-	Exclude            []string `toml:"exclude" delim:" "`
-	Include            []string `toml:"include" delim:" "`
-	LogDir             string   `toml:"log_dir"`
-	Logfile            string   `toml:"log_file"`
-	CustomBin          string   `toml:"custom_bin"`
-	PromTextFile       string   `toml:"prometheus_textfile"`
+	Name               string   `toml:"name" yaml:"name"`
+	SourceHost         string   `toml:"source_host" yaml:"source_host"`
+	DestHost           string   `toml:"dest_host" yaml:"dest_host"`
+	DestDev            string   `toml:"dest_dev" yaml:"dest_dev"`
+	MountPoint         string   `toml:"mount_point" yaml:"mount_point"`
+	ReuseExistingMount bool     `toml:"reuse_existing_mount" yaml:"reuse_existing_mount"`
+	WaitForDevice      string   `toml:"wait_for_device" yaml:"wait_for_device"`
+	SourceDir          string   `toml:"source_dir" yaml:"source_dir"`
+	DestDir            string   `toml:"dest_dir" yaml:"dest_dir"`
+	ExpireDays         int      `toml:"expire_days" yaml:"expire_days"`
+	ExpireCount        int      `toml:"expire_count" yaml:"expire_count"`
+	ExtraArgs          []string `toml:"extra_args" yaml:"extra_args" delim:" "`
+	RsyncArgs          []string `toml:"rsync_args" yaml:"rsync_args"`
+	RcloneArgs         []string `toml:"rclone_args" yaml:"rclone_args"`
+	ResticArgs         []string `toml:"restic_args" yaml:"restic_args"`
+	FSCleanup          bool     `toml:"fs_cleanup" yaml:"fs_cleanup"`
+	UmountTimeout      string   `toml:"umount_timeout" yaml:"umount_timeout"`
+	LazyUmount         bool     `toml:"lazy_umount" yaml:"lazy_umount"`
+	PowerDownDest      bool     `toml:"power_down_dest" yaml:"power_down_dest"`
+	PowerDownCommand   string   `toml:"power_down_command" yaml:"power_down_command"`
+	PreCommand         string   `toml:"pre_command" yaml:"pre_command"`
+	SourceIsMountPoint bool     `toml:"source_is_mountpoint" yaml:"source_is_mountpoint"`
+	MinSourceEntries   int      `toml:"min_source_entries" yaml:"min_source_entries"`
+	PostCommand        string   `toml:"post_command" yaml:"post_command"`
+	FailCommand        string   `toml:"fail_command" yaml:"fail_command"`
+	Shell              string   `toml:"shell" yaml:"shell"`
+	Transport          string   `toml:"transport" yaml:"transport"`
+	Exclude            []string `toml:"exclude" yaml:"exclude" delim:" "`
+	ExcludeFrom        string   `toml:"exclude_from" yaml:"exclude_from"`
+	AutoExcludeDest    bool     `toml:"auto_exclude_dest" yaml:"auto_exclude_dest"`
+	Include            []string `toml:"include" yaml:"include" delim:" "`
+	Filters            []string `toml:"filters" yaml:"filters"`
+	ExcludeCaches      bool     `toml:"exclude_caches" yaml:"exclude_caches"`
+	MaxFileSize        string   `toml:"max_file_size" yaml:"max_file_size"`
+	Compression        string   `toml:"compression" yaml:"compression"`
+	LogDir             string   `toml:"log_dir" yaml:"log_dir"`
+	Logfile            string   `toml:"log_file" yaml:"log_file"`
+	CustomBin          string   `toml:"custom_bin" yaml:"custom_bin"`
+	InitRepo           bool     `toml:"init_repo" yaml:"init_repo"`
+	PruneInterval      string   `toml:"prune_interval" yaml:"prune_interval"`
+	MaxDuration        string   `toml:"max_duration" yaml:"max_duration"`
+	StateDir           string   `toml:"state_dir" yaml:"state_dir"`
+	PromTextFile       string   `toml:"prometheus_textfile" yaml:"prometheus_textfile"`
+	PromMetricPrefix   string   `toml:"prometheus_metric_prefix" yaml:"prometheus_metric_prefix"`
+	PromJob            string   `toml:"prometheus_job" yaml:"prometheus_job"`
+	StatusFile         string   `toml:"status_file" yaml:"status_file"`
+	IncludeConfig      []string `toml:"include_config" yaml:"include_config"`
+	TmpDir             string   `toml:"tmp_dir" yaml:"tmp_dir"`
+	CacheDir           string   `toml:"cache_dir" yaml:"cache_dir"`
+	RedactPatterns     []string `toml:"redact_patterns" yaml:"redact_patterns"`
+	AuditLog           string   `toml:"audit_log" yaml:"audit_log"`
+	SelfNice           int      `toml:"self_nice" yaml:"self_nice"`
+	RunAsUser          string   `toml:"run_as_user" yaml:"run_as_user"`
+	WriteManifest      bool     `toml:"write_manifest" yaml:"write_manifest"`
+	ProgressFile       string   `toml:"progress_file" yaml:"progress_file"`
+	// rsync specific options
+	RsyncNoTrailingSlash bool `toml:"rsync_no_trailing_slash" yaml:"rsync_no_trailing_slash"`
+	RsyncInplace         bool `toml:"rsync_inplace" yaml:"rsync_inplace"`
+	RsyncSparse          bool `toml:"rsync_sparse" yaml:"rsync_sparse"`
+	// Unset means true (see Parsed.RsyncIgnoreVanished).
+	RsyncIgnoreVanished *bool `toml:"rsync_ignore_vanished" yaml:"rsync_ignore_vanished"`
+	// Per-directory exclusions (rsync)
+	RsyncCvsExclude bool   `toml:"rsync_cvs_exclude" yaml:"rsync_cvs_exclude"`
+	RsyncIgnoreFile string `toml:"rsync_ignore_file" yaml:"rsync_ignore_file"`
+	// Bandwidth limits by time of day (rsync and rclone)
+	BandwidthSchedule []string `toml:"bandwidth_schedule" yaml:"bandwidth_schedule"`
+	// restic specific options (unset means 2, see Parsed.ResticVerbosity)
+	ResticVerbosity *int `toml:"restic_verbosity" yaml:"restic_verbosity"`
+	// rdiff-backup specific options (unset means 5 and true, see Parsed)
+	RdiffVerbosity *int  `toml:"rdiff_verbosity" yaml:"rdiff_verbosity"`
+	RdiffForce     *bool `toml:"rdiff_force" yaml:"rdiff_force"`
+	// rclone specific options
+	RcloneConfig            string `toml:"rclone_config" yaml:"rclone_config"`
+	RcloneConfigPassCommand string `toml:"rclone_config_pass_command" yaml:"rclone_config_pass_command"`
+	RcloneLogLevel          string `toml:"rclone_log_level" yaml:"rclone_log_level"`
+	RcloneStats             string `toml:"rclone_stats" yaml:"rclone_stats"`
+	// Hook options
+	PostCommandOptional bool `toml:"post_command_optional" yaml:"post_command_optional"`
+	// test transport options
+	TestSleep         string `toml:"test_sleep" yaml:"test_sleep"`
+	TestProgressLines int    `toml:"test_progress_lines" yaml:"test_progress_lines"`
+	TestExitCode      int    `toml:"test_exit_code" yaml:"test_exit_code"`
+	// Log file options
+	LogFileMode   string `toml:"log_file_mode" yaml:"log_file_mode"`
+	LogDirMode    string `toml:"log_dir_mode" yaml:"log_dir_mode"`
+	LogGroup      string `toml:"log_group" yaml:"log_group"`
+	LogMaxSize    string `toml:"log_max_size" yaml:"log_max_size"`
+	LogDateFormat string `toml:"log_date_format" yaml:"log_date_format"`
+	// Per-phase timeouts
+	PreCommandTimeout  string `toml:"pre_command_timeout" yaml:"pre_command_timeout"`
+	TransportTimeout   string `toml:"transport_timeout" yaml:"transport_timeout"`
+	PostCommandTimeout string `toml:"post_command_timeout" yaml:"post_command_timeout"`
 	// LUKS specific options
-	LuksDestDev string `toml:"luks_dest_dev"`
-	LuksKeyFile string `toml:"luks_keyfile"`
+	LuksDestDev         string `toml:"luks_dest_dev" yaml:"luks_dest_dev"`
+	LuksKeyFile         string `toml:"luks_keyfile" yaml:"luks_keyfile"`
+	LuksInsecureKeyfile bool   `toml:"luks_insecure_keyfile" yaml:"luks_insecure_keyfile"`
+	LuksCloseTimeout    string `toml:"luks_close_timeout" yaml:"luks_close_timeout"`
+	// Extra labels added to all prometheus metrics
+	PromLabels map[string]string `toml:"prometheus_labels" yaml:"prometheus_labels"`
+	// Multiple destinations
+	DestFailFast bool          `toml:"dest_fail_fast" yaml:"dest_fail_fast"`
+	Destinations []Destination `toml:"destination" yaml:"destination"`
+
+	// Typed values of the duration, size, and mode options, set by Normalize.
+	Parsed Parsed `toml:"-" yaml:"-"`
 }
 
-// ParseConfig reads and parses TOML configuration from io.Reader and performs
-// basic sanity checking on it. A pointer to Config is returned or error.
-func ParseConfig(r io.Reader) (*Config, error) {
-	config := &Config{}
+// Parsed holds the values of the duration, size, and mode options in the
+// configuration, parsed by Normalize, and the effective values of boolean
+// options defaulting to true and integer options with a non-zero default.
+// Other options not set in the configuration are zero.
+type Parsed struct {
+	WaitForDevice      time.Duration
+	UmountTimeout      time.Duration
+	LuksCloseTimeout   time.Duration
+	PruneInterval      time.Duration
+	PreCommandTimeout  time.Duration
+	TransportTimeout   time.Duration
+	PostCommandTimeout time.Duration
+	TestSleep          time.Duration
+	MaxDuration        time.Duration
+	RcloneStats        time.Duration
+	// Sizes in bytes.
+	MaxFileSize int64
+	LogMaxSize  int64
+	// File modes.
+	LogFileMode os.FileMode
+	LogDirMode  os.FileMode
+	// Booleans with a default of true.
+	RsyncIgnoreVanished bool
+	RdiffForce          bool
+	// Integers with a non-zero default.
+	ResticVerbosity int
+	RdiffVerbosity  int
+}
+
+// Normalize parses the duration, size, and mode options in the configuration
+// (and resolves the defaults of boolean and integer options) into Parsed,
+// returning an error naming the offending option if any of them is invalid.
+// ParseConfig and ParseConfigFile call Normalize automatically.
+func (c *Config) Normalize() error {
+	durations := []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"wait_for_device", c.WaitForDevice, &c.Parsed.WaitForDevice},
+		{"umount_timeout", c.UmountTimeout, &c.Parsed.UmountTimeout},
+		{"luks_close_timeout", c.LuksCloseTimeout, &c.Parsed.LuksCloseTimeout},
+		{"prune_interval", c.PruneInterval, &c.Parsed.PruneInterval},
+		{"pre_command_timeout", c.PreCommandTimeout, &c.Parsed.PreCommandTimeout},
+		{"transport_timeout", c.TransportTimeout, &c.Parsed.TransportTimeout},
+		{"post_command_timeout", c.PostCommandTimeout, &c.Parsed.PostCommandTimeout},
+		{"test_sleep", c.TestSleep, &c.Parsed.TestSleep},
+		{"max_duration", c.MaxDuration, &c.Parsed.MaxDuration},
+		{"rclone_stats", c.RcloneStats, &c.Parsed.RcloneStats},
+	}
+	for _, d := range durations {
+		*d.dest = 0
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", d.name, err)
+		}
+		if v < 0 {
+			return fmt.Errorf("invalid %s: negative duration %q", d.name, d.value)
+		}
+		*d.dest = v
+	}
+
+	sizes := []struct {
+		name  string
+		value string
+		dest  *int64
+	}{
+		{"max_file_size", c.MaxFileSize, &c.Parsed.MaxFileSize},
+		{"log_max_size", c.LogMaxSize, &c.Parsed.LogMaxSize},
+	}
+	for _, s := range sizes {
+		*s.dest = 0
+		if s.value == "" {
+			continue
+		}
+		v, err := ParseSize(s.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", s.name, err)
+		}
+		*s.dest = v
+	}
+
+	modes := []struct {
+		name  string
+		value string
+		dest  *os.FileMode
+	}{
+		{"log_file_mode", c.LogFileMode, &c.Parsed.LogFileMode},
+		{"log_dir_mode", c.LogDirMode, &c.Parsed.LogDirMode},
+	}
+	for _, m := range modes {
+		*m.dest = 0
+		if m.value == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(m.value, 8, 32)
+		if err != nil || v > 0777 {
+			return fmt.Errorf("invalid %s %q (use an octal mode, E.g. \"0640\")", m.name, m.value)
+		}
+		*m.dest = os.FileMode(v)
+	}
+
+	ints := []struct {
+		name     string
+		value    *int
+		def      int
+		min, max int
+		dest     *int
+	}{
+		{"restic_verbosity", c.ResticVerbosity, 2, 0, 3, &c.Parsed.ResticVerbosity},
+		{"rdiff_verbosity", c.RdiffVerbosity, 5, 0, 9, &c.Parsed.RdiffVerbosity},
+	}
+	for _, i := range ints {
+		*i.dest = i.def
+		if i.value == nil {
+			continue
+		}
+		if *i.value < i.min || *i.value > i.max {
+			return fmt.Errorf("invalid %s: %d (must be between %d and %d)", i.name, *i.value, i.min, i.max)
+		}
+		*i.dest = *i.value
+	}
+
+	c.Parsed.RsyncIgnoreVanished = c.RsyncIgnoreVanished == nil || *c.RsyncIgnoreVanished
+	c.Parsed.RdiffForce = c.RdiffForce == nil || *c.RdiffForce
+	return nil
+}
+
+// Destination represents one of the destinations of a backup with multiple
+// destinations. Each destination accepts the same options (with the same
+// meaning) as the corresponding destination options in Config.
+type Destination struct {
+	DestHost    string `toml:"dest_host" yaml:"dest_host"`
+	DestDir     string `toml:"dest_dir" yaml:"dest_dir"`
+	DestDev     string `toml:"dest_dev" yaml:"dest_dev"`
+	LuksDestDev string `toml:"luks_dest_dev" yaml:"luks_dest_dev"`
+	LuksKeyFile string `toml:"luks_keyfile" yaml:"luks_keyfile"`
+}
+
+// ForDestination returns a copy of the configuration for the i-th entry in
+// Destinations, with the destination options replaced by those in the entry
+// and no further destinations (so dest_fail_fast is cleared). The LUKS keyfile
+// is inherited from the main configuration, unless set in the entry.
+func (c *Config) ForDestination(i int) *Config {
+	d := c.Destinations[i]
+	ret := *c
+	ret.DestHost = d.DestHost
+	ret.DestDir = d.DestDir
+	ret.DestDev = d.DestDev
+	ret.LuksDestDev = d.LuksDestDev
+	if d.LuksKeyFile != "" {
+		ret.LuksKeyFile = d.LuksKeyFile
+	}
+	ret.Destinations = nil
+	ret.DestFailFast = false
+	return &ret
+}
+
+// ParseConfigFile reads and parses the configuration in the named file and
+// performs basic sanity checking on it, according to opts. The file format is
+// taken from opts.Format or, if not set, detected from the file name and
+// contents. Relative paths in include_config are resolved against the
+// directory containing the file. A pointer to Config is returned or error.
+func ParseConfigFile(path string, opts ParseOptions) (*Config, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %v", err)
+	}
+	format, err := configFormat(path, buf, opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	config, err := decodeWithDefaults(buf, format, filepath.Dir(path), opts.DefaultsFile)
+	if err != nil {
+		return nil, err
+	}
+	return validateConfig(config, opts)
+}
 
-	mdata, err := toml.DecodeReader(r, config)
+// ParseConfig reads and parses the configuration from io.Reader and performs
+// basic sanity checking on it, according to opts. The format is taken from
+// opts.Format or, if not set, detected from the contents. Relative paths in
+// include_config are resolved against the current directory. A pointer to
+// Config is returned or error.
+func ParseConfig(r io.Reader, opts ParseOptions) (*Config, error) {
+	buf, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, fmt.Errorf("Error loading config: %v", err)
 	}
-	if len(mdata.Undecoded()) != 0 {
+	format, err := configFormat("", buf, opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	config, err := decodeWithDefaults(buf, format, "", opts.DefaultsFile)
+	if err != nil {
+		return nil, err
+	}
+	return validateConfig(config, opts)
+}
+
+// configFormat returns the format of the main configuration: format, if set,
+// or the format detected from the file name and contents.
+func configFormat(fname string, buf []byte, format string) (string, error) {
+	switch format {
+	case "":
+		return detectFormat(fname, buf), nil
+	case FormatTOML, FormatYAML:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown config format %q (use %q or %q)", format, FormatTOML, FormatYAML)
+}
+
+// yamlKey matches the first line of a YAML mapping ("key:" or "key: value").
+var yamlKey = regexp.MustCompile(`^[A-Za-z0-9_-]+\s*:(\s|$)`)
+
+// detectFormat returns the format of a configuration file. Files named
+// *.yaml or *.yml are YAML, and files named *.toml or *.conf are TOML.
+// Otherwise, the first line that is not empty or a comment decides: a
+// document start marker ("---") or a "key: value" line indicate YAML.
+func detectFormat(fname string, buf []byte) string {
+	switch strings.ToLower(filepath.Ext(fname)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml", ".conf":
+		return FormatTOML
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line == "---" || yamlKey.MatchString(line) {
+			return FormatYAML
+		}
+		break
+	}
+	return FormatTOML
+}
+
+// decodeWithDefaults decodes the data in buf (in the given format) on top of
+// the defaults in defaultsFile (if set and present.) Values in buf override
+// the defaults, except for exclude, which is appended to the default exclude
+// list. Setting either log_dir or log_file in buf overrides both defaults.
+func decodeWithDefaults(buf []byte, format string, basedir string, defaultsFile string) (*Config, error) {
+	config := &Config{}
+	if defaultsFile != "" {
+		data, err := ioutil.ReadFile(defaultsFile)
+		switch {
+		case err == nil:
+			if err := decodeConfig(data, detectFormat(defaultsFile, data), filepath.Dir(defaultsFile), config, 0); err != nil {
+				return nil, fmt.Errorf("%s: %v", defaultsFile, err)
+			}
+		case !os.IsNotExist(err):
+			return nil, fmt.Errorf("unable to read defaults file: %v", err)
+		}
+	}
+
+	exclude := config.Exclude
+	logDir, logfile := config.LogDir, config.Logfile
+	config.Exclude = nil
+	config.LogDir, config.Logfile = "", ""
+	if err := decodeConfig(buf, format, basedir, config, 0); err != nil {
+		return nil, err
+	}
+	if len(exclude) > 0 {
+		config.Exclude = append(exclude, config.Exclude...)
+	}
+	if config.LogDir == "" && config.Logfile == "" {
+		config.LogDir, config.Logfile = logDir, logfile
+	}
+
+	// Patterns in exclude_from are added to the exclusions.
+	if config.ExcludeFrom != "" {
+		fname := config.ExcludeFrom
+		if !filepath.IsAbs(fname) {
+			fname = filepath.Join(basedir, fname)
+		}
+		patterns, err := readPatternFile(fname)
+		if err != nil {
+			return nil, err
+		}
+		config.Exclude = append(config.Exclude, patterns...)
+	}
+	return config, nil
+}
+
+// readPatternFile returns the patterns in the file fname, one per line.
+// Carriage returns (from files edited on Windows) are removed, and blank
+// lines and comments (lines starting with "#") are skipped.
+func readPatternFile(fname string) ([]string, error) {
+	r, err := os.Open(fname)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read exclude_from file: %v", err)
+	}
+	defer r.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if t := strings.TrimSpace(line); t == "" || strings.HasPrefix(t, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read exclude_from file: %v", err)
+	}
+	return patterns, nil
+}
+
+// decodeConfig decodes the data in buf (in the given format) into config.
+// Files listed in include_config are decoded first (recursively, with their
+// format detected from the name and contents), so values in buf take
+// precedence over values in the included files. Relative include paths are
+// resolved against basedir.
+func decodeConfig(buf []byte, format string, basedir string, config *Config, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("include_config nested too deeply (max %d levels)", maxIncludeDepth)
+	}
+
+	// Fetch the list of included files first.
+	inc := struct {
+		IncludeConfig []string `toml:"include_config" yaml:"include_config"`
+	}{}
+	if err := unmarshal(buf, format, &inc, false); err != nil {
+		return err
+	}
+	for _, fname := range inc.IncludeConfig {
+		if !filepath.IsAbs(fname) {
+			fname = filepath.Join(basedir, fname)
+		}
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return fmt.Errorf("unable to read included config: %v", err)
+		}
+		if err := decodeConfig(data, detectFormat(fname, data), filepath.Dir(fname), config, depth+1); err != nil {
+			return fmt.Errorf("%s: %v", fname, err)
+		}
+	}
+
+	return unmarshal(buf, format, config, true)
+}
+
+// unmarshal decodes the data in buf (in the given format) into v. If strict
+// is set, keys in buf that do not map to a field in v result in error, except
+// for custom keys (see isCustomKey), which are always ignored.
+func unmarshal(buf []byte, format string, v interface{}, strict bool) error {
+	if format == FormatYAML {
+		buf, err := stripYAMLCustomKeys(buf)
+		if err != nil {
+			return fmt.Errorf("Error loading config: %v", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(buf))
+		dec.KnownFields(strict)
+		// An empty document is not an error.
+		if err := dec.Decode(v); err != nil && err != io.EOF {
+			if strict && strings.Contains(err.Error(), "not found in type") {
+				return fmt.Errorf("unknown field(s) in config: %v", err)
+			}
+			return fmt.Errorf("Error loading config: %v", err)
+		}
+		return nil
+	}
+
+	mdata, err := toml.Decode(string(buf), v)
+	if err != nil {
+		return fmt.Errorf("Error loading config: %v", err)
+	}
+	if strict {
 		keys := []string{}
 		for _, v := range mdata.Undecoded() {
+			if hasCustomKey(v) {
+				continue
+			}
 			strv := v.String()
 			keys = append(keys, strv)
 		}
-		return nil, fmt.Errorf("unknown field(s) in config: %s", strings.Join(keys, ","))
+		if len(keys) != 0 {
+			return fmt.Errorf("unknown field(s) in config: %s", strings.Join(keys, ","))
+		}
+	}
+	return nil
+}
+
+// isCustomKey returns true if key is a custom key (starting with "x_"). Custom
+// keys are ignored by netbackup, so users can keep their own metadata in the
+// configuration.
+func isCustomKey(key string) bool {
+	return strings.HasPrefix(key, "x_")
+}
+
+// hasCustomKey returns true if any component of the TOML key is a custom
+// key (E.g. "x_meta.owner", or "destination.x_note".)
+func hasCustomKey(key toml.Key) bool {
+	for _, k := range key {
+		if isCustomKey(k) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripYAMLCustomKeys returns a copy of the YAML document in buf without
+// custom keys (see isCustomKey) in any mapping.
+func stripYAMLCustomKeys(buf []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(buf, &doc); err != nil {
+		return nil, err
+	}
+	if !stripNodeCustomKeys(&doc) {
+		return buf, nil
+	}
+	return yaml.Marshal(&doc)
+}
+
+// stripNodeCustomKeys removes custom keys from all mappings under node,
+// recursively. Returns true if any key was removed.
+func stripNodeCustomKeys(node *yaml.Node) bool {
+	stripped := false
+	if node.Kind == yaml.MappingNode {
+		content := node.Content[:0]
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if isCustomKey(node.Content[i].Value) {
+				stripped = true
+				continue
+			}
+			content = append(content, node.Content[i], node.Content[i+1])
+		}
+		node.Content = content
+	}
+	for _, n := range node.Content {
+		if stripNodeCustomKeys(n) {
+			stripped = true
+		}
+	}
+	return stripped
+}
+
+// sizeRegex matches sizes in the format accepted by ParseSize.
+var sizeRegex = regexp.MustCompile(`^([0-9]+)([KMGT]?)$`)
+
+// ParseSize parses a size with an optional binary unit suffix (K, M, G, or T,
+// case insensitive. E.g. "2G") and returns the size in bytes.
+func ParseSize(size string) (int64, error) {
+	m := sizeRegex.FindStringSubmatch(strings.ToUpper(size))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q (use a number followed by an optional K, M, G, or T)", size)
+	}
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %v", size, err)
+	}
+	shift := map[string]uint{"": 0, "K": 10, "M": 20, "G": 30, "T": 40}[m[2]]
+	return n << shift, nil
+}
+
+// blankEntry returns the index of the first empty or whitespace-only string
+// in list, or -1 if there are none.
+func blankEntry(list []string) int {
+	for i, v := range list {
+		if strings.TrimSpace(v) == "" {
+			return i
+		}
 	}
+	return -1
+}
+
+// isRcloneLogLevel returns true if level (in any case) is a valid value for
+// rclone_log_level.
+func isRcloneLogLevel(level string) bool {
+	switch strings.ToUpper(level) {
+	case "DEBUG", "INFO", "NOTICE":
+		return true
+	}
+	return false
+}
+
+// promMetricRegex matches valid prometheus metric names.
+var promMetricRegex = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// promLabelRegex matches valid prometheus label names.
+var promLabelRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
 
+// checkPromLabel returns an error if name is not a valid name for an extra
+// prometheus label. Labels set by netbackup itself cannot be overridden.
+func checkPromLabel(name string) error {
+	switch {
+	case !promLabelRegex.MatchString(name) || strings.HasPrefix(name, "__"):
+		return fmt.Errorf("invalid label name %q in prometheus_labels", name)
+	case name == "name" || name == "job" || name == "status" || name == "snapshot":
+		return fmt.Errorf("label %q in prometheus_labels is reserved", name)
+	}
+	return nil
+}
+
+// safeDateRegex matches dates that are safe to use in file names. Colons are
+// excluded, since most transports treat them as host separators.
+var safeDateRegex = regexp.MustCompile(`^[A-Za-z0-9._+-]+$`)
+
+// checkDateFormat returns an error if the Go time layout produces dates
+// that are not safe to use in file names.
+func checkDateFormat(layout string) error {
+	// Check a few times, so that all fields (including the zone) show up.
+	for _, t := range []time.Time{
+		time.Date(2024, 1, 2, 3, 4, 5, 6, time.Local),
+		time.Date(2024, 12, 31, 23, 59, 59, 999999999, time.UTC),
+	} {
+		if s := t.Format(layout); !safeDateRegex.MatchString(s) {
+			return fmt.Errorf("log_date_format %q produces %q, which is not safe for file names (use only letters, digits, '.', '_', '+' and '-')", layout, s)
+		}
+	}
+	return nil
+}
+
+// userExists returns true if the user name (or numeric user ID) exists.
+func userExists(name string) bool {
+	if _, err := user.Lookup(name); err == nil {
+		return true
+	}
+	if _, err := strconv.Atoi(name); err == nil {
+		if _, err := user.LookupId(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// isDeviceID returns true if dev identifies a device by filesystem UUID or
+// label (UUID=<uuid> or LABEL=<label>).
+func isDeviceID(dev string) bool {
+	return strings.HasPrefix(dev, "UUID=") || strings.HasPrefix(dev, "LABEL=")
+}
+
+// checkWritableDir returns an error if dir does not exist, is not a
+// directory, or is not writable by the current user.
+func checkWritableDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%q is not a directory", dir)
+	}
+	w, err := ioutil.TempFile(dir, ".netbackup")
+	if err != nil {
+		return fmt.Errorf("%q is not writable: %v", dir, err)
+	}
+	w.Close()
+	return os.Remove(w.Name())
+}
+
+// checkKeyFilePerms returns an error if the key file cannot be accessed or
+// is readable by group or others.
+func checkKeyFilePerms(fname string) error {
+	fi, err := os.Stat(fname)
+	if err != nil {
+		return fmt.Errorf("unable to access luks_keyfile: %v", err)
+	}
+	if fi.Mode().Perm()&0044 != 0 {
+		return fmt.Errorf("luks_keyfile %q is readable by group or others (mode %04o). Fix the permissions or set luks_insecure_keyfile", fname, fi.Mode().Perm())
+	}
+	return nil
+}
+
+// validateConfig sets default values and performs basic sanity checking on
+// a decoded configuration, according to opts. Returns the config itself or
+// error.
+func validateConfig(config *Config, opts ParseOptions) (*Config, error) {
 	// Set defaults
 	if config.Logfile == "" && config.LogDir == "" {
 		config.LogDir = defaultLogDir
 	}
+	if config.StateDir == "" {
+		config.StateDir = defaultStateDir
+	}
+	// The default temporary directory is only checked when used, since many
+	// backups never create temporary files.
+	if config.TmpDir == "" {
+		config.TmpDir = os.TempDir()
+	} else if err := checkWritableDir(config.TmpDir); err != nil {
+		return nil, fmt.Errorf("tmp_dir: %v", err)
+	}
+	if config.CacheDir != "" {
+		if err := checkWritableDir(config.CacheDir); err != nil {
+			return nil, fmt.Errorf("cache_dir: %v", err)
+		}
+	}
+
+	// Multiple destinations: validate the configuration for each one.
+	if config.DestFailFast && len(config.Destinations) == 0 {
+		return nil, fmt.Errorf("dest_fail_fast requires multiple destinations")
+	}
+	if len(config.Destinations) != 0 {
+		if config.DestHost != "" || config.DestDir != "" || config.DestDev != "" || config.LuksDestDev != "" {
+			return nil, fmt.Errorf("destination cannot be used with dest_host, dest_dir, dest_dev, or luks_dest_dev")
+		}
+		for i := range config.Destinations {
+			if _, err := validateConfig(config.ForDestination(i), opts); err != nil {
+				return nil, fmt.Errorf("destination %d: %v", i+1, err)
+			}
+		}
+		// The per-destination copies are discarded, so Parsed must be set
+		// in the main configuration (ForDestination copies it.)
+		if err := config.Normalize(); err != nil {
+			return nil, err
+		}
+		return config, nil
+	}
 
 	// Count the number of destinations set
 	ndest := 0
@@ -108,16 +829,116 @@ func ParseConfig(r io.Reader) (*Config, error) {
 	// Paths must be absolute if we're doing a local backup (no src or dst hosts.)
 	case config.SourceHost == "" && !strings.HasPrefix(config.SourceDir, "/"):
 		return nil, fmt.Errorf("source_dir must be an absolute path")
-	case config.DestHost == "" && config.DestDir != "" && !strings.HasPrefix(config.DestDir, "/"):
+	case config.DestHost == "" && config.DestDir != "" && !strings.HasPrefix(config.DestDir, "/") &&
+		!(config.Transport == "restic" && IsResticBackend(config.DestDir)):
 		return nil, fmt.Errorf("dest_dir must be an absolute path")
-	case config.DestDev != "" && !strings.HasPrefix(config.DestDev, "/"):
-		return nil, fmt.Errorf("dest_dev must be an absolute path")
-	case config.LuksDestDev != "" && !strings.HasPrefix(config.LuksDestDev, "/"):
-		return nil, fmt.Errorf("dest_luks_dev must be an absolute path")
+	case config.DestDev != "" && !strings.HasPrefix(config.DestDev, "/") && !isDeviceID(config.DestDev):
+		return nil, fmt.Errorf("dest_dev must be an absolute path, UUID=<uuid>, or LABEL=<label>")
+	case config.LuksDestDev != "" && !strings.HasPrefix(config.LuksDestDev, "/") && !isDeviceID(config.LuksDestDev):
+		return nil, fmt.Errorf("dest_luks_dev must be an absolute path, UUID=<uuid>, or LABEL=<label>")
+	case config.MountPoint != "" && !strings.HasPrefix(config.MountPoint, "/"):
+		return nil, fmt.Errorf("mount_point must be an absolute path")
+	case config.MountPoint != "" && ndev == 0:
+		return nil, fmt.Errorf("mount_point requires dest_dev or luks_dest_dev")
+	case config.PowerDownDest && ndev == 0:
+		return nil, fmt.Errorf("power_down_dest requires dest_dev or luks_dest_dev")
+	case config.ReuseExistingMount && ndev == 0:
+		return nil, fmt.Errorf("reuse_existing_mount requires dest_dev or luks_dest_dev")
+	case config.ReuseExistingMount && (config.FSCleanup || config.PowerDownDest):
+		return nil, fmt.Errorf("reuse_existing_mount cannot be used with fs_cleanup or power_down_dest")
+	case config.Shell != "" && !strings.HasPrefix(config.Shell, "/"):
+		return nil, fmt.Errorf("shell must be an absolute path")
+	case config.ProgressFile != "" && !filepath.IsAbs(config.ProgressFile):
+		return nil, fmt.Errorf("progress_file must be an absolute path")
+	case blankEntry(config.Include) >= 0:
+		return nil, fmt.Errorf("include contains an empty pattern (item %d)", blankEntry(config.Include)+1)
+	case blankEntry(config.Exclude) >= 0:
+		return nil, fmt.Errorf("exclude contains an empty pattern (item %d)", blankEntry(config.Exclude)+1)
+	case len(config.Filters) != 0 && (len(config.Include) != 0 || len(config.Exclude) != 0):
+		return nil, fmt.Errorf("filters cannot be used with include or exclude")
 	// Specific checks.
+	case (config.RsyncInplace || config.RsyncSparse || config.RsyncIgnoreVanished != nil) && config.Transport != "rsync":
+		return nil, fmt.Errorf("rsync_inplace, rsync_sparse, and rsync_ignore_vanished can only be used with the rsync transport")
+	case config.Transport == "test" && !opts.EnableTestTransport:
+		return nil, fmt.Errorf("the test transport is disabled (use --enable-test-transport or set NETBACKUP_ENABLE_TEST_TRANSPORT=1)")
+	case (config.TestSleep != "" || config.TestProgressLines != 0 || config.TestExitCode != 0) && config.Transport != "test":
+		return nil, fmt.Errorf("test_sleep, test_progress_lines, and test_exit_code can only be used with the test transport")
+	case (config.RsyncCvsExclude || config.RsyncIgnoreFile != "") && config.Transport != "rsync":
+		return nil, fmt.Errorf("rsync_cvs_exclude and rsync_ignore_file can only be used with the rsync transport")
+	case strings.ContainsAny(config.RsyncIgnoreFile, "/ \t"):
+		return nil, fmt.Errorf("rsync_ignore_file must be a file name, without directories or spaces")
+	case (config.RcloneLogLevel != "" || config.RcloneStats != "") && config.Transport != "rclone":
+		return nil, fmt.Errorf("rclone_log_level and rclone_stats can only be used with the rclone transport")
+	case config.RcloneLogLevel != "" && !isRcloneLogLevel(config.RcloneLogLevel):
+		return nil, fmt.Errorf("rclone_log_level must be DEBUG, INFO, or NOTICE")
+	case config.ExpireCount < 0:
+		return nil, fmt.Errorf("expire_count cannot be negative")
+	case config.ExpireCount != 0 && config.ExpireDays != 0:
+		return nil, fmt.Errorf("expire_count and expire_days are mutually exclusive")
+	case config.ExpireCount != 0 && config.Transport != "rdiff-backup":
+		return nil, fmt.Errorf("expire_count can only be used with the rdiff-backup transport")
+	case config.WriteManifest && config.Transport != "rsync" && config.Transport != "tar":
+		return nil, fmt.Errorf("write_manifest can only be used with the rsync and tar transports")
+	case config.Compression != "" && config.Transport != "tar":
+		return nil, fmt.Errorf("compression can only be used with the tar transport")
+	case config.TestProgressLines < 0:
+		return nil, fmt.Errorf("test_progress_lines must be zero or positive")
 	case config.LuksDestDev != "" && config.LuksKeyFile == "":
 		return nil, fmt.Errorf("dest_luks_dev requires luks_key_file")
 	}
 
+	// Features must be supported by the transport.
+	if err := checkCapabilities(config); err != nil {
+		return nil, err
+	}
+
+	// Durations and sizes must be valid.
+	if err := config.Normalize(); err != nil {
+		return nil, err
+	}
+
+	if _, err := ParseBandwidthSchedule(config.BandwidthSchedule); err != nil {
+		return nil, err
+	}
+
+	if config.MinSourceEntries < 0 {
+		return nil, fmt.Errorf("min_source_entries must be zero or positive")
+	}
+	if config.SelfNice < -20 || config.SelfNice > 19 {
+		return nil, fmt.Errorf("self_nice must be between -20 and 19")
+	}
+	if config.RunAsUser != "" && !userExists(config.RunAsUser) {
+		return nil, fmt.Errorf("run_as_user: unknown user %q", config.RunAsUser)
+	}
+
+	if config.LogDateFormat != "" {
+		if err := checkDateFormat(config.LogDateFormat); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.PromMetricPrefix != "" && !promMetricRegex.MatchString(config.PromMetricPrefix) {
+		return nil, fmt.Errorf("prometheus_metric_prefix must contain only letters, digits, underscores, and colons, and not start with a digit")
+	}
+	for k := range config.PromLabels {
+		if err := checkPromLabel(k); err != nil {
+			return nil, err
+		}
+	}
+
+	// Redaction patterns must be valid regular expressions.
+	for _, p := range config.RedactPatterns {
+		if _, err := regexp.Compile(p); err != nil {
+			return nil, fmt.Errorf("invalid regular expression in redact_patterns: %v", err)
+		}
+	}
+
+	// Refuse to use LUKS keyfiles readable by group or others.
+	if config.LuksKeyFile != "" && !config.LuksInsecureKeyfile {
+		if err := checkKeyFilePerms(config.LuksKeyFile); err != nil {
+			return nil, err
+		}
+	}
+
 	return config, nil
 }
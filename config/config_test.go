@@ -6,8 +6,14 @@
 package config
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 // compare two arrays. Return true if they're the same, false otherwise.
@@ -28,7 +34,7 @@ func TestParseConfigMinimal(t *testing.T) {
 	cstr := "name=\"foo\"\ntransport=\"transp\"\nsource_dir=\"/src\"\ndest_dir=\"/dst\""
 	r := strings.NewReader(cstr)
 
-	cfg, err := ParseConfig(r)
+	cfg, err := ParseConfig(r, ParseOptions{})
 	if err != nil {
 		t.Fatal("ParseConfig failed:", err)
 	}
@@ -51,7 +57,7 @@ func TestParseConfigInvalidKey(t *testing.T) {
 	cstr := "name=\"foo\"\ntransport=\"transp\"\ninvalidkey=\"foo\""
 	r := strings.NewReader(cstr)
 
-	if _, err := ParseConfig(r); err == nil {
+	if _, err := ParseConfig(r, ParseOptions{}); err == nil {
 		t.Fatalf("ParseConfig succeeded with invalid key; want non-nil error: %v", err)
 	}
 }
@@ -71,7 +77,7 @@ func TestParseConfigMandatoryMissing(t *testing.T) {
 			}
 		}
 		r := strings.NewReader(s)
-		if _, err := ParseConfig(r); err == nil {
+		if _, err := ParseConfig(r, ParseOptions{}); err == nil {
 			t.Fatalf("ParseConfig succeeded when key %q is missing; want non-nil error", miss)
 		}
 	}
@@ -83,33 +89,47 @@ func TestDestOptions(t *testing.T) {
 
 	// dest_dir and dest_dev should result in error.
 	r := strings.NewReader(baseConfig + "dest_dir=\"/dst\"\ndest_dev=\"/dev/foo\"")
-	if _, err := ParseConfig(r); err == nil {
+	if _, err := ParseConfig(r, ParseOptions{}); err == nil {
 		t.Fatalf("ParseConfig succeeded when dest_dir and dest_dev are set; want non-nil error")
 	}
 
 	// dest_dev and dest_host should result in error.
 	r = strings.NewReader(baseConfig + "dest_dev=\"/dev/foo\"\ndest_host=\"foohost\"")
-	if _, err := ParseConfig(r); err == nil {
+	if _, err := ParseConfig(r, ParseOptions{}); err == nil {
 		t.Fatalf("ParseConfig succeeded when key dest_dev and dest_host are set; want non-nil error")
 	}
 
 	// dest_dev and dest_luks_dev should result in error.
 	r = strings.NewReader(baseConfig + "dest_dev=\"/dev/foo\"\ndest_luks_dev=\"/luksdev\"\nluks_key_file=\"foo\"")
-	if _, err := ParseConfig(r); err == nil {
+	if _, err := ParseConfig(r, ParseOptions{}); err == nil {
 		t.Fatalf("ParseConfig succeeded when key dest_dev and luks_dest_dev are set; want non-nil error")
 	}
 
 	// dest_luks_dev without a key file should result in error.
 	r = strings.NewReader(baseConfig + "dest_luks_dev=\"/luksdev\"\nluks_key_file=\"foo\"")
-	if _, err := ParseConfig(r); err == nil {
+	if _, err := ParseConfig(r, ParseOptions{}); err == nil {
 		t.Fatalf("ParseConfig succeeded when key luks_dest_dev is set without a luks_kefile; want non-nil error")
 	}
 
 	// filesystem_cleanup without a filesystem destination should result in error.
 	r = strings.NewReader(baseConfig + "dest_dir=\"/dst\"\nfs_cleanup=\"yes\"")
-	if _, err := ParseConfig(r); err == nil {
+	if _, err := ParseConfig(r, ParseOptions{}); err == nil {
 		t.Fatalf("ParseConfig succeeded when key luks_dest_dev is set without a luks_kefile; want non-nil error")
 	}
+
+	// dest_dev by UUID or label should be accepted.
+	for _, dev := range []string{"UUID=1234-abcd", "LABEL=backup"} {
+		r = strings.NewReader(baseConfig + "dest_dev=\"" + dev + "\"")
+		if _, err := ParseConfig(r, ParseOptions{}); err != nil {
+			t.Fatalf("ParseConfig failed when dest_dev is %q: %v", dev, err)
+		}
+	}
+
+	// Relative dest_dev should result in error.
+	r = strings.NewReader(baseConfig + "dest_dev=\"sdb1\"")
+	if _, err := ParseConfig(r, ParseOptions{}); err == nil {
+		t.Fatalf("ParseConfig succeeded when dest_dev is a relative path; want non-nil error")
+	}
 }
 
 // Test source_is_mountpoint options.
@@ -118,13 +138,13 @@ func TestSourceIsMountpoint(t *testing.T) {
 
 	// Make sure source_is_mountpoint set to true doesn't cause an error
 	r := strings.NewReader(baseConfig)
-	if _, err := ParseConfig(r); err != nil {
+	if _, err := ParseConfig(r, ParseOptions{}); err != nil {
 		t.Fatalf("ParseConfig failed: %v", err)
 	}
 
 	// Make sure source_is_mountpoint set with source_host set results in error.
 	r = strings.NewReader(baseConfig + "source_host=\"meh\"\n")
-	if _, err := ParseConfig(r); err == nil {
+	if _, err := ParseConfig(r, ParseOptions{}); err == nil {
 		t.Errorf("ParseConfig succeeded when source_is_mountpoint and source_host are set; want non-nil error")
 	}
 }
@@ -138,7 +158,7 @@ func TestLoggingOptions(t *testing.T) {
 
 	// LogDir and no Logfile
 	r := strings.NewReader(baseConfig + "log_dir=\"" + logDir + "\"")
-	cfg, err := ParseConfig(r)
+	cfg, err := ParseConfig(r, ParseOptions{})
 	if err != nil {
 		t.Fatalf("ParseConfig failed: %v", err)
 	}
@@ -151,7 +171,7 @@ func TestLoggingOptions(t *testing.T) {
 
 	// Logfile and no LogDir
 	r = strings.NewReader(baseConfig + "log_file=\"" + logFile + "\"")
-	cfg, err = ParseConfig(r)
+	cfg, err = ParseConfig(r, ParseOptions{})
 	if err != nil {
 		t.Fatalf("ParseConfig failed: %v", err)
 	}
@@ -164,7 +184,7 @@ func TestLoggingOptions(t *testing.T) {
 
 	// Blank Logfile & Blank LogDir == default LogDir
 	r = strings.NewReader(baseConfig)
-	cfg, err = ParseConfig(r)
+	cfg, err = ParseConfig(r, ParseOptions{})
 	if err != nil {
 		t.Fatalf("ParseConfig failed: %v", err)
 	}
@@ -174,10 +194,14 @@ func TestLoggingOptions(t *testing.T) {
 	if cfg.Logfile != "" {
 		t.Errorf("log_file should be empty; is %s", cfg.Logfile)
 	}
+	// No status file unless configured.
+	if cfg.StatusFile != "" {
+		t.Errorf("status_file should be empty; is %s", cfg.StatusFile)
+	}
 
 	// Logfile and LogDir should result in error
 	r = strings.NewReader(baseConfig + "log_file=\"" + logFile + "\"\nlog_dir=\"" + logDir + "\"")
-	if _, err := ParseConfig(r); err == nil {
+	if _, err := ParseConfig(r, ParseOptions{}); err == nil {
 		t.Errorf("ParseConfig succeeded when keys log_dir and log_file are set; want non-nil error")
 	}
 }
@@ -188,30 +212,44 @@ func TestRelativePaths(t *testing.T) {
 	// Relative source_dir, local backup (FAIL)
 	cstr := "name=\"foo\"\nsource_dir=\"a\"\ndest_dir=\"/b\"\ntransport=\"transp\""
 	r := strings.NewReader(cstr)
-	if _, err := ParseConfig(r); err == nil {
+	if _, err := ParseConfig(r, ParseOptions{}); err == nil {
 		t.Fatalf("ParseConfig succeeded when source_dir is a relative path; want non-nil error: %v", err)
 	}
 
 	// Relative dest_dir, local backup (FAIL)
 	cstr = "name=\"foo\"\nsource_dir=\"/a\"\ndest_dir=\"b\"\ntransport=\"transp\""
 	r = strings.NewReader(cstr)
-	if _, err := ParseConfig(r); err == nil {
+	if _, err := ParseConfig(r, ParseOptions{}); err == nil {
 		t.Fatalf("ParseConfig succeeded when dest_dir is a relative path; want non-nil error: %v", err)
 	}
 
 	// Relative source_dir, sourc_host set (OK)
 	cstr = "name=\"foo\"\nsource_dir=\"a\"\nsource_host=\"foo\"\ndest_dir=\"/b\"\ntransport=\"transp\""
 	r = strings.NewReader(cstr)
-	if _, err := ParseConfig(r); err != nil {
+	if _, err := ParseConfig(r, ParseOptions{}); err != nil {
 		t.Fatalf("ParseConfig failed when source_dir is a relative path and source_host is set: %v", err)
 	}
 
 	// Relative dest_dir, local backup
 	cstr = "name=\"foo\"\nsource_dir=\"/a\"\ndest_dir=\"b\"\ndest_host=\"foo\"\ntransport=\"transp\""
 	r = strings.NewReader(cstr)
-	if _, err := ParseConfig(r); err != nil {
+	if _, err := ParseConfig(r, ParseOptions{}); err != nil {
 		t.Fatalf("ParseConfig failed when dest_dir is a relative path and dest_host is set: %v", err)
 	}
+
+	// Restic backend URL as dest_dir, restic transport (OK)
+	cstr = "name=\"foo\"\nsource_dir=\"/a\"\ndest_dir=\"s3:host/bucket\"\ntransport=\"restic\""
+	r = strings.NewReader(cstr)
+	if _, err := ParseConfig(r, ParseOptions{}); err != nil {
+		t.Fatalf("ParseConfig failed when dest_dir is a restic backend URL: %v", err)
+	}
+
+	// Restic backend URL as dest_dir, other transport (FAIL)
+	cstr = "name=\"foo\"\nsource_dir=\"/a\"\ndest_dir=\"s3:host/bucket\"\ntransport=\"rsync\""
+	r = strings.NewReader(cstr)
+	if _, err := ParseConfig(r, ParseOptions{}); err == nil {
+		t.Fatalf("ParseConfig succeeded when dest_dir is a restic backend URL with a non-restic transport; want non-nil error")
+	}
 }
 
 // Test that Exclude and Include produce lists of strings.
@@ -219,7 +257,7 @@ func TestParseConfigLists(t *testing.T) {
 	cstr := "name=\"foo\"\ntransport=\"transp\"\nsource_dir=\"/src\"\ndest_dir=\"/dst\"\nexclude=[\"aa\", \"bb\", \"cc\"]\ninclude=[\"dd\", \"ee\", \"ff\"]"
 	r := strings.NewReader(cstr)
 
-	cfg, err := ParseConfig(r)
+	cfg, err := ParseConfig(r, ParseOptions{})
 	if err != nil {
 		t.Fatal("ParseConfig failed:", err)
 	}
@@ -234,3 +272,904 @@ func TestParseConfigLists(t *testing.T) {
 		t.Errorf("Include should be %s, is %s", expected, cfg.Name)
 	}
 }
+
+// Test that empty patterns in include and exclude are rejected.
+func TestParseConfigBlankPatterns(t *testing.T) {
+	baseConfig := "name=\"foo\"\ntransport=\"transp\"\nsource_dir=\"/src\"\ndest_dir=\"/dst\"\n"
+
+	casetests := []struct {
+		config    string
+		wantError string
+	}{
+		{config: "exclude=[\"aa\", \"bb\"]\ninclude=[\"cc\"]\n"},
+		{config: "exclude=[\"aa\", \"\"]\n", wantError: "exclude contains an empty pattern (item 2)"},
+		{config: "exclude=[\"  \", \"aa\"]\n", wantError: "exclude contains an empty pattern (item 1)"},
+		{config: "include=[\"aa\", \"\\t\"]\n", wantError: "include contains an empty pattern (item 2)"},
+	}
+	for _, tt := range casetests {
+		_, err := ParseConfig(strings.NewReader(baseConfig+tt.config), ParseOptions{})
+		if tt.wantError == "" {
+			if err != nil {
+				t.Errorf("config %q: got error %v, want no error", tt.config, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+			t.Errorf("config %q: got error %v, want %q", tt.config, err, tt.wantError)
+		}
+	}
+}
+
+// Test that filters cannot be combined with include or exclude.
+func TestParseConfigFilters(t *testing.T) {
+	baseConfig := "name=\"foo\"\ntransport=\"transp\"\nsource_dir=\"/src\"\ndest_dir=\"/dst\"\nfilters=[\"+ aa\", \"- *\"]\n"
+
+	r := strings.NewReader(baseConfig)
+	cfg, err := ParseConfig(r, ParseOptions{})
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	expected := []string{"+ aa", "- *"}
+	if !arrayEqual(cfg.Filters, expected) {
+		t.Errorf("Filters should be %s, is %s", expected, cfg.Filters)
+	}
+
+	r = strings.NewReader(baseConfig + "exclude=[\"bb\"]\n")
+	if _, err := ParseConfig(r, ParseOptions{}); err == nil {
+		t.Errorf("ParseConfig succeeded when filters and exclude are set; want non-nil error")
+	}
+	r = strings.NewReader(baseConfig + "include=[\"bb\"]\n")
+	if _, err := ParseConfig(r, ParseOptions{}); err == nil {
+		t.Errorf("ParseConfig succeeded when filters and include are set; want non-nil error")
+	}
+}
+
+// Test include_config merge precedence and relative path resolution.
+func TestParseConfigFileInclude(t *testing.T) {
+	tmpdir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(tmpdir, "sub"), 0755); err != nil {
+		t.Fatalf("error creating directory: %v", err)
+	}
+
+	files := map[string]string{
+		// Included from main.toml (relative to tmpdir).
+		"sub/common.toml": "include_config=[\"logs.toml\"]\nname=\"common\"\nexclude=[\"aa\", \"bb\"]\ntransport=\"rsync\"\n",
+		// Included from sub/common.toml (relative to tmpdir/sub).
+		"sub/logs.toml": "log_dir=\"/logs\"\ntransport=\"rclone\"\n",
+		"main.toml":     "include_config=[\"sub/common.toml\"]\nname=\"main\"\nsource_dir=\"/src\"\ndest_dir=\"/dst\"\n",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(tmpdir, name), []byte(contents), 0644); err != nil {
+			t.Fatalf("error writing %s: %v", name, err)
+		}
+	}
+
+	cfg, err := ParseConfigFile(filepath.Join(tmpdir, "main.toml"), ParseOptions{})
+	if err != nil {
+		t.Fatalf("ParseConfigFile failed: %v", err)
+	}
+	// Values in the including file win.
+	if cfg.Name != "main" {
+		t.Errorf("name should be main; is %s", cfg.Name)
+	}
+	// Values in the included file win over nested includes.
+	if cfg.Transport != "rsync" {
+		t.Errorf("transport should be rsync; is %s", cfg.Transport)
+	}
+	expected := []string{"aa", "bb"}
+	if !arrayEqual(cfg.Exclude, expected) {
+		t.Errorf("Exclude should be %s, is %s", expected, cfg.Exclude)
+	}
+	if cfg.LogDir != "/logs" {
+		t.Errorf("log_dir should be /logs; is %s", cfg.LogDir)
+	}
+
+	// Lists in the including file replace lists in included files.
+	override := "include_config=[\"sub/common.toml\"]\nname=\"main\"\nsource_dir=\"/src\"\ndest_dir=\"/dst\"\nexclude=[\"cc\"]\n"
+	if err := os.WriteFile(filepath.Join(tmpdir, "override.toml"), []byte(override), 0644); err != nil {
+		t.Fatalf("error writing override.toml: %v", err)
+	}
+	cfg, err = ParseConfigFile(filepath.Join(tmpdir, "override.toml"), ParseOptions{})
+	if err != nil {
+		t.Fatalf("ParseConfigFile failed: %v", err)
+	}
+	expected = []string{"cc"}
+	if !arrayEqual(cfg.Exclude, expected) {
+		t.Errorf("Exclude should be %s, is %s", expected, cfg.Exclude)
+	}
+
+	// Missing include files result in error.
+	missing := "include_config=[\"missing.toml\"]\nname=\"main\"\nsource_dir=\"/src\"\ndest_dir=\"/dst\"\n"
+	if err := os.WriteFile(filepath.Join(tmpdir, "missing_inc.toml"), []byte(missing), 0644); err != nil {
+		t.Fatalf("error writing missing_inc.toml: %v", err)
+	}
+	if _, err := ParseConfigFile(filepath.Join(tmpdir, "missing_inc.toml"), ParseOptions{}); err == nil {
+		t.Errorf("ParseConfigFile succeeded with a missing include file; want non-nil error")
+	}
+
+	// Recursive includes result in error.
+	loop := "include_config=[\"loop.toml\"]\n"
+	if err := os.WriteFile(filepath.Join(tmpdir, "loop.toml"), []byte(loop), 0644); err != nil {
+		t.Fatalf("error writing loop.toml: %v", err)
+	}
+	if _, err := ParseConfigFile(filepath.Join(tmpdir, "loop.toml"), ParseOptions{}); err == nil {
+		t.Errorf("ParseConfigFile succeeded with recursive includes; want non-nil error")
+	}
+}
+
+// Test that patterns in exclude_from are added to the exclusions, with CRLF
+// line endings, blank lines, and comments removed.
+func TestParseConfigExcludeFrom(t *testing.T) {
+	dir := t.TempDir()
+	contents := "# Windows style list\r\n*.tmp\r\n\r\n  # indented comment\r\ncache dir/\r\n   \r\nlast"
+	if err := os.WriteFile(filepath.Join(dir, "excludes.txt"), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfgfile := filepath.Join(dir, "backup.toml")
+	cfg := "name=\"foo\"\ntransport=\"rsync\"\nsource_dir=\"/tmp\"\ndest_dir=\"/tmp\"\nexclude=[\"a\"]\nexclude_from=\"excludes.txt\"\n"
+	if err := os.WriteFile(cfgfile, []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := ParseConfigFile(cfgfile, ParseOptions{})
+	if err != nil {
+		t.Fatalf("ParseConfigFile failed: %v", err)
+	}
+	want := []string{"a", "*.tmp", "cache dir/", "last"}
+	if !reflect.DeepEqual(config.Exclude, want) {
+		t.Errorf("exclude: got %q, want %q", config.Exclude, want)
+	}
+
+	// Missing files are errors.
+	cfg = strings.Replace(cfg, "excludes.txt", "missing.txt", 1)
+	if err := os.WriteFile(cfgfile, []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseConfigFile(cfgfile, ParseOptions{}); err == nil {
+		t.Errorf("ParseConfigFile with missing exclude_from: got no error, want error")
+	}
+}
+
+// Test that shell must be an absolute path.
+func TestParseConfigShell(t *testing.T) {
+	baseConfig := "name=\"foo\"\ntransport=\"transp\"\nsource_dir=\"/src\"\ndest_dir=\"/dst\"\n"
+
+	r := strings.NewReader(baseConfig + "shell=\"/bin/bash\"\n")
+	cfg, err := ParseConfig(r, ParseOptions{})
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if cfg.Shell != "/bin/bash" {
+		t.Errorf("shell should be /bin/bash; is %s", cfg.Shell)
+	}
+
+	r = strings.NewReader(baseConfig + "shell=\"bash\"\n")
+	if _, err := ParseConfig(r, ParseOptions{}); err == nil {
+		t.Errorf("ParseConfig succeeded when shell is a relative path; want non-nil error")
+	}
+}
+
+// Test multiple destinations.
+func TestParseConfigDestinations(t *testing.T) {
+	baseConfig := "name=\"foo\"\ntransport=\"transp\"\nsource_dir=\"/src\"\n"
+
+	casetests := []struct {
+		config    string
+		wantDests []Destination
+		wantError bool
+	}{
+		// Local and remote destinations.
+		{
+			config: "[[destination]]\ndest_dir=\"/dst1\"\n[[destination]]\ndest_host=\"host\"\ndest_dir=\"dst2\"\n",
+			wantDests: []Destination{
+				{DestDir: "/dst1"},
+				{DestHost: "host", DestDir: "dst2"},
+			},
+		},
+		// Device destination.
+		{
+			config:    "[[destination]]\ndest_dir=\"/dst1\"\n[[destination]]\ndest_dev=\"/dev/foo\"\n",
+			wantDests: []Destination{{DestDir: "/dst1"}, {DestDev: "/dev/foo"}},
+		},
+		// Invalid destination (relative local path).
+		{
+			config:    "[[destination]]\ndest_dir=\"/dst1\"\n[[destination]]\ndest_dir=\"dst2\"\n",
+			wantError: true,
+		},
+		// Invalid destination (two destinations in one entry).
+		{
+			config:    "[[destination]]\ndest_dir=\"/dst1\"\ndest_dev=\"/dev/foo\"\n",
+			wantError: true,
+		},
+		// Destinations and dest_dir in the main configuration.
+		{
+			config:    "dest_dir=\"/dst\"\n[[destination]]\ndest_dir=\"/dst1\"\n",
+			wantError: true,
+		},
+		// Fail fast with multiple destinations.
+		{
+			config:    "dest_fail_fast=true\n[[destination]]\ndest_dir=\"/dst1\"\n[[destination]]\ndest_dir=\"/dst2\"\n",
+			wantDests: []Destination{{DestDir: "/dst1"}, {DestDir: "/dst2"}},
+		},
+		// Fail fast requires destinations.
+		{
+			config:    "dest_fail_fast=true\ndest_dir=\"/dst\"\n",
+			wantError: true,
+		},
+	}
+	for _, tt := range casetests {
+		cfg, err := ParseConfig(strings.NewReader(baseConfig+tt.config), ParseOptions{})
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("config %q: got no error, want error", tt.config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("config %q: got error %v, want no error", tt.config, err)
+			continue
+		}
+		if !reflect.DeepEqual(cfg.Destinations, tt.wantDests) {
+			t.Errorf("config %q: got destinations %+v, want %+v", tt.config, cfg.Destinations, tt.wantDests)
+		}
+		// ForDestination returns a single destination configuration.
+		for i, d := range tt.wantDests {
+			dcfg := cfg.ForDestination(i)
+			if dcfg.DestDir != d.DestDir || dcfg.DestHost != d.DestHost || dcfg.DestDev != d.DestDev || len(dcfg.Destinations) != 0 {
+				t.Errorf("ForDestination(%d): got %+v, want destination %+v", i, dcfg, d)
+			}
+		}
+	}
+}
+
+// Test that the typed values are set in multiple destination configurations
+// (and the single destination configurations derived from them.)
+func TestParseConfigDestinationsNormalize(t *testing.T) {
+	cstr := "name=\"foo\"\ntransport=\"rsync\"\nsource_dir=\"/src\"\ntransport_timeout=\"6h\"\nrsync_ignore_vanished=false\n" +
+		"[[destination]]\ndest_dir=\"/dst1\"\n[[destination]]\ndest_dir=\"/dst2\"\n"
+	cfg, err := ParseConfig(strings.NewReader(cstr), ParseOptions{})
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	want := Parsed{TransportTimeout: 6 * time.Hour, ResticVerbosity: 2, RdiffVerbosity: 5, RdiffForce: true}
+	if cfg.Parsed != want {
+		t.Errorf("Parsed: got %+v, want %+v", cfg.Parsed, want)
+	}
+	for i := range cfg.Destinations {
+		if got := cfg.ForDestination(i).Parsed; got != want {
+			t.Errorf("ForDestination(%d).Parsed: got %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+// Test mount_point validation.
+func TestParseConfigMountPoint(t *testing.T) {
+	baseConfig := "name=\"foo\"\ntransport=\"transp\"\nsource_dir=\"/src\"\n"
+
+	casetests := []struct {
+		config    string
+		wantError bool
+	}{
+		{config: "dest_dev=\"/dev/foo\"\nmount_point=\"/mnt/backup\"\n"},
+		{config: "dest_dev=\"/dev/foo\"\nmount_point=\"mnt/backup\"\n", wantError: true},
+		{config: "dest_dir=\"/dst\"\nmount_point=\"/mnt/backup\"\n", wantError: true},
+		{config: "dest_dev=\"/dev/foo\"\nreuse_existing_mount=true\n"},
+		{config: "dest_dir=\"/dst\"\nreuse_existing_mount=true\n", wantError: true},
+		{config: "dest_dev=\"/dev/foo\"\nreuse_existing_mount=true\nfs_cleanup=true\n", wantError: true},
+		{config: "dest_dev=\"/dev/foo\"\nreuse_existing_mount=true\npower_down_dest=true\n", wantError: true},
+	}
+	for _, tt := range casetests {
+		_, err := ParseConfig(strings.NewReader(baseConfig+tt.config), ParseOptions{})
+		if tt.wantError != (err != nil) {
+			t.Errorf("config %q: got error %v, want error: %v", tt.config, err, tt.wantError)
+		}
+	}
+}
+
+// Test tmp_dir defaults and validation.
+func TestParseConfigTmpDir(t *testing.T) {
+	baseConfig := "name=\"foo\"\ntransport=\"transp\"\nsource_dir=\"/src\"\ndest_dir=\"/dst\"\n"
+
+	// Default is the system temporary directory.
+	r := strings.NewReader(baseConfig)
+	cfg, err := ParseConfig(r, ParseOptions{})
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if cfg.TmpDir != os.TempDir() {
+		t.Errorf("tmp_dir should be %s; is %s", os.TempDir(), cfg.TmpDir)
+	}
+
+	// Existing directory.
+	tmpdir := t.TempDir()
+	r = strings.NewReader(baseConfig + "tmp_dir=\"" + tmpdir + "\"\n")
+	cfg, err = ParseConfig(r, ParseOptions{})
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if cfg.TmpDir != tmpdir {
+		t.Errorf("tmp_dir should be %s; is %s", tmpdir, cfg.TmpDir)
+	}
+
+	// Non-existing directory.
+	r = strings.NewReader(baseConfig + "tmp_dir=\"" + filepath.Join(tmpdir, "missing") + "\"\n")
+	if _, err := ParseConfig(r, ParseOptions{}); err == nil {
+		t.Errorf("ParseConfig succeeded when tmp_dir does not exist; want non-nil error")
+	}
+
+	// The default temporary directory is not checked.
+	t.Setenv("TMPDIR", filepath.Join(tmpdir, "missing"))
+	if _, err := ParseConfig(strings.NewReader(baseConfig), ParseOptions{}); err != nil {
+		t.Errorf("ParseConfig with an unusable default temporary directory: got error %v, want no error", err)
+	}
+}
+
+// Test that LUKS keyfiles readable by group or others are refused, unless
+// luks_insecure_keyfile is set.
+func TestLuksKeyfilePerms(t *testing.T) {
+	baseConfig := "name=\"foo\"\ntransport=\"transp\"\nsource_dir=\"/src\"\nluks_dest_dev=\"/dev/foo\"\n"
+	tmpdir := t.TempDir()
+
+	casetests := []struct {
+		mode      os.FileMode
+		insecure  bool
+		wantError bool
+	}{
+		{mode: 0600},
+		{mode: 0400},
+		{mode: 0640, wantError: true},
+		{mode: 0604, wantError: true},
+		{mode: 0644, wantError: true},
+		{mode: 0644, insecure: true},
+		{mode: 0640, insecure: true},
+	}
+
+	for _, tt := range casetests {
+		keyfile := filepath.Join(tmpdir, "keyfile")
+		if err := os.WriteFile(keyfile, []byte("secret"), 0600); err != nil {
+			t.Fatalf("error writing keyfile: %v", err)
+		}
+		if err := os.Chmod(keyfile, tt.mode); err != nil {
+			t.Fatalf("error setting keyfile permissions: %v", err)
+		}
+		cstr := baseConfig + "luks_keyfile=\"" + keyfile + "\"\n"
+		if tt.insecure {
+			cstr += "luks_insecure_keyfile=true\n"
+		}
+		_, err := ParseConfig(strings.NewReader(cstr), ParseOptions{})
+		if tt.wantError && err == nil {
+			t.Errorf("ParseConfig succeeded with keyfile mode %04o (insecure=%v); want non-nil error", tt.mode, tt.insecure)
+		}
+		if !tt.wantError && err != nil {
+			t.Errorf("ParseConfig failed with keyfile mode %04o (insecure=%v): %v", tt.mode, tt.insecure, err)
+		}
+		os.Remove(keyfile)
+	}
+
+	// Missing keyfile.
+	cstr := baseConfig + "luks_keyfile=\"" + filepath.Join(tmpdir, "missing") + "\"\n"
+	if _, err := ParseConfig(strings.NewReader(cstr), ParseOptions{}); err == nil {
+		t.Errorf("ParseConfig succeeded with a missing keyfile; want non-nil error")
+	}
+}
+
+// Test prune_interval validation.
+func TestParseConfigPruneInterval(t *testing.T) {
+	baseConfig := "name=\"foo\"\ntransport=\"transp\"\nsource_dir=\"/src\"\ndest_dir=\"/dst\"\n"
+
+	r := strings.NewReader(baseConfig + "prune_interval=\"168h\"\n")
+	if _, err := ParseConfig(r, ParseOptions{}); err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	r = strings.NewReader(baseConfig + "prune_interval=\"7 days\"\n")
+	if _, err := ParseConfig(r, ParseOptions{}); err == nil {
+		t.Errorf("ParseConfig succeeded with invalid prune_interval; want non-nil error")
+	}
+}
+
+// Test max_file_size validation and size parsing.
+func TestParseConfigMaxFileSize(t *testing.T) {
+	baseConfig := "name=\"foo\"\ntransport=\"rsync\"\nsource_dir=\"/tmp\"\ndest_dir=\"/tmp\"\n"
+
+	casetests := []struct {
+		size      string
+		want      int64
+		wantError bool
+	}{
+		{size: "100", want: 100},
+		{size: "2K", want: 2048},
+		{size: "2k", want: 2048},
+		{size: "2G", want: 2 << 30},
+		{size: "1T", want: 1 << 40},
+		{size: "2GB", wantError: true},
+		{size: "1.5G", wantError: true},
+		{size: "G", wantError: true},
+	}
+	for _, tt := range casetests {
+		_, err := ParseConfig(strings.NewReader(baseConfig+fmt.Sprintf("max_file_size=%q\n", tt.size)), ParseOptions{})
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("max_file_size=%q: got no error, want error", tt.size)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("max_file_size=%q: got error %v, want no error", tt.size, err)
+		}
+		if got, _ := ParseSize(tt.size); got != tt.want {
+			t.Errorf("ParseSize(%q): got %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
+
+// Test that the defaults file is merged as a base for the configuration.
+func TestParseConfigDefaults(t *testing.T) {
+	dir := t.TempDir()
+	opts := ParseOptions{DefaultsFile: filepath.Join(dir, "defaults.toml")}
+	defaults := "exclude=[\"lost+found\", \".Trash-*\"]\nshell=\"/bin/bash\"\nlog_dir=\"/var/log/foo\"\n"
+	if err := ioutil.WriteFile(opts.DefaultsFile, []byte(defaults), 0644); err != nil {
+		t.Fatalf("error writing defaults file: %v", err)
+	}
+
+	baseConfig := "name=\"foo\"\ntransport=\"rsync\"\nsource_dir=\"/tmp\"\ndest_dir=\"/tmp\"\n"
+
+	casetests := []struct {
+		job         string
+		wantExclude []string
+		wantShell   string
+		wantLogDir  string
+		wantLogfile string
+	}{
+		// Defaults only.
+		{
+			wantExclude: []string{"lost+found", ".Trash-*"},
+			wantShell:   "/bin/bash",
+			wantLogDir:  "/var/log/foo",
+		},
+		// Job excludes are appended, other values override the defaults.
+		{
+			job:         "exclude=[\"/cache\"]\nshell=\"/bin/zsh\"\n",
+			wantExclude: []string{"lost+found", ".Trash-*", "/cache"},
+			wantShell:   "/bin/zsh",
+			wantLogDir:  "/var/log/foo",
+		},
+		// The log_file in the job overrides the default log_dir.
+		{
+			job:         "log_file=\"/tmp/foo.log\"\n",
+			wantExclude: []string{"lost+found", ".Trash-*"},
+			wantShell:   "/bin/bash",
+			wantLogfile: "/tmp/foo.log",
+		},
+	}
+	for _, tt := range casetests {
+		cfg, err := ParseConfig(strings.NewReader(baseConfig+tt.job), opts)
+		if err != nil {
+			t.Fatalf("ParseConfig failed: %v", err)
+		}
+		if !reflect.DeepEqual(cfg.Exclude, tt.wantExclude) {
+			t.Errorf("exclude: got %q, want %q", cfg.Exclude, tt.wantExclude)
+		}
+		if cfg.Shell != tt.wantShell {
+			t.Errorf("shell: got %q, want %q", cfg.Shell, tt.wantShell)
+		}
+		if cfg.LogDir != tt.wantLogDir || cfg.Logfile != tt.wantLogfile {
+			t.Errorf("log_dir, log_file: got %q, %q, want %q, %q", cfg.LogDir, cfg.Logfile, tt.wantLogDir, tt.wantLogfile)
+		}
+	}
+
+	// A missing defaults file is ignored.
+	cfg, err := ParseConfig(strings.NewReader(baseConfig), ParseOptions{DefaultsFile: filepath.Join(dir, "missing.toml")})
+	if err != nil {
+		t.Fatalf("ParseConfig with missing defaults failed: %v", err)
+	}
+	if len(cfg.Exclude) != 0 {
+		t.Errorf("exclude with missing defaults: got %q, want empty", cfg.Exclude)
+	}
+
+	// Unknown keys in the defaults file are errors.
+	if err := ioutil.WriteFile(opts.DefaultsFile, []byte("foo=\"bar\"\n"), 0644); err != nil {
+		t.Fatalf("error writing defaults file: %v", err)
+	}
+	if _, err := ParseConfig(strings.NewReader(baseConfig), opts); err == nil {
+		t.Errorf("ParseConfig with invalid defaults: got no error, want error")
+	}
+}
+
+// Test that the test transport must be enabled explicitly.
+func TestParseConfigTestTransport(t *testing.T) {
+	cstr := "name=\"foo\"\ntransport=\"test\"\nsource_dir=\"/src\"\ndest_dir=\"/dst\"\n"
+	if _, err := ParseConfig(strings.NewReader(cstr), ParseOptions{}); err == nil {
+		t.Errorf("ParseConfig with the test transport disabled: got no error, want error")
+	}
+	if _, err := ParseConfig(strings.NewReader(cstr), ParseOptions{EnableTestTransport: true}); err != nil {
+		t.Errorf("ParseConfig with the test transport enabled: got error %v, want no error", err)
+	}
+}
+
+// Test that rsync specific options require the rsync transport.
+func TestParseConfigRsyncOptions(t *testing.T) {
+	casetests := []struct {
+		transport string
+		option    string
+		wantError bool
+	}{
+		{transport: "rsync", option: "rsync_inplace"},
+		{transport: "rsync", option: "rsync_sparse"},
+		{transport: "restic", option: "rsync_inplace", wantError: true},
+		{transport: "rclone", option: "rsync_sparse", wantError: true},
+		{transport: "rsync", option: "rsync_ignore_vanished"},
+		{transport: "restic", option: "rsync_ignore_vanished", wantError: true},
+		{transport: "rsync", option: "rsync_cvs_exclude"},
+		{transport: "rclone", option: "rsync_cvs_exclude", wantError: true},
+	}
+	for _, tt := range casetests {
+		cfg := fmt.Sprintf("name=\"foo\"\ntransport=%q\nsource_dir=\"/tmp\"\ndest_dir=\"/tmp\"\n%s=true\n", tt.transport, tt.option)
+		_, err := ParseConfig(strings.NewReader(cfg), ParseOptions{})
+		if tt.wantError != (err != nil) {
+			t.Errorf("transport=%q %s: got error %v, want error: %v", tt.transport, tt.option, err, tt.wantError)
+		}
+	}
+}
+
+// Test that features not supported by the transport fail at parse time.
+func TestParseConfigCapabilities(t *testing.T) {
+	casetests := []struct {
+		transport string
+		options   string
+		wantError bool
+	}{
+		{transport: "restic", options: "include=[\"foo\"]", wantError: true},
+		{transport: "restic", options: "source_host=\"host\"", wantError: true},
+		{transport: "restic", options: "dest_host=\"host\""},
+		{transport: "restic", options: "filters=[\"+ foo\"]", wantError: true},
+		{transport: "rsync", options: "include=[\"foo\"]"},
+		{transport: "rsync", options: "source_host=\"host\""},
+		{transport: "rsync", options: "source_host=\"host\"\ndest_host=\"host\"", wantError: true},
+		{transport: "rdiff-backup", options: "source_host=\"host\"\ndest_host=\"host\"", wantError: true},
+		{transport: "rdiff-backup", options: "filters=[\"+ foo\"]", wantError: true},
+		{transport: "tar", options: "dest_host=\"host\"", wantError: true},
+		{transport: "rclone", options: "filters=[\"+ foo\"]"},
+		{transport: "rsync", options: "write_manifest=true"},
+		{transport: "tar", options: "write_manifest=true"},
+		{transport: "restic", options: "write_manifest=true", wantError: true},
+		{transport: "rclone", options: "rclone_log_level=\"debug\"\nrclone_stats=\"1m\""},
+		{transport: "rsync", options: "rsync_ignore_file=\".rsync-filter\""},
+		{transport: "rsync", options: "rsync_ignore_file=\"dir/.rsync-filter\"", wantError: true},
+		{transport: "restic", options: "rsync_ignore_file=\".rsync-filter\"", wantError: true},
+		{transport: "rdiff-backup", options: "expire_count=10"},
+		{transport: "rdiff-backup", options: "expire_count=-1", wantError: true},
+		{transport: "rdiff-backup", options: "expire_count=10\nexpire_days=30", wantError: true},
+		{transport: "restic", options: "expire_count=10", wantError: true},
+		{transport: "rclone", options: "rclone_log_level=\"ERROR\"", wantError: true},
+		{transport: "rclone", options: "rclone_stats=\"foo\"", wantError: true},
+		{transport: "rsync", options: "rclone_log_level=\"INFO\"", wantError: true},
+		{transport: "rsync", options: "rclone_stats=\"1m\"", wantError: true},
+		// Unknown transports are not checked.
+		{transport: "transp", options: "include=[\"foo\"]"},
+	}
+	for _, tt := range casetests {
+		cfg := fmt.Sprintf("name=\"foo\"\ntransport=%q\nsource_dir=\"/tmp\"\ndest_dir=\"/tmp\"\n%s\n", tt.transport, tt.options)
+		_, err := ParseConfig(strings.NewReader(cfg), ParseOptions{})
+		if tt.wantError != (err != nil) {
+			t.Errorf("transport=%q %q: got error %v, want error: %v", tt.transport, tt.options, err, tt.wantError)
+		}
+	}
+}
+
+// Test the bandwidth schedule resolution at several times of day.
+func TestBandwidthSchedule(t *testing.T) {
+	schedule, err := ParseBandwidthSchedule([]string{
+		"08:00-18:00=1M",
+		"22:30-06:00=10M",
+		"18:00-22:30=5M",
+	})
+	if err != nil {
+		t.Fatalf("ParseBandwidthSchedule failed: %v", err)
+	}
+
+	casetests := []struct {
+		hhmm string
+		want string
+	}{
+		{hhmm: "08:00", want: "1M"},
+		{hhmm: "12:34", want: "1M"},
+		{hhmm: "17:59", want: "1M"},
+		{hhmm: "18:00", want: "5M"},
+		{hhmm: "22:29", want: "5M"},
+		// Window wrapping around midnight.
+		{hhmm: "22:30", want: "10M"},
+		{hhmm: "23:59", want: "10M"},
+		{hhmm: "00:00", want: "10M"},
+		{hhmm: "05:59", want: "10M"},
+		// No window applies.
+		{hhmm: "06:00", want: ""},
+		{hhmm: "07:59", want: ""},
+	}
+	for _, tt := range casetests {
+		now, err := time.Parse("15:04", tt.hhmm)
+		if err != nil {
+			t.Fatalf("invalid time %q: %v", tt.hhmm, err)
+		}
+		if got := BandwidthLimit(schedule, now); got != tt.want {
+			t.Errorf("BandwidthLimit at %s: got %q, want %q", tt.hhmm, got, tt.want)
+		}
+	}
+
+	// Invalid entries.
+	for _, e := range []string{"8:00-18:00=1M", "08:00-24:00=1M", "08:00-18:00", "08:00-18:00=fast", "08:00/18:00=1M"} {
+		if _, err := ParseBandwidthSchedule([]string{e}); err == nil {
+			t.Errorf("ParseBandwidthSchedule(%q): got no error, want error", e)
+		}
+	}
+}
+
+// Test that YAML configurations decode to the same values as the equivalent
+// TOML configurations.
+func TestParseConfigYAML(t *testing.T) {
+	tomlConfig := `
+name = "foo"
+transport = "rsync"
+source_dir = "/src"
+dest_host = "host"
+dest_dir = "/dst"
+expire_days = 10
+exclude_caches = true
+exclude = ["a", "b/c"]
+rsync_args = ["--foo", "--bar"]
+pre_command = "echo pre"
+`
+	yamlConfig := `
+# Comments are fine.
+name: foo
+transport: rsync
+source_dir: /src
+dest_host: host
+dest_dir: /dst
+expire_days: 10
+exclude_caches: true
+exclude:
+  - a
+  - b/c
+rsync_args: ["--foo", "--bar"]
+pre_command: echo pre
+`
+	want, err := ParseConfig(strings.NewReader(tomlConfig), ParseOptions{})
+	if err != nil {
+		t.Fatalf("ParseConfig (TOML) failed: %v", err)
+	}
+
+	// Auto-detected from the contents.
+	got, err := ParseConfig(strings.NewReader(yamlConfig), ParseOptions{})
+	if err != nil {
+		t.Fatalf("ParseConfig (YAML) failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("YAML config differs from TOML:\ngot  %+v\nwant %+v", got, want)
+	}
+
+	// Auto-detected from the file name.
+	fname := filepath.Join(t.TempDir(), "foo.yml")
+	if err := os.WriteFile(fname, []byte("name: foo\ntransport: rsync\nsource_dir: /src\ndest_host: host\ndest_dir: /dst\nexpire_days: 10\nexclude_caches: true\nexclude: [a, b/c]\nrsync_args: [--foo, --bar]\npre_command: echo pre\n"), 0644); err != nil {
+		t.Fatalf("error writing config: %v", err)
+	}
+	got, err = ParseConfigFile(fname, ParseOptions{})
+	if err != nil {
+		t.Fatalf("ParseConfigFile (YAML) failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("YAML config file differs from TOML:\ngot  %+v\nwant %+v", got, want)
+	}
+
+	// Destinations.
+	got, err = ParseConfig(strings.NewReader("name: foo\ntransport: rsync\nsource_dir: /src\ndestination:\n  - dest_dir: /dst1\n  - dest_host: host\n    dest_dir: dst2\n"), ParseOptions{})
+	if err != nil {
+		t.Fatalf("ParseConfig (YAML destinations) failed: %v", err)
+	}
+	wantDests := []Destination{{DestDir: "/dst1"}, {DestHost: "host", DestDir: "dst2"}}
+	if !reflect.DeepEqual(got.Destinations, wantDests) {
+		t.Errorf("got destinations %+v, want %+v", got.Destinations, wantDests)
+	}
+
+	// Validation and unknown keys work the same way.
+	for _, cstr := range []string{
+		"name: foo\ntransport: rsync\nsource_dir: /src\n",
+		"name: foo\ntransport: rsync\nsource_dir: /src\ndest_dir: /dst\ninvalidkey: foo\n",
+	} {
+		if _, err := ParseConfig(strings.NewReader(cstr), ParseOptions{}); err == nil {
+			t.Errorf("config %q: got no error, want error", cstr)
+		}
+	}
+
+	// Forced format.
+	if _, err := ParseConfig(strings.NewReader(yamlConfig), ParseOptions{Format: FormatTOML}); err == nil {
+		t.Errorf("YAML config parsed as TOML: got no error, want error")
+	}
+}
+
+// Test that custom (x_ prefixed) keys are ignored, while other unknown keys
+// still result in error.
+func TestParseConfigCustomKeys(t *testing.T) {
+	casetests := []struct {
+		config    string
+		wantError bool
+	}{
+		// TOML.
+		{config: "name=\"foo\"\ntransport=\"rsync\"\nsource_dir=\"/src\"\ndest_dir=\"/dst\"\nx_note=\"Owned by the web team\"\n"},
+		{config: "name=\"foo\"\ntransport=\"rsync\"\nsource_dir=\"/src\"\nx_tags=[\"a\", \"b\"]\n[[destination]]\ndest_dir=\"/dst\"\nx_note=\"USB disk\"\n[x_meta]\nowner=\"web\"\n"},
+		{config: "name=\"foo\"\ntransport=\"rsync\"\nsource_dir=\"/src\"\ndest_dir=\"/dst\"\nnote=\"Owned by the web team\"\n", wantError: true},
+		// YAML.
+		{config: "name: foo\ntransport: rsync\nsource_dir: /src\ndest_dir: /dst\nx_note: Owned by the web team\n"},
+		{config: "name: foo\ntransport: rsync\nsource_dir: /src\nx_meta:\n  owner: web\ndestination:\n  - dest_dir: /dst\n    x_note: USB disk\n"},
+		{config: "name: foo\ntransport: rsync\nsource_dir: /src\ndest_dir: /dst\nnote: Owned by the web team\n", wantError: true},
+	}
+	for _, tt := range casetests {
+		cfg, err := ParseConfig(strings.NewReader(tt.config), ParseOptions{})
+		if tt.wantError {
+			if err == nil || !strings.Contains(err.Error(), "unknown field") {
+				t.Errorf("config %q: got error %v, want unknown field error", tt.config, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("config %q: got error %v, want no error", tt.config, err)
+			continue
+		}
+		if cfg.Name != "foo" || cfg.SourceDir != "/src" {
+			t.Errorf("config %q: got %+v, want name foo and source_dir /src", tt.config, cfg)
+		}
+	}
+}
+
+// Test that log_date_format must produce file name safe dates.
+func TestParseConfigLogDateFormat(t *testing.T) {
+	casetests := []struct {
+		layout    string
+		wantError bool
+	}{
+		{layout: "2006-01-02"},
+		{layout: "2006-01-02T150405"},
+		{layout: "20060102.15h04m-0700"},
+		{layout: "Mon_Jan_02"},
+		// Space padded day of the month.
+		{layout: "Mon_Jan_2", wantError: true},
+		{layout: "2006/01/02", wantError: true},
+		{layout: "15:04:05", wantError: true},
+		{layout: "Jan 2", wantError: true},
+	}
+	for _, tt := range casetests {
+		cfg := fmt.Sprintf("name=\"foo\"\ntransport=\"rsync\"\nsource_dir=\"/tmp\"\ndest_dir=\"/tmp\"\nlog_date_format=%q\n", tt.layout)
+		_, err := ParseConfig(strings.NewReader(cfg), ParseOptions{})
+		if tt.wantError != (err != nil) {
+			t.Errorf("log_date_format=%q: got error %v, want error: %v", tt.layout, err, tt.wantError)
+		}
+	}
+}
+
+// Test that prometheus_metric_prefix must be a valid metric name.
+func TestParseConfigPromMetricPrefix(t *testing.T) {
+	casetests := []struct {
+		prefix    string
+		wantError bool
+	}{
+		{prefix: "myorg_netbackup"},
+		{prefix: "myorg:netbackup"},
+		{prefix: "_nb2"},
+		{prefix: "2nb", wantError: true},
+		{prefix: "my-org", wantError: true},
+		{prefix: "my org", wantError: true},
+	}
+	for _, tt := range casetests {
+		cfg := fmt.Sprintf("name=\"foo\"\ntransport=\"rsync\"\nsource_dir=\"/tmp\"\ndest_dir=\"/tmp\"\nprometheus_metric_prefix=%q\n", tt.prefix)
+		_, err := ParseConfig(strings.NewReader(cfg), ParseOptions{})
+		if tt.wantError != (err != nil) {
+			t.Errorf("prometheus_metric_prefix=%q: got error %v, want error: %v", tt.prefix, err, tt.wantError)
+		}
+	}
+}
+
+// Test that prometheus_labels are parsed, and that invalid or reserved label
+// names are rejected.
+func TestParseConfigPromLabels(t *testing.T) {
+	casetests := []struct {
+		labels    string
+		want      map[string]string
+		wantError bool
+	}{
+		{labels: "prometheus_labels = { host = \"a\", tier = \"gold\" }", want: map[string]string{"host": "a", "tier": "gold"}},
+		{labels: "[prometheus_labels]\nschedule = \"daily\"", want: map[string]string{"schedule": "daily"}},
+		{labels: "prometheus_labels = { \"my-label\" = \"a\" }", wantError: true},
+		{labels: "prometheus_labels = { __meta = \"a\" }", wantError: true},
+		{labels: "prometheus_labels = { job = \"a\" }", wantError: true},
+	}
+	for _, tt := range casetests {
+		cfg := fmt.Sprintf("name=\"foo\"\ntransport=\"rsync\"\nsource_dir=\"/tmp\"\ndest_dir=\"/tmp\"\n%s\n", tt.labels)
+		config, err := ParseConfig(strings.NewReader(cfg), ParseOptions{})
+		if tt.wantError != (err != nil) {
+			t.Errorf("%q: got error %v, want error: %v", tt.labels, err, tt.wantError)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(config.PromLabels, tt.want) {
+			t.Errorf("%q: got labels %v, want %v", tt.labels, config.PromLabels, tt.want)
+		}
+	}
+}
+
+// Test that run_as_user must be an existing user.
+func TestParseConfigRunAsUser(t *testing.T) {
+	casetests := []struct {
+		user      string
+		wantError bool
+	}{
+		{user: "root"},
+		{user: "0"},
+		{user: "netbackup-no-such-user", wantError: true},
+		{user: "987654321", wantError: true},
+	}
+	for _, tt := range casetests {
+		cfg := fmt.Sprintf("name=\"foo\"\ntransport=\"restic\"\nsource_dir=\"/tmp\"\ndest_dir=\"/tmp\"\nrun_as_user=%q\n", tt.user)
+		_, err := ParseConfig(strings.NewReader(cfg), ParseOptions{})
+		if tt.wantError != (err != nil) {
+			t.Errorf("run_as_user=%q: got error %v, want error: %v", tt.user, err, tt.wantError)
+		}
+	}
+}
+
+// Test that duration and size options are parsed into typed values, and that
+// invalid values result in an error naming the option.
+func TestParseConfigNormalize(t *testing.T) {
+	baseConfig := "name=\"foo\"\ntransport=\"rsync\"\nsource_dir=\"/src\"\ndest_dev=\"/dev/foo\"\n"
+
+	casetests := []struct {
+		config    string
+		want      Parsed
+		wantError string
+	}{
+		// Nothing set.
+		{config: "", want: Parsed{RsyncIgnoreVanished: true, ResticVerbosity: 2, RdiffVerbosity: 5, RdiffForce: true}},
+		// Durations.
+		{config: "wait_for_device=\"10m\"\n", want: Parsed{WaitForDevice: 10 * time.Minute, RsyncIgnoreVanished: true, ResticVerbosity: 2, RdiffVerbosity: 5, RdiffForce: true}},
+		{config: "umount_timeout=\"1m30s\"\n", want: Parsed{UmountTimeout: 90 * time.Second, RsyncIgnoreVanished: true, ResticVerbosity: 2, RdiffVerbosity: 5, RdiffForce: true}},
+		{config: "luks_close_timeout=\"45s\"\n", want: Parsed{LuksCloseTimeout: 45 * time.Second, RsyncIgnoreVanished: true, ResticVerbosity: 2, RdiffVerbosity: 5, RdiffForce: true}},
+		{config: "prune_interval=\"168h\"\n", want: Parsed{PruneInterval: 168 * time.Hour, RsyncIgnoreVanished: true, ResticVerbosity: 2, RdiffVerbosity: 5, RdiffForce: true}},
+		{
+			config: "pre_command_timeout=\"1m\"\ntransport_timeout=\"6h\"\npost_command_timeout=\"500ms\"\n",
+			want:   Parsed{PreCommandTimeout: time.Minute, TransportTimeout: 6 * time.Hour, PostCommandTimeout: 500 * time.Millisecond, RsyncIgnoreVanished: true, ResticVerbosity: 2, RdiffVerbosity: 5, RdiffForce: true},
+		},
+		// Sizes.
+		{config: "max_file_size=\"2G\"\n", want: Parsed{MaxFileSize: 2 << 30, RsyncIgnoreVanished: true, ResticVerbosity: 2, RdiffVerbosity: 5, RdiffForce: true}},
+		{config: "max_file_size=\"512k\"\n", want: Parsed{MaxFileSize: 512 << 10, RsyncIgnoreVanished: true, ResticVerbosity: 2, RdiffVerbosity: 5, RdiffForce: true}},
+		// Booleans defaulting to true.
+		{config: "rsync_ignore_vanished=true\n", want: Parsed{RsyncIgnoreVanished: true, ResticVerbosity: 2, RdiffVerbosity: 5, RdiffForce: true}},
+		{config: "rsync_ignore_vanished=false\n", want: Parsed{ResticVerbosity: 2, RdiffVerbosity: 5, RdiffForce: true}},
+		{config: "rdiff_force=false\n", want: Parsed{RsyncIgnoreVanished: true, ResticVerbosity: 2, RdiffVerbosity: 5}},
+		// Integers with a non-zero default.
+		{config: "restic_verbosity=0\n", want: Parsed{RsyncIgnoreVanished: true, RdiffVerbosity: 5, RdiffForce: true}},
+		{config: "restic_verbosity=3\n", want: Parsed{RsyncIgnoreVanished: true, ResticVerbosity: 3, RdiffVerbosity: 5, RdiffForce: true}},
+		{config: "rdiff_verbosity=3\n", want: Parsed{RsyncIgnoreVanished: true, ResticVerbosity: 2, RdiffVerbosity: 3, RdiffForce: true}},
+		// Invalid values.
+		{config: "wait_for_device=\"10 minutes\"\n", wantError: "wait_for_device"},
+		{config: "umount_timeout=\"30\"\n", wantError: "umount_timeout"},
+		{config: "luks_close_timeout=\"-5s\"\n", wantError: "luks_close_timeout"},
+		{config: "transport_timeout=\"forever\"\n", wantError: "transport_timeout"},
+		{config: "max_file_size=\"2 GB\"\n", wantError: "max_file_size"},
+		{config: "restic_verbosity=4\n", wantError: "restic_verbosity"},
+		{config: "restic_verbosity=-1\n", wantError: "restic_verbosity"},
+		{config: "rdiff_verbosity=10\n", wantError: "rdiff_verbosity"},
+	}
+	for _, tt := range casetests {
+		cfg, err := ParseConfig(strings.NewReader(baseConfig+tt.config), ParseOptions{})
+		if tt.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Errorf("config %q: got error %v, want error mentioning %s", tt.config, err, tt.wantError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("config %q: got error %v, want no error", tt.config, err)
+			continue
+		}
+		if cfg.Parsed != tt.want {
+			t.Errorf("config %q: got parsed values %+v, want %+v", tt.config, cfg.Parsed, tt.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package execute
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/marcopaganini/netbackup/clock"
+)
+
+// auditKey is the context key for the audit log.
+type auditKey struct{}
+
+// auditLog holds the audit log file name and the name of the job.
+type auditLog struct {
+	path string
+	job  string
+}
+
+// AuditEntry is a line in the audit log.
+type AuditEntry struct {
+	Time     string   `json:"time"`
+	Job      string   `json:"job"`
+	Argv     []string `json:"argv"`
+	ExitCode int      `json:"exit_code"`
+}
+
+// auditMu serializes writes to audit logs from the same process. Writes
+// from other processes are serialized with flock.
+var auditMu sync.Mutex
+
+// WithAuditLog returns a copy of ctx that causes RunCommand to append an
+// entry for every command executed by job to the audit log file in path.
+func WithAuditLog(ctx context.Context, path string, job string) context.Context {
+	return context.WithValue(ctx, auditKey{}, auditLog{path: path, job: job})
+}
+
+// audit appends an entry for cmd (redacted) and its exit status (from err)
+// to the audit log in ctx, if any. Each entry is a single JSON line, written
+// with the file locked, so concurrent jobs never interleave their entries.
+func audit(ctx context.Context, cmd []string, err error) error {
+	a, ok := ctx.Value(auditKey{}).(auditLog)
+	if !ok {
+		return nil
+	}
+	line, jerr := json.Marshal(AuditEntry{
+		Time:     clock.ClockValue(ctx).Now().Format(time.RFC3339),
+		Job:      a.job,
+		Argv:     Redact(ctx, cmd),
+		ExitCode: ExitCode(err),
+	})
+	if jerr != nil {
+		return fmt.Errorf("error writing audit log: %v", jerr)
+	}
+	line = append(line, '\n')
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	f, ferr := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if ferr != nil {
+		return fmt.Errorf("error opening audit log: %v", ferr)
+	}
+	defer f.Close()
+	if ferr := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); ferr != nil {
+		return fmt.Errorf("error locking audit log: %v", ferr)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	if _, ferr := f.Write(line); ferr != nil {
+		return fmt.Errorf("error writing audit log: %v", ferr)
+	}
+	return nil
+}
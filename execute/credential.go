@@ -0,0 +1,65 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package execute
+
+import (
+	"context"
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// credentialKey is the context key for the credential used to run commands.
+type credentialKey struct{}
+
+// WithCredential returns a copy of ctx that causes Exec to run commands with
+// the user and group IDs in cred.
+func WithCredential(ctx context.Context, cred *syscall.Credential) context.Context {
+	return context.WithValue(ctx, credentialKey{}, cred)
+}
+
+// CredentialValue returns the credential in ctx, or nil if commands run as
+// the current user.
+func CredentialValue(ctx context.Context) *syscall.Credential {
+	cred, _ := ctx.Value(credentialKey{}).(*syscall.Credential)
+	return cred
+}
+
+// LookupUser returns the credential (user ID, primary group ID, and
+// supplementary group IDs) and the home directory of the user name, which
+// may also be a numeric user ID.
+func LookupUser(name string) (*syscall.Credential, string, error) {
+	u, err := user.Lookup(name)
+	if _, ok := err.(user.UnknownUserError); ok {
+		if _, nerr := strconv.Atoi(name); nerr == nil {
+			u, err = user.LookupId(name)
+		}
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to find user %q: %v", name, err)
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid uid %q for user %q", u.Uid, name)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid gid %q for user %q", u.Gid, name)
+	}
+	cred := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+
+	// Supplementary groups are optional (not all systems support them.)
+	if gids, err := u.GroupIds(); err == nil {
+		for _, g := range gids {
+			if n, err := strconv.ParseUint(g, 10, 32); err == nil && n != gid {
+				cred.Groups = append(cred.Groups, uint32(n))
+			}
+		}
+	}
+	return cred, u.HomeDir, nil
+}
@@ -17,6 +17,7 @@ import (
 	"time"
 
 	"github.com/marcopaganini/logger"
+	"github.com/marcopaganini/netbackup/clock"
 )
 
 // CallbackFunc represents callback functions functions for stdout/stderr output
@@ -26,7 +27,8 @@ type CallbackFunc func(string) error
 type Executor interface {
 	SetStdout(CallbackFunc)
 	SetStderr(CallbackFunc)
-	Exec([]string) error
+	SetEnv([]string)
+	Exec(context.Context, []string) error
 }
 
 // Execute defines a struct to easily run external programs and
@@ -34,6 +36,7 @@ type Executor interface {
 type Execute struct {
 	outWrite CallbackFunc
 	errWrite CallbackFunc
+	env      []string
 }
 
 // New returns a new Execute object
@@ -54,14 +57,35 @@ func (e *Execute) SetStderr(f CallbackFunc) {
 	e.errWrite = f
 }
 
+// SetEnv sets extra environment variables (in the "key=value" format) to be
+// added to the current environment of executed programs. A nil slice restores
+// the default (current environment only).
+func (e *Execute) SetEnv(env []string) {
+	e.env = env
+}
+
 // Exec runs a program specified in the slice cmd. The first element of the
 // slice is used as the executable name, and the rest as the arguments.  The
 // standard output and standard error of the executed program will be sent
 // line-by-line to outWrite() and errWrite() respectively. These (user
 // supplied) functions may decide to write to a file, file-descriptor or ignore
-// each of the lines in the output. Returns the error value from exec.Wait()
-func (e *Execute) Exec(cmd []string) error {
+// each of the lines in the output. If ctx contains a credential (see
+// WithCredential), the program runs with its user and group IDs. If ctx is
+// canceled while the program runs, the program is killed and the context
+// error is returned without waiting for its output to be closed (children of
+// a shell may keep it open). Otherwise, returns the error value from
+// exec.Wait()
+func (e *Execute) Exec(ctx context.Context, cmd []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	run := exec.Command(cmd[0], cmd[1:]...)
+	if len(e.env) != 0 {
+		run.Env = append(os.Environ(), e.env...)
+	}
+	if cred := CredentialValue(ctx); cred != nil {
+		run.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
 
 	// Grab stdout & stderr
 	stdout, err := run.StdoutPipe()
@@ -78,6 +102,20 @@ func (e *Execute) Exec(cmd []string) error {
 		return err
 	}
 
+	// Kill the program if ctx is canceled, and close our side of the pipes,
+	// so the streams below return even if other processes still hold them.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			run.Process.Kill()
+			stdout.Close()
+			stderr.Close()
+		case <-done:
+		}
+	}()
+
 	// Channels
 	outchan := make(chan error, 1)
 	errchan := make(chan error, 1)
@@ -96,12 +134,17 @@ func (e *Execute) Exec(cmd []string) error {
 		return fmt.Errorf("Error reading program's stderr: %v", err)
 	}
 
-	return run.Wait()
+	err = run.Wait()
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
 }
 
-// hmsNow returns the current time in HMS format (hour minute second)
-func hmsNow() string {
-	return time.Now().Format("15:04:05")
+// hmsNow returns the current time (according to the clock in ctx) in HMS
+// format (hour minute second)
+func hmsNow(ctx context.Context) string {
+	return clock.ClockValue(ctx).Now().Format("15:04:05")
 }
 
 // stream reads lines from an io.ReadCloser and calls outFunc() with each of
@@ -147,12 +190,14 @@ func ExitCode(err error) int {
 }
 
 // WithShell receives a string command and returns an slice ready to be passed
-// to Run or RunCommand with the current shell prepended to it.  The function
-// works as a helper to run strings commands using the shell with Run or
-// RunCommand.
-func WithShell(cmd string) []string {
+// to Run or RunCommand with the shell prepended to it.  The function works as
+// a helper to run strings commands using the shell with Run or RunCommand. If
+// shell is empty, the current shell ($SHELL) or /bin/sh is used.
+func WithShell(shell string, cmd string) []string {
 	// Run using shell
-	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = os.Getenv("SHELL")
+	}
 	if shell == "" {
 		shell = "/bin/sh"
 	}
@@ -172,12 +217,17 @@ func Run(ctx context.Context, prefix string, cmd []string) error {
 // with a verbosity level of 3. Every output line is prefixed by the current
 // HMS. If the Execute object is nil, a new one will be created. outFilter and
 // errFilter contain optional slices of substrings which, if matched, will
-// cause the entire line to be excluded from the output.
+// cause the entire line to be excluded from the output. Standard output and
+// standard error lines are also sent to the output and error parsers in ctx
+// (see WithOutputParser and WithErrorParser), standard output lines are
+// copied to the writer in ctx (see WithOutputCopy), and the command is added
+// to the audit log in ctx, if any (see WithAuditLog).
 func RunCommand(ctx context.Context, prefix string, cmd []string, ex Executor, outFilter []string, errFilter []string) error {
 	log := logger.LoggerValue(ctx)
+	clk := clock.ClockValue(ctx)
 
-	log.Verbosef(2, "%s Start: %s\n", prefix, time.Now().Format(time.Stamp))
-	log.Verbosef(1, "%s Command: %q\n", prefix, strings.Join(cmd, " "))
+	log.Verbosef(2, "%s Start: %s\n", prefix, clk.Now().Format(time.Stamp))
+	log.Verbosef(1, "%s Command: %q\n", prefix, strings.Join(Redact(ctx, cmd), " "))
 
 	// Create a new execute object, if current is nil
 	e := ex
@@ -188,15 +238,22 @@ func RunCommand(ctx context.Context, prefix string, cmd []string, ex Executor, o
 	// Filter functions: These functions will copy stderr and stdout to
 	// the log, omitting lines that match our filters.
 	errFilterFunc := func(buf string) error {
+		parseError(ctx, buf)
 		if errFilter == nil || !matchSlice(errFilter, buf) {
-			log.Verbosef(3, "%s (err): %s\n", hmsNow(), buf)
+			log.Verbosef(3, "%s (err): %s\n", hmsNow(ctx), buf)
 			return nil
 		}
 		return nil
 	}
+	copyFailed := false
 	outFilterFunc := func(buf string) error {
+		parseOutput(ctx, buf)
+		if err := copyOutput(ctx, buf); err != nil && !copyFailed {
+			log.Verbosef(1, "Warning: error copying output: %v\n", err)
+			copyFailed = true
+		}
 		if outFilter == nil || !matchSlice(outFilter, buf) {
-			log.Verbosef(3, "%s (out): %s\n", hmsNow(), buf)
+			log.Verbosef(3, "%s (out): %s\n", hmsNow(ctx), buf)
 			return nil
 		}
 		return nil
@@ -206,8 +263,11 @@ func RunCommand(ctx context.Context, prefix string, cmd []string, ex Executor, o
 	e.SetStderr(errFilterFunc)
 	e.SetStdout(outFilterFunc)
 
-	err := e.Exec(cmd)
-	log.Verbosef(2, "%s Finish: %s\n", prefix, time.Now().Format(time.Stamp))
+	err := e.Exec(ctx, cmd)
+	log.Verbosef(2, "%s Finish: %s\n", prefix, clk.Now().Format(time.Stamp))
+	if aerr := audit(ctx, cmd, err); aerr != nil {
+		log.Verbosef(1, "Warning: %v\n", aerr)
+	}
 	if err != nil {
 		log.Verbosef(1, "%s returned: %v\n", prefix, err)
 		return err
@@ -0,0 +1,62 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package execute
+
+import (
+	"context"
+	"io"
+)
+
+// parserKey is the context key for the output parser.
+type parserKey struct{}
+
+// errParserKey is the context key for the error output parser.
+type errParserKey struct{}
+
+// outputCopyKey is the context key for the copy of the standard output.
+type outputCopyKey struct{}
+
+// WithOutputParser returns a copy of ctx that causes RunCommand to pass every
+// line written by the program to its standard output to f, before filtering.
+func WithOutputParser(ctx context.Context, f func(string)) context.Context {
+	return context.WithValue(ctx, parserKey{}, f)
+}
+
+// parseOutput passes line to the output parser in ctx, if any.
+func parseOutput(ctx context.Context, line string) {
+	if f, ok := ctx.Value(parserKey{}).(func(string)); ok && f != nil {
+		f(line)
+	}
+}
+
+// WithErrorParser returns a copy of ctx that causes RunCommand to pass every
+// line written by the program to its standard error to f, before filtering.
+func WithErrorParser(ctx context.Context, f func(string)) context.Context {
+	return context.WithValue(ctx, errParserKey{}, f)
+}
+
+// parseError passes line to the error output parser in ctx, if any.
+func parseError(ctx context.Context, line string) {
+	if f, ok := ctx.Value(errParserKey{}).(func(string)); ok && f != nil {
+		f(line)
+	}
+}
+
+// WithOutputCopy returns a copy of ctx that causes RunCommand to write every
+// line written by the program to its standard output to w, as soon as it is
+// read and before filtering.
+func WithOutputCopy(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, outputCopyKey{}, w)
+}
+
+// copyOutput writes line to the output copy in ctx, if any.
+func copyOutput(ctx context.Context, line string) error {
+	if w, ok := ctx.Value(outputCopyKey{}).(io.Writer); ok && w != nil {
+		_, err := io.WriteString(w, line+"\n")
+		return err
+	}
+	return nil
+}
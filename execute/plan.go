@@ -0,0 +1,56 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package execute
+
+import (
+	"context"
+)
+
+// planKey is the context key for the plan.
+type planKey struct{}
+
+// phaseKey is the context key for the name of the current phase.
+type phaseKey struct{}
+
+// Plan holds the commands a backup runs (or would run, in dry-run mode),
+// grouped in phases, in order.
+type Plan struct {
+	Phases []PlanPhase `json:"phases"`
+}
+
+// PlanPhase is a phase of the backup (E.g. "mount", "pre", "transport") and
+// the commands it runs.
+type PlanPhase struct {
+	Name     string     `json:"name"`
+	Commands [][]string `json:"commands"`
+}
+
+// WithPlan returns a copy of ctx that causes RecordCommand (and PlanCommand)
+// to add commands to plan.
+func WithPlan(ctx context.Context, plan *Plan) context.Context {
+	return context.WithValue(ctx, planKey{}, plan)
+}
+
+// WithPhase returns a copy of ctx where commands are added to the plan under
+// the phase name.
+func WithPhase(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, phaseKey{}, name)
+}
+
+// PlanCommand adds cmd (redacted) to the plan in ctx, if any, under the
+// current phase. Consecutive commands in the same phase are grouped.
+func PlanCommand(ctx context.Context, cmd []string) {
+	plan, ok := ctx.Value(planKey{}).(*Plan)
+	if !ok {
+		return
+	}
+	name, _ := ctx.Value(phaseKey{}).(string)
+	if n := len(plan.Phases); n == 0 || plan.Phases[n-1].Name != name {
+		plan.Phases = append(plan.Phases, PlanPhase{Name: name})
+	}
+	p := &plan.Phases[len(plan.Phases)-1]
+	p.Commands = append(p.Commands, Redact(ctx, cmd))
+}
@@ -0,0 +1,43 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package execute
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// recorderKey is the context key for the command recorder.
+type recorderKey struct{}
+
+// WithCommandRecorder returns a copy of ctx that causes RecordCommand to
+// write commands into w.
+func WithCommandRecorder(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, recorderKey{}, w)
+}
+
+// RecordCommand writes cmd to the command recorder in ctx, if any. Each
+// argument is redacted (like in the logs) and written on a separate line, and
+// an empty line terminates the command. Commands are recorded in all modes,
+// including dry-run. The command is also added to the plan in ctx, if any.
+func RecordCommand(ctx context.Context, cmd []string) error {
+	PlanCommand(ctx, cmd)
+
+	w, ok := ctx.Value(recorderKey{}).(io.Writer)
+	if !ok {
+		return nil
+	}
+	for _, arg := range Redact(ctx, cmd) {
+		if _, err := fmt.Fprintln(w, arg); err != nil {
+			return fmt.Errorf("error recording command: %v", err)
+		}
+	}
+	if _, err := fmt.Fprintln(w); err != nil {
+		return fmt.Errorf("error recording command: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package execute
+
+import (
+	"sync"
+)
+
+// Tail keeps the last lines added to it, in a ring buffer. Its Add method can
+// be used as an output parser (see WithOutputParser and WithErrorParser). It
+// is safe for concurrent use.
+type Tail struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+// NewTail returns a Tail keeping the last n lines.
+func NewTail(n int) *Tail {
+	return &Tail{lines: make([]string, n)}
+}
+
+// Add adds a line to the tail, discarding the oldest line if full.
+func (t *Tail) Add(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.lines) == 0 {
+		return
+	}
+	t.lines[t.next] = line
+	t.next = (t.next + 1) % len(t.lines)
+	if t.next == 0 {
+		t.full = true
+	}
+}
+
+// Lines returns the lines in the tail, oldest first.
+func (t *Tail) Lines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.full {
+		return append([]string{}, t.lines[:t.next]...)
+	}
+	return append(append([]string{}, t.lines[t.next:]...), t.lines[:t.next]...)
+}
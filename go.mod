@@ -1,9 +1,10 @@
 module github.com/marcopaganini/netbackup
 
-go 1.13
+go 1.17
 
 require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/marcopaganini/logger v0.1.2
-	github.com/spf13/pflag v1.0.5 // indirect
+	github.com/spf13/pflag v1.0.5
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -7,33 +7,43 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/user"
 	"path/filepath"
-	"strings"
+	"strconv"
+	"syscall"
 	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/marcopaganini/logger"
+	"github.com/marcopaganini/netbackup/clock"
 	"github.com/marcopaganini/netbackup/config"
+	"github.com/marcopaganini/netbackup/execute"
+	"github.com/marcopaganini/netbackup/netbackup"
 	"github.com/spf13/pflag"
 )
 
 const (
-	progName     = "netbackup"
-	devMapperDir = "/dev/mapper"
+	progName = "netbackup"
 
-	// Default permissions for log directories and files.
-	// The current umask will apply to these.
+	// Machine-wide configuration defaults.
+	defaultDefaultsFile = "/etc/netbackup/defaults.toml"
+
+	// Default permissions for log directories and files. The current umask
+	// will apply to these, unless log_dir_mode or log_file_mode are set.
 	defaultLogDirMode  = 0777
 	defaultLogFileMode = 0666
 
-	// External commands.
-	mountCmd      = "mount"
-	umountCmd     = "umount"
-	cryptSetupCmd = "cryptsetup"
-	fsckCmd       = "fsck"
-	tunefsCmd     = "tune2fs"
+	// Default time layout for log names (overridden by log_date_format).
+	defaultLogDateFormat = "2006-01-02"
+
+	// Output formats (--output).
+	outputText = "text"
+	outputJSON = "json"
 )
 
 var (
@@ -43,13 +53,35 @@ var (
 	// Generic logging object.
 	log *logger.Logger
 
+	// Clock used for log names and timestamps. It can be replaced by a fixed
+	// clock (with --now or NETBACKUP_NOW) to produce reproducible results.
+	clk clock.Clock = clock.Real{}
+
 	// Command-line options.
 	opt struct {
-		config  string
-		dryrun  bool
-		help    bool
-		verbose int
-		version bool
+		auditLog       string
+		cleanupStale   bool
+		config         string
+		configFormat   string
+		defaultsFile   string
+		dryrun         bool
+		dumpConfig     bool
+		emitCommand    string
+		enableTest     bool
+		globalLockDir  string
+		help           bool
+		logFile        string
+		noLogfile      bool
+		maxGlobal      int
+		maxGlobalWait  bool
+		now            string
+		output         string
+		quiet          bool
+		selfNice       int
+		verbose        int
+		verifyManifest bool
+		version        bool
+		versions       bool
 	}
 )
 
@@ -65,11 +97,29 @@ func usage() {
 // basic sanity checking of flags fails.
 func parseFlags() error {
 	// Parse command line
-	pflag.StringVarP(&opt.config, "config", "c", "", "Config File")
+	pflag.StringVar(&opt.auditLog, "audit-log", "", "Append every command executed to this audit log file (overrides audit_log in the config)")
+	pflag.BoolVar(&opt.cleanupStale, "cleanup-stale", false, "Close the LUKS device mapper left behind by a crashed run of this backup, if not in use")
+	pflag.StringVarP(&opt.config, "config", "c", "", "Config File (use \"-\" to read from stdin)")
+	pflag.StringVar(&opt.configFormat, "config-format", "", "Config file format: toml or yaml (default: detect from the file name and contents)")
+	pflag.StringVar(&opt.defaultsFile, "defaults-file", defaultsFile(), "File with default values for all configurations (ignored if missing, default $NETBACKUP_DEFAULTS or "+defaultDefaultsFile+")")
 	pflag.BoolVarP(&opt.dryrun, "dry-run", "n", false, "Dry-run mode")
+	pflag.BoolVar(&opt.dumpConfig, "dump-config", false, "Print the effective configuration (after defaults and includes) as TOML and exit")
+	pflag.BoolVar(&opt.enableTest, "enable-test-transport", os.Getenv("NETBACKUP_ENABLE_TEST_TRANSPORT") == "1", "Enable the \"test\" transport, which copies no data (default $NETBACKUP_ENABLE_TEST_TRANSPORT=1)")
+	pflag.StringVar(&opt.emitCommand, "emit-command", "", "Write the transport and hook commands (redacted) to this file, one argument per line (works in dry-run mode)")
+	pflag.StringVar(&opt.globalLockDir, "global-lock-dir", defaultGlobalLockDir, "Directory for the --max-global lock files")
+	pflag.StringVar(&opt.logFile, "log-file", "", "Log file (overrides log_dir and log_file in the config)")
+	pflag.BoolVar(&opt.noLogfile, "no-logfile", false, "Do not write a log file (log to stderr only)")
+	pflag.IntVar(&opt.maxGlobal, "max-global", 0, "Maximum number of netbackup jobs running at once on this machine (0 = unlimited)")
+	pflag.BoolVar(&opt.maxGlobalWait, "max-global-wait", false, "Wait for a free slot instead of exiting when --max-global is reached")
+	pflag.StringVar(&opt.now, "now", os.Getenv("NETBACKUP_NOW"), "Use this fixed time (RFC3339) instead of the current time for log names and metric timestamps (default $NETBACKUP_NOW)")
 	pflag.BoolVarP(&opt.dryrun, "help", "h", false, "Quick help")
+	pflag.StringVar(&opt.output, "output", outputText, "Output format: text or json (json prints the dry-run plan to stdout; requires --dry-run)")
 	pflag.CountVarP(&opt.verbose, "verbose", "v", "Verbose mode (use multiple times to increase level)")
+	pflag.BoolVar(&opt.verifyManifest, "verify-manifest", false, "Verify the destination against its MANIFEST.sha256 (see write_manifest) instead of running the backup")
+	pflag.BoolVarP(&opt.quiet, "quiet", "q", false, "Quiet mode (only print errors; log file is still written)")
+	pflag.IntVar(&opt.selfNice, "self-nice", 0, "Run netbackup (and all commands) with this niceness, -20 to 19 (overrides self_nice in the config)")
 	pflag.BoolVarP(&opt.version, "version", "V", false, "Show version (build) number and exit")
+	pflag.BoolVar(&opt.versions, "versions", false, "Show version (build) number and the versions of the transport binaries and exit")
 	pflag.Parse()
 
 	// Help
@@ -77,57 +127,373 @@ func parseFlags() error {
 		usage()
 	}
 
+	if opt.maxGlobal < 0 {
+		return fmt.Errorf("--max-global must be zero or positive")
+	}
+	if opt.selfNice < -20 || opt.selfNice > 19 {
+		return fmt.Errorf("--self-nice must be between -20 and 19")
+	}
+	if opt.output != outputText && opt.output != outputJSON {
+		return fmt.Errorf("--output must be %q or %q", outputText, outputJSON)
+	}
+	if opt.output == outputJSON && !opt.dryrun {
+		return fmt.Errorf("--output=%s requires --dry-run", outputJSON)
+	}
+	if opt.noLogfile && opt.logFile != "" {
+		return fmt.Errorf("--no-logfile and --log-file are mutually exclusive")
+	}
+	if opt.configFormat != "" && opt.configFormat != config.FormatTOML && opt.configFormat != config.FormatYAML {
+		return fmt.Errorf("--config-format must be %q or %q", config.FormatTOML, config.FormatYAML)
+	}
+
+	// Fixed time, if requested.
+	if opt.now != "" {
+		t, err := time.Parse(time.RFC3339, opt.now)
+		if err != nil {
+			return fmt.Errorf("invalid time in --now/NETBACKUP_NOW (must be RFC3339): %v", err)
+		}
+		clk = clock.NewFake(t)
+	}
+
 	// Config is mandatory
-	if opt.config == "" && !opt.version {
+	if opt.config == "" && !opt.version && !opt.versions {
 		usage()
 		return fmt.Errorf("Configuration file must be specified with --config=config_filename")
 	}
 	return nil
 }
 
+// defaultsFile returns the name of the defaults file from the environment, or
+// the standard location.
+func defaultsFile() string {
+	if f, ok := os.LookupEnv("NETBACKUP_DEFAULTS"); ok {
+		return f
+	}
+	return defaultDefaultsFile
+}
+
 // logPath constructs the name for the output log using the the name and
-// the current system date.
-func logPath(name string, logDir string) string {
-	ymd := time.Now().Format("2006-01-02")
+// the current system date, formatted with the Go time layout in dateFormat
+// (or defaultLogDateFormat, if empty).
+func logPath(name string, logDir string, dateFormat string) string {
+	if dateFormat == "" {
+		dateFormat = defaultLogDateFormat
+	}
+	ymd := clk.Now().Format(dateFormat)
 	dir := filepath.Join(logDir, name)
 	return filepath.Join(dir, progName+"-"+name+"."+ymd+".log")
 }
 
+// readConfig reads and parses the configuration from the named file, or from
+// stdin if the name is "-".
+func readConfig(fname string, stdin io.Reader, opts config.ParseOptions) (*config.Config, error) {
+	if fname == "-" {
+		return config.ParseConfig(stdin, opts)
+	}
+	return config.ParseConfigFile(fname, opts)
+}
+
+// logFilename returns the name of the output log. The override (usually from
+// the command-line) takes precedence, followed by the log file specified in
+// the config. If neither is set, a "standard" name is created using the
+// backup name, log directory, and date.
+func logFilename(cfg *config.Config, override string) string {
+	switch {
+	case override != "":
+		return override
+	case cfg.Logfile != "":
+		return cfg.Logfile
+	}
+	return logPath(cfg.Name, cfg.LogDir, cfg.LogDateFormat)
+}
+
+// overran returns true if a backup taking d exceeded max_duration in cfg.
+func overran(cfg *config.Config, d time.Duration) bool {
+	return cfg.Parsed.MaxDuration > 0 && d > cfg.Parsed.MaxDuration
+}
+
+// setNice sets the niceness (scheduling priority) of the current process to
+// nice. On Linux, the niceness is a per-thread attribute, so it is set on all
+// threads listed in /proc/self/task (or only the current thread, if that is
+// not available). Threads and processes started afterwards inherit it.
+func setNice(nice int) error {
+	tids := []int{0}
+	if entries, err := ioutil.ReadDir("/proc/self/task"); err == nil {
+		tids = nil
+		for _, e := range entries {
+			if tid, err := strconv.Atoi(e.Name()); err == nil {
+				tids = append(tids, tid)
+			}
+		}
+	}
+	for _, tid := range tids {
+		// Threads may exit while we're at it.
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("unable to set niceness to %d: %w", nice, err)
+		}
+	}
+	return nil
+}
+
+// logPerms contains the permissions of the log files and directories created
+// by netbackup. Zero modes use the defaults (subject to the umask). Explicit
+// modes are set exactly, regardless of the umask.
+type logPerms struct {
+	fileMode os.FileMode
+	dirMode  os.FileMode
+	// Group owning the files and directories, or -1 to keep the default.
+	gid int
+}
+
+// defaultLogPerms are the log permissions used when none are configured.
+var defaultLogPerms = logPerms{gid: -1}
+
+// logPermsFromConfig returns the log permissions requested in the
+// configuration. The group in log_group may be a name or a numeric ID.
+func logPermsFromConfig(cfg *config.Config) (logPerms, error) {
+	perms := logPerms{
+		fileMode: cfg.Parsed.LogFileMode,
+		dirMode:  cfg.Parsed.LogDirMode,
+		gid:      -1,
+	}
+	if cfg.LogGroup == "" {
+		return perms, nil
+	}
+	gidstr := cfg.LogGroup
+	if g, err := user.LookupGroup(cfg.LogGroup); err == nil {
+		gidstr = g.Gid
+	}
+	gid, err := strconv.Atoi(gidstr)
+	if err != nil {
+		return perms, fmt.Errorf("unknown log_group %q", cfg.LogGroup)
+	}
+	perms.gid = gid
+	return perms, nil
+}
+
+// apply sets the explicit mode (if not zero) and group (if set) on path.
+func (p logPerms) apply(path string, mode os.FileMode) error {
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	if p.gid != -1 {
+		return os.Chown(path, -1, p.gid)
+	}
+	return nil
+}
+
+// mkdirAll creates the directory dir and any missing parents, applying perms
+// to the directories created.
+func mkdirAll(dir string, perms logPerms) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := mkdirAll(parent, perms); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, defaultLogDirMode); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return perms.apply(dir, perms.dirMode)
+}
+
+// rotateLog renames the log file in path to path.N (using the first unused
+// sequence number N, starting at 1) if it is larger than maxSize bytes, so a
+// fresh log is started. A maxSize of zero disables rotation. Returns the new
+// name of the log file, or an empty string if the file was not rotated.
+func rotateLog(path string, maxSize int64) (string, error) {
+	if maxSize <= 0 {
+		return "", nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil || fi.Size() <= maxSize {
+		return "", nil
+	}
+	for seq := 1; ; seq++ {
+		newpath := fmt.Sprintf("%s.%d", path, seq)
+		if _, err := os.Lstat(newpath); os.IsNotExist(err) {
+			if err := os.Rename(path, newpath); err != nil {
+				return "", fmt.Errorf("unable to rotate log file: %v", err)
+			}
+			return newpath, nil
+		}
+	}
+}
+
 // logOpen opens (for append) or creates (if needed) the specified file.
 // If the file doesn't exist, all intermediate directories will be created.
-// Returns an *os.File to the just opened file.
-func logOpen(path string) (*os.File, error) {
+// Files and directories created get the modes and group in perms. Returns an
+// *os.File to the just opened file.
+func logOpen(path string, perms logPerms) (*os.File, error) {
+	return logOpenFlags(path, perms, 0)
+}
+
+// logOpenFlags is like logOpen, but adds flags to the flags used to open the
+// file (E.g., syscall.O_NOFOLLOW).
+func logOpenFlags(path string, perms logPerms, flags int) (*os.File, error) {
 	// Create full directory path if it doesn't exist yet.
 	dir := filepath.Dir(path)
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		if err := os.MkdirAll(dir, defaultLogDirMode); err != nil {
-			return nil, fmt.Errorf("unable to create dir tree %q: %v", dir, err)
-		}
+	if err := mkdirAll(dir, perms); err != nil {
+		return nil, fmt.Errorf("unable to create dir tree %q: %v", dir, err)
 	}
 
 	// Open for append or create if doesn't exist.
-	w, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, defaultLogFileMode)
+	_, statErr := os.Stat(path)
+	w, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE|flags, defaultLogFileMode)
 	if err != nil {
 		return nil, fmt.Errorf("unable to open %q: %v", path, err)
 	}
+	if os.IsNotExist(statErr) {
+		if err := perms.apply(path, perms.fileMode); err != nil {
+			w.Close()
+			return nil, fmt.Errorf("unable to set permissions of %q: %v", path, err)
+		}
+	}
 	return w, nil
 }
 
-// isMounted returns true if the specified directory is mounted, false otherwise.
-// This function needs /proc/mounts to work.
-func isMounted(dirname string) (bool, error) {
-	d, err := ioutil.ReadFile("/proc/mounts")
+// nopWriteCloser is an io.WriteCloser with a no-op Close method.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// fallbackLogDir returns the directory used for logs when log_dir is not
+// writable: $XDG_STATE_HOME/netbackup, or a per-user directory under the
+// system temporary directory if XDG_STATE_HOME is not set. The latter is
+// created if needed and must be a private directory owned by the user (see
+// checkPrivateDir). There is no fallback under the temporary directory for
+// root.
+func fallbackLogDir() (string, error) {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, progName), nil
+	}
+	uid := os.Getuid()
+	if uid == 0 {
+		return "", fmt.Errorf("no fallback log directory for root (XDG_STATE_HOME not set)")
+	}
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("%s-%d", progName, uid))
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	if err := checkPrivateDir(dir, uid); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// checkPrivateDir returns an error unless dir is a directory (not a symbolic
+// link) owned by uid, with mode 0700.
+func checkPrivateDir(dir string, uid int) error {
+	fi, err := os.Lstat(dir)
 	if err != nil {
-		return false, err
+		return err
 	}
-	cslice := strings.Split(string(d), "\n")
-	for _, line := range cslice {
-		f := strings.Split(line, " ")
-		if len(f) > 1 && f[1] == dirname {
-			return true, nil
-		}
+	if !fi.IsDir() {
+		return fmt.Errorf("%q is not a directory", dir)
 	}
-	return false, nil
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != uid {
+		return fmt.Errorf("%q is not owned by uid %d", dir, uid)
+	}
+	if fi.Mode().Perm() != 0700 {
+		return fmt.Errorf("%q has mode %04o, want 0700", dir, fi.Mode().Perm())
+	}
+	return nil
+}
+
+// outputLog is the output log opened by openLog.
+type outputLog struct {
+	io.WriteCloser
+	// New name of the previous log, if rotated.
+	rotated string
+	// Error opening the log under log_dir, if the log was opened under
+	// fallbackLogDir instead.
+	fallbackErr error
+	path        string
+}
+
+// openLog rotates (if needed) and opens the output log for cfg (named by
+// logFilename), with the permissions in perms. If the log cannot be opened
+// under log_dir, it is opened under fallbackLogDir instead. Explicitly named
+// log files (override or log_file) have no fallback. If noLogfile is set, no
+// file is created and the returned log discards all output.
+func openLog(cfg *config.Config, override string, perms logPerms, noLogfile bool) (*outputLog, error) {
+	if noLogfile {
+		return &outputLog{WriteCloser: nopWriteCloser{ioutil.Discard}}, nil
+	}
+	logfile := logFilename(cfg, override)
+	rotated, err := rotateLog(logfile, cfg.Parsed.LogMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	w, openErr := logOpen(logfile, perms)
+	if openErr == nil {
+		return &outputLog{WriteCloser: w, rotated: rotated, path: logfile}, nil
+	}
+	if override != "" || cfg.Logfile != "" {
+		return nil, fmt.Errorf("Unable to open/create logfile: %v", openErr)
+	}
+
+	fallbackDir, err := fallbackLogDir()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open/create logfile: %v (fallback: %v)", openErr, err)
+	}
+	fallback := logPath(cfg.Name, fallbackDir, cfg.LogDateFormat)
+	if rotated, err = rotateLog(fallback, cfg.Parsed.LogMaxSize); err != nil {
+		return nil, err
+	}
+	if w, err = logOpenFlags(fallback, perms, syscall.O_NOFOLLOW); err != nil {
+		return nil, fmt.Errorf("Unable to open/create logfile: %v (fallback: %v)", openErr, err)
+	}
+	return &outputLog{WriteCloser: w, rotated: rotated, fallbackErr: openErr, path: fallback}, nil
+}
+
+// writePlan writes plan to w as indented JSON.
+func writePlan(w io.Writer, plan *execute.Plan) error {
+	if plan.Phases == nil {
+		plan.Phases = []execute.PlanPhase{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(plan); err != nil {
+		return fmt.Errorf("error writing plan: %v", err)
+	}
+	return nil
+}
+
+// writeConfig writes the effective configuration in cfg to w as TOML.
+// Include_config and exclude_from are omitted, since their contents have
+// already been merged into the configuration.
+func writeConfig(w io.Writer, cfg *config.Config) error {
+	c := *cfg
+	c.IncludeConfig = nil
+	c.ExcludeFrom = ""
+	if err := toml.NewEncoder(w).Encode(c); err != nil {
+		return fmt.Errorf("error writing configuration: %v", err)
+	}
+	return nil
+}
+
+// fatalf logs an error message and exits the program with the given exit
+// code.
+func fatalf(code int, format string, args ...interface{}) {
+	log.Printf(format, args...)
+	os.Exit(code)
+}
+
+// setLogOutput configures log to write to w. In quiet mode, output goes only
+// to w. Otherwise, output goes to stderr and is mirrored to w.
+func setLogOutput(log *logger.Logger, w io.Writer, quiet bool) {
+	if quiet {
+		log.SetOutputs([]io.Writer{w})
+		return
+	}
+	log.SetMirrorOutput(w)
 }
 
 func main() {
@@ -136,23 +502,36 @@ func main() {
 
 	// Parse command line flags and read config file.
 	if err := parseFlags(); err != nil {
-		log.Fatalf("Error: %v\n", err)
+		fatalf(netbackup.ExitConfig, "Error: %v\n", err)
 	}
 
 	// If version request, just print version and exit.
-	if opt.version {
+	if opt.version || opt.versions {
 		fmt.Printf("Version (Build): %s\n", Build)
+		if opt.versions {
+			for _, v := range binaryVersions(versionCmds) {
+				fmt.Println(v)
+			}
+		}
 		os.Exit(0)
 	}
 
-	// Open and parse config file.
-	cfg, err := os.Open(opt.config)
+	// Open and parse config file, on top of the defaults.
+	config, err := readConfig(opt.config, os.Stdin, config.ParseOptions{
+		Format:              opt.configFormat,
+		DefaultsFile:        opt.defaultsFile,
+		EnableTestTransport: opt.enableTest,
+	})
 	if err != nil {
-		log.Fatalf("Unable to open config file: %v\n", err)
+		fatalf(netbackup.ExitConfig, "Configuration error in %q: %v\n", opt.config, err)
 	}
-	config, err := config.ParseConfig(cfg)
-	if err != nil {
-		log.Fatalf("Configuration error in %q: %v\n", opt.config, err)
+
+	// Print the effective configuration and exit, if requested.
+	if opt.dumpConfig {
+		if err := writeConfig(os.Stdout, config); err != nil {
+			fatalf(netbackup.ExitError, "%v\n", err)
+		}
+		os.Exit(netbackup.ExitOK)
 	}
 
 	// Set log output and all other log related parameters.
@@ -160,41 +539,116 @@ func main() {
 	if verbose > 0 {
 		log.SetVerboseLevel(verbose)
 	}
-	// Create output log. Use the name specified in the config, if any,
-	// or create a "standard" name using the backup name and date.
-	logFilename := config.Logfile
-	if logFilename == "" {
-		logFilename = logPath(config.Name, config.LogDir)
+	// Create output log (unless --no-logfile). Use the name specified in the
+	// command-line or config, if any, or create a "standard" name using the
+	// backup name and date.
+	perms, err := logPermsFromConfig(config)
+	if err != nil {
+		fatalf(netbackup.ExitConfig, "Configuration error in %q: %v\n", opt.config, err)
 	}
-	outLog, err := logOpen(logFilename)
+	outLog, err := openLog(config, opt.logFile, perms, opt.noLogfile)
 	if err != nil {
-		log.Fatalf("Unable to open/create logfile: %v\n", err)
+		fatalf(netbackup.ExitError, "%v\n", err)
 	}
 	defer outLog.Close()
 
-	// Configure log to log everything to stderr and outLog
-	log.SetMirrorOutput(outLog)
+	// Configure log to log everything to stderr (unless in quiet mode) and outLog.
+	setLogOutput(log, outLog, opt.quiet)
+	if outLog.fallbackErr != nil {
+		log.Printf("Warning: %v; logging to %q instead\n", outLog.fallbackErr, outLog.path)
+	}
+	if outLog.rotated != "" {
+		log.Verbosef(1, "Log file larger than log_max_size, previous contents moved to %q\n", outLog.rotated)
+	}
 
-	// Add Logger to context.
+	// Lower (or raise) the priority of the whole process, if requested.
+	if opt.selfNice != 0 {
+		config.SelfNice = opt.selfNice
+	}
+	if config.SelfNice != 0 {
+		if err := setNice(config.SelfNice); err != nil {
+			log.Verbosef(1, "Warning: %v\n", err)
+		} else {
+			log.Verbosef(2, "Niceness set to %d\n", config.SelfNice)
+		}
+	}
+
+	// Add Logger to context. A fixed time (--now) only applies to log names
+	// and metric timestamps; everything else uses the real clock.
 	ctx = logger.WithLogger(ctx, log)
+	ctx = clock.WithTimestampClock(ctx, clk)
+
+	// Add redaction patterns to context.
+	ctx, err = execute.WithRedactPatterns(ctx, config.RedactPatterns)
+	if err != nil {
+		fatalf(netbackup.ExitConfig, "%v\n", err)
+	}
+
+	// Audit log of all commands executed, if requested.
+	if opt.auditLog != "" {
+		config.AuditLog = opt.auditLog
+	}
+	if config.AuditLog != "" {
+		ctx = execute.WithAuditLog(ctx, config.AuditLog, config.Name)
+	}
+
+	// Record the commands to a file, if requested.
+	if opt.emitCommand != "" {
+		w, err := os.OpenFile(opt.emitCommand, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			fatalf(netbackup.ExitError, "Unable to create command file: %v\n", err)
+		}
+		defer w.Close()
+		ctx = execute.WithCommandRecorder(ctx, w)
+	}
 
 	if opt.dryrun {
 		log.Verboseln(1, "Warning: Dry-Run mode. Won't execute any commands.")
 	}
 
-	// Create new Backup and execute.
-	b := NewBackup(config, opt.dryrun)
+	// Collect the plan of commands, to be printed as JSON.
+	var plan execute.Plan
+	if opt.output == outputJSON {
+		ctx = execute.WithPlan(ctx, &plan)
+	}
 
-	if err = b.Run(ctx); err != nil {
-		log.Fatalln(err)
+	// Limit the number of concurrent jobs, if requested.
+	if opt.maxGlobal > 0 {
+		sem := newGlobalSemaphore(opt.globalLockDir, opt.maxGlobal)
+		if err := sem.acquire(ctx, opt.maxGlobalWait, semPollInterval); err != nil {
+			fatalf(netbackup.ExitBusy, "Unable to start backup: %v\n", err)
+		}
+		defer sem.release()
 	}
-	// Save node (prometheus) compatible textfile, if requested.
-	if config.PromTextFile != "" {
-		log.Verbosef(1, "Writing node-exporter (prometheus) textfile to: %s\n", config.PromTextFile)
-		if err := writeNodeTextFile(config.PromTextFile, config.Name); err != nil {
-			log.Verbosef(1, "Warning: Unable to write node (prometheus) textfile: %v\n", err)
+
+	// Execute the backup.
+	res, err := netbackup.Run(ctx, config, netbackup.Options{DryRun: opt.dryrun, CleanupStale: opt.cleanupStale, VerifyManifest: opt.verifyManifest})
+	// Successful runs stay silent by default (E.g., no mail from cron).
+	if err != nil {
+		log.Println(res)
+	} else {
+		log.Verbosef(1, "%v\n", res)
+	}
+
+	if opt.output == outputJSON && err == nil {
+		if err := writePlan(os.Stdout, &plan); err != nil {
+			fatalf(netbackup.ExitError, "%v\n", err)
 		}
 	}
 
-	log.Verboseln(1, "*** Backup Result: Success")
+	// Warn about backups taking longer than expected. These are not
+	// killed (use the timeouts for that.)
+	if overran(config, res.Duration) && !opt.dryrun && !opt.verifyManifest {
+		log.Printf("WARNING: Backup took %v, longer than max_duration (%v)\n", res.Duration.Round(time.Second), config.Parsed.MaxDuration)
+		if err := netbackup.WriteOverranMetric(ctx, config); err != nil {
+			log.Verbosef(1, "Warning: Unable to write node (prometheus) textfile: %v\n", err)
+		}
+	}
+	if err != nil {
+		// In quiet mode, log only goes to the log file.
+		if opt.quiet {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		fatalf(netbackup.ExitCode(err), "%v\n", err)
+	}
 }
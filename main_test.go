@@ -6,10 +6,22 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/marcopaganini/logger"
+	"github.com/marcopaganini/netbackup/clock"
+	"github.com/marcopaganini/netbackup/config"
 )
 
 // Test logOpen
@@ -22,7 +34,7 @@ func TestLogOpen(t *testing.T) {
 	w.Close()
 
 	// Test specific file under /tmp. File must exist at the end.
-	w, err = logOpen(testFname)
+	w, err = logOpen(testFname, defaultLogPerms)
 	if err != nil {
 		t.Fatalf("logOpen failed: %v", err)
 	}
@@ -39,7 +51,7 @@ func TestLogOpen(t *testing.T) {
 	}
 	logpath := "a/b/c/log"
 
-	w, err = logOpen(filepath.Join(basedir, logpath))
+	w, err = logOpen(filepath.Join(basedir, logpath), defaultLogPerms)
 	if err != nil {
 		t.Fatalf("logOpen failed: %v", err)
 	}
@@ -52,3 +64,475 @@ func TestLogOpen(t *testing.T) {
 	}
 	os.RemoveAll(basedir)
 }
+
+// Test that logOpen creates files and directories with the requested modes
+// and group, regardless of the umask.
+func TestLogOpenPerms(t *testing.T) {
+	basedir := t.TempDir()
+	perms := logPerms{fileMode: 0640, dirMode: 0750, gid: os.Getgid()}
+
+	fname := filepath.Join(basedir, "a", "b", "log")
+	w, err := logOpen(fname, perms)
+	if err != nil {
+		t.Fatalf("logOpen failed: %v", err)
+	}
+	w.Close()
+
+	for _, tt := range []struct {
+		path string
+		want os.FileMode
+	}{
+		{path: fname, want: 0640},
+		{path: filepath.Join(basedir, "a", "b"), want: 0750 | os.ModeDir},
+		{path: filepath.Join(basedir, "a"), want: 0750 | os.ModeDir},
+	} {
+		fi, err := os.Stat(tt.path)
+		if err != nil {
+			t.Fatalf("error on stat: %v", err)
+		}
+		if fi.Mode() != tt.want {
+			t.Errorf("%s: got mode %v, want %v", tt.path, fi.Mode(), tt.want)
+		}
+	}
+
+	// Existing files are left alone.
+	if err := os.Chmod(fname, 0600); err != nil {
+		t.Fatalf("error on chmod: %v", err)
+	}
+	w, err = logOpen(fname, perms)
+	if err != nil {
+		t.Fatalf("logOpen failed: %v", err)
+	}
+	w.Close()
+	if fi, err := os.Stat(fname); err != nil || fi.Mode() != 0600 {
+		t.Errorf("%s: existing file mode changed: %v (%v)", fname, fi.Mode(), err)
+	}
+
+	// Groups by name or ID.
+	if _, err := logPermsFromConfig(&config.Config{LogGroup: "no-such-group-netbackup"}); err == nil {
+		t.Errorf("logPermsFromConfig with an unknown group: got no error, want error")
+	}
+	p, err := logPermsFromConfig(&config.Config{LogGroup: strconv.Itoa(os.Getgid())})
+	if err != nil || p.gid != os.Getgid() {
+		t.Errorf("logPermsFromConfig(gid %d): got %+v (%v), want gid %d", os.Getgid(), p, err, os.Getgid())
+	}
+}
+
+// Test that logs larger than the maximum size are moved away.
+func TestRotateLog(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "netbackup-foo.2024-03-01.log")
+	write := func(size int) {
+		if err := os.WriteFile(fname, bytes.Repeat([]byte("x"), size), 0644); err != nil {
+			t.Fatalf("error writing log: %v", err)
+		}
+	}
+
+	// Small logs and disabled rotation leave the log alone.
+	write(100)
+	for _, max := range []int64{0, 100, 1000} {
+		if got, err := rotateLog(fname, max); err != nil || got != "" {
+			t.Errorf("rotateLog(max=%d): got (%q, %v), want no rotation", max, got, err)
+		}
+	}
+
+	// Too large: rename with the next free sequence number, then start fresh.
+	for seq := 1; seq <= 2; seq++ {
+		write(101)
+		got, err := rotateLog(fname, 100)
+		want := fmt.Sprintf("%s.%d", fname, seq)
+		if err != nil || got != want {
+			t.Fatalf("rotateLog: got (%q, %v), want %q", got, err, want)
+		}
+		if fi, err := os.Stat(want); err != nil || fi.Size() != 101 {
+			t.Errorf("rotated log %q: got %v (%v), want 101 bytes", want, fi, err)
+		}
+		w, err := logOpen(fname, defaultLogPerms)
+		if err != nil {
+			t.Fatalf("logOpen failed: %v", err)
+		}
+		w.Close()
+		if fi, err := os.Stat(fname); err != nil || fi.Size() != 0 {
+			t.Errorf("log %q should be empty after rotation: %v (%v)", fname, fi, err)
+		}
+	}
+
+	// Missing logs are not an error.
+	if got, err := rotateLog(filepath.Join(dir, "missing"), 1); err != nil || got != "" {
+		t.Errorf("rotateLog(missing): got (%q, %v), want no rotation", got, err)
+	}
+}
+
+// Test that quiet mode only writes to the log file.
+func TestQuietOutput(t *testing.T) {
+	for _, quiet := range []bool{false, true} {
+		// Redirect stdout and stderr to a temporary file.
+		w, err := os.Create(filepath.Join(t.TempDir(), "output"))
+		if err != nil {
+			t.Fatalf("error creating output file: %v", err)
+		}
+		stdout, stderr := os.Stdout, os.Stderr
+		os.Stdout, os.Stderr = w, w
+
+		var buf bytes.Buffer
+		log := logger.New("")
+		log.SetVerboseLevel(1)
+		setLogOutput(log, &buf, quiet)
+		log.Verboseln(1, "*** Backup Result: Success")
+
+		os.Stdout, os.Stderr = stdout, stderr
+		w.Close()
+
+		output, err := ioutil.ReadFile(w.Name())
+		if err != nil {
+			t.Fatalf("error reading output file: %v", err)
+		}
+		if !bytes.Contains(buf.Bytes(), []byte("Success")) {
+			t.Errorf("quiet=%v: log file should contain output; got %q", quiet, buf.String())
+		}
+		if quiet && len(output) != 0 {
+			t.Errorf("quiet=%v: stdout/stderr should be empty; got %q", quiet, output)
+		}
+		if !quiet && !bytes.Contains(output, []byte("Success")) {
+			t.Errorf("quiet=%v: stderr should contain output; got %q", quiet, output)
+		}
+	}
+}
+
+// Test that openLog creates the log under log_dir, unless noLogfile is set.
+func TestOpenLogNoLogfile(t *testing.T) {
+	for _, noLogfile := range []bool{false, true} {
+		dir := t.TempDir()
+		cfg := &config.Config{Name: "foo", LogDir: dir}
+
+		w, err := openLog(cfg, "", defaultLogPerms, noLogfile)
+		if err != nil {
+			t.Fatalf("noLogfile=%v: openLog failed: %v", noLogfile, err)
+		}
+		if _, err := fmt.Fprintln(w, "test"); err != nil {
+			t.Errorf("noLogfile=%v: error writing to log: %v", noLogfile, err)
+		}
+		w.Close()
+
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("error reading %s: %v", dir, err)
+		}
+		if noLogfile && len(entries) != 0 {
+			t.Errorf("noLogfile=%v: got %d entries in log_dir, want none", noLogfile, len(entries))
+		}
+		if _, err := os.Stat(logPath("foo", dir, "")); !noLogfile && err != nil {
+			t.Errorf("noLogfile=%v: log file not created: %v", noLogfile, err)
+		}
+	}
+}
+
+// Test that openLog falls back to $XDG_STATE_HOME/netbackup when log_dir is
+// not writable, but not for explicitly named log files.
+func TestOpenLogFallback(t *testing.T) {
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state")
+	t.Setenv("XDG_STATE_HOME", state)
+
+	// A directory under a regular file can't be created, even by root.
+	blocker := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatalf("error writing %s: %v", blocker, err)
+	}
+	logdir := filepath.Join(blocker, "logs")
+
+	w, err := openLog(&config.Config{Name: "foo", LogDir: logdir}, "", defaultLogPerms, false)
+	if err != nil {
+		t.Fatalf("openLog failed: %v", err)
+	}
+	w.Close()
+	want := logPath("foo", filepath.Join(state, "netbackup"), "")
+	if w.fallbackErr == nil || w.path != want {
+		t.Errorf("openLog: got path %q (fallback error %v), want fallback to %q", w.path, w.fallbackErr, want)
+	}
+	if _, err := os.Stat(want); err != nil {
+		t.Errorf("fallback log not created: %v", err)
+	}
+
+	// No fallback for the log file from the command-line.
+	if _, err := openLog(&config.Config{Name: "foo", LogDir: logdir}, filepath.Join(logdir, "log"), defaultLogPerms, false); err == nil {
+		t.Errorf("openLog with an unwritable override: got no error, want error")
+	}
+}
+
+// Test checkPrivateDir and the fallback log directory under the temporary
+// directory.
+func TestFallbackLogDirPrivate(t *testing.T) {
+	dir := t.TempDir()
+	uid := os.Getuid()
+
+	private := filepath.Join(dir, "private")
+	if err := os.Mkdir(private, 0700); err != nil {
+		t.Fatal(err)
+	}
+	open := filepath.Join(dir, "open")
+	if err := os.Mkdir(open, 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(private, link); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	casetests := []struct {
+		dir     string
+		uid     int
+		wantErr bool
+	}{
+		{dir: private, uid: uid},
+		{dir: private, uid: uid + 1, wantErr: true},
+		{dir: open, uid: uid, wantErr: true},
+		{dir: link, uid: uid, wantErr: true},
+		{dir: file, uid: uid, wantErr: true},
+		{dir: filepath.Join(dir, "missing"), uid: uid, wantErr: true},
+	}
+	for _, tt := range casetests {
+		err := checkPrivateDir(tt.dir, tt.uid)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkPrivateDir(%q, %d): got error %v, want error: %v", tt.dir, tt.uid, err, tt.wantErr)
+		}
+	}
+
+	// Without XDG_STATE_HOME, the fallback is a private directory under the
+	// temporary directory (and there is no fallback for root).
+	t.Setenv("XDG_STATE_HOME", "")
+	t.Setenv("TMPDIR", dir)
+	got, err := fallbackLogDir()
+	if uid == 0 {
+		if err == nil {
+			t.Errorf("fallbackLogDir as root: got %q, want error", got)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("fallbackLogDir failed: %v", err)
+	}
+	if err := checkPrivateDir(got, uid); err != nil {
+		t.Errorf("fallbackLogDir: %v", err)
+	}
+}
+
+// Test logFilename precedence.
+func TestLogFilename(t *testing.T) {
+	casetests := []struct {
+		logfile  string
+		logdir   string
+		override string
+		want     string
+	}{
+		// Command-line override always wins.
+		{logdir: "/logdir", override: "/override/log", want: "/override/log"},
+		{logfile: "/logfile", override: "/override/log", want: "/override/log"},
+		// log_file in config.
+		{logfile: "/logfile", want: "/logfile"},
+		// Standard name under log_dir.
+		{logdir: "/logdir", want: logPath("foo", "/logdir", "")},
+	}
+
+	for _, tt := range casetests {
+		cfg := &config.Config{
+			Name:    "foo",
+			Logfile: tt.logfile,
+			LogDir:  tt.logdir,
+		}
+		if got := logFilename(cfg, tt.override); got != tt.want {
+			t.Errorf("logFilename(logfile=%q, logdir=%q, override=%q): got %q, want %q", tt.logfile, tt.logdir, tt.override, got, tt.want)
+		}
+	}
+
+	// Intermediate directories are created for the override path.
+	override := filepath.Join(t.TempDir(), "a", "b", "log")
+	w, err := logOpen(logFilename(&config.Config{Name: "foo", LogDir: "/logdir"}, override), defaultLogPerms)
+	if err != nil {
+		t.Fatalf("logOpen failed: %v", err)
+	}
+	w.Close()
+	if _, err := os.Stat(override); err != nil {
+		t.Errorf("%s not created: %v", override, err)
+	}
+}
+
+// Test reading the configuration from stdin.
+func TestReadConfigStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("error creating pipe: %v", err)
+	}
+	go func(w *os.File) {
+		w.Write([]byte("name=\"foo\"\ntransport=\"rsync\"\nsource_dir=\"/src\"\ndest_dir=\"/dst\"\n"))
+		w.Close()
+	}(w)
+
+	cfg, err := readConfig("-", r, config.ParseOptions{})
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	if cfg.Name != "foo" {
+		t.Errorf("name should be foo; is %s", cfg.Name)
+	}
+
+	// Validation still applies.
+	r, w, err = os.Pipe()
+	if err != nil {
+		t.Fatalf("error creating pipe: %v", err)
+	}
+	go func(w *os.File) {
+		w.Write([]byte("name=\"foo\"\ntransport=\"rsync\"\nsource_dir=\"src\"\ndest_dir=\"/dst\"\n"))
+		w.Close()
+	}(w)
+	if _, err := readConfig("-", r, config.ParseOptions{}); err == nil {
+		t.Errorf("readConfig succeeded with a relative source_dir; want non-nil error")
+	}
+}
+
+// Test that the dumped configuration contains the values merged from the
+// defaults file and included files, and can be parsed again.
+func TestWriteConfig(t *testing.T) {
+	dir := t.TempDir()
+	opts := config.ParseOptions{DefaultsFile: filepath.Join(dir, "defaults.toml")}
+	files := map[string]string{
+		opts.DefaultsFile:                 "exclude=[\"*.tmp\"]\nlog_dir=\"/var/log/backups\"\n",
+		filepath.Join(dir, "common.toml"): "rsync_args=[\"--checksum\"]\n",
+		filepath.Join(dir, "job.toml"):    "include_config=[\"common.toml\"]\nname=\"foo\"\ntransport=\"rsync\"\nsource_dir=\"/src\"\ndest_dir=\"/dst\"\nexclude=[\"cache\"]\n",
+	}
+	for fname, contents := range files {
+		if err := ioutil.WriteFile(fname, []byte(contents), 0644); err != nil {
+			t.Fatalf("error writing %s: %v", fname, err)
+		}
+	}
+	cfg, err := readConfig(filepath.Join(dir, "job.toml"), nil, opts)
+	if err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeConfig(&buf, cfg); err != nil {
+		t.Fatalf("writeConfig failed: %v", err)
+	}
+	for _, want := range []string{`exclude = ["*.tmp", "cache"]`, `rsync_args = ["--checksum"]`, `log_dir = "/var/log/backups"`, `name = "foo"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("dumped config should contain %q:\n%s", want, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "include_config") {
+		t.Errorf("dumped config should not contain include_config:\n%s", buf.String())
+	}
+
+	// The dump is a valid configuration, equivalent to the original.
+	got, err := config.ParseConfig(&buf, config.ParseOptions{})
+	if err != nil {
+		t.Fatalf("ParseConfig of dumped config failed: %v", err)
+	}
+	if !reflect.DeepEqual(got.Exclude, cfg.Exclude) || !reflect.DeepEqual(got.RsyncArgs, cfg.RsyncArgs) {
+		t.Errorf("dumped config differs: got %+v, want %+v", got, cfg)
+	}
+}
+
+// Test logPath with a fake clock.
+func TestLogPathFakeClock(t *testing.T) {
+	saved := clk
+	defer func() { clk = saved }()
+
+	fake := clock.NewFake(time.Date(2024, 3, 5, 23, 59, 0, 0, time.UTC))
+	clk = fake
+	want := "/logdir/foo/netbackup-foo.2024-03-05.log"
+	if got := logPath("foo", "/logdir", ""); got != want {
+		t.Errorf("logPath: got %q, want %q", got, want)
+	}
+
+	fake.Advance(time.Minute)
+	want = "/logdir/foo/netbackup-foo.2024-03-06.log"
+	if got := logPath("foo", "/logdir", ""); got != want {
+		t.Errorf("logPath: got %q, want %q", got, want)
+	}
+}
+
+// Test logPath with a custom date format including the time of day.
+func TestLogPathDateFormat(t *testing.T) {
+	saved := clk
+	defer func() { clk = saved }()
+	clk = clock.NewFake(time.Date(2024, 3, 5, 14, 30, 15, 0, time.UTC))
+
+	casetests := []struct {
+		layout string
+		want   string
+	}{
+		{layout: "", want: "/logdir/foo/netbackup-foo.2024-03-05.log"},
+		{layout: "2006-01-02T150405", want: "/logdir/foo/netbackup-foo.2024-03-05T143015.log"},
+		{layout: "20060102-15h", want: "/logdir/foo/netbackup-foo.20240305-14h.log"},
+	}
+	for _, tt := range casetests {
+		if got := logPath("foo", "/logdir", tt.layout); got != tt.want {
+			t.Errorf("logPath(layout=%q): got %q, want %q", tt.layout, got, tt.want)
+		}
+	}
+
+	// logFilename uses log_date_format from the config.
+	cfg := &config.Config{Name: "foo", LogDir: "/logdir", LogDateFormat: "2006-01-02_15"}
+	if got, want := logFilename(cfg, ""), "/logdir/foo/netbackup-foo.2024-03-05_14.log"; got != want {
+		t.Errorf("logFilename: got %q, want %q", got, want)
+	}
+}
+
+// Test that setNice changes the niceness of the current process.
+func TestSetNice(t *testing.T) {
+	// The raw getpriority syscall returns 20 - nice.
+	prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+	if err != nil {
+		t.Skipf("unable to read the current priority: %v", err)
+	}
+	nice := 20 - prio
+	if nice >= 19 {
+		t.Skipf("niceness already at the maximum (%d)", nice)
+	}
+
+	// Raising the niceness is always allowed, but lowering it back may not be.
+	if err := setNice(nice + 1); err != nil {
+		if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+			t.Skipf("not permitted to change the niceness: %v", err)
+		}
+		t.Fatalf("setNice(%d) failed: %v", nice+1, err)
+	}
+	defer setNice(nice)
+
+	prio, err = syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+	if err != nil {
+		t.Fatalf("unable to read the priority: %v", err)
+	}
+	if got := 20 - prio; got != nice+1 {
+		t.Errorf("niceness: got %d, want %d", got, nice+1)
+	}
+}
+
+// Test the detection of backups taking longer than max_duration.
+func TestOverran(t *testing.T) {
+	casetests := []struct {
+		maxDuration string
+		duration    time.Duration
+		want        bool
+	}{
+		{maxDuration: "", duration: 100 * time.Hour},
+		{maxDuration: "4h", duration: 3 * time.Hour},
+		{maxDuration: "4h", duration: 4 * time.Hour},
+		{maxDuration: "4h", duration: 4*time.Hour + time.Second, want: true},
+		{maxDuration: "30m", duration: 2 * time.Hour, want: true},
+	}
+	for _, tt := range casetests {
+		cfg := &config.Config{MaxDuration: tt.maxDuration}
+		if err := cfg.Normalize(); err != nil {
+			t.Fatalf("Normalize failed: %v", err)
+		}
+		if got := overran(cfg, tt.duration); got != tt.want {
+			t.Errorf("overran(max_duration=%q, %v): got %v, want %v", tt.maxDuration, tt.duration, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,1179 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package netbackup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/marcopaganini/logger"
+	"github.com/marcopaganini/netbackup/clock"
+	"github.com/marcopaganini/netbackup/config"
+	"github.com/marcopaganini/netbackup/execute"
+	"github.com/marcopaganini/netbackup/progress"
+	"github.com/marcopaganini/netbackup/transports"
+)
+
+const (
+	devMapperDir = "/dev/mapper"
+	diskDir      = "/dev/disk"
+	procMounts   = "/proc/mounts"
+
+	// External commands.
+	mountCmd      = "mount"
+	umountCmd     = "umount"
+	cryptSetupCmd = "cryptsetup"
+	fsckCmd       = "fsck"
+	tunefsCmd     = "tune2fs"
+	udisksctlCmd  = "udisksctl"
+)
+
+// Exit codes, per failure category.
+const (
+	ExitOK        = 0
+	ExitError     = 1 // Generic error.
+	ExitConfig    = 2 // Configuration error.
+	ExitDevice    = 3 // Mount/LUKS/filesystem error.
+	ExitTransport = 4 // Transport (backup program) error.
+	ExitHook      = 5 // Error running pre/post/fail commands.
+	ExitBusy      = 6 // Too many concurrent jobs.
+	ExitVerify    = 7 // Manifest verification failed.
+)
+
+const (
+	// Default maximum time to keep retrying a failed umount or LUKS close.
+	defaultUmountTimeout    = 30 * time.Second
+	defaultLuksCloseTimeout = 30 * time.Second
+	// Delay before the first retry of a failed command. The delay doubles on
+	// every subsequent retry, up to retryMaxDelay.
+	retryInitialDelay = 500 * time.Millisecond
+	retryMaxDelay     = 8 * time.Second
+
+	// How often to check for the destination device (wait_for_device).
+	devicePollInterval = 5 * time.Second
+
+	// Minimum age of a leftover device mapper to be considered stale.
+	staleMapperAge = 10 * time.Minute
+
+	// Number of lines of the transport's standard error passed to the
+	// fail-command in NETBACKUP_ERROR_TAIL.
+	errorTailLines = 20
+)
+
+// labelEscaper escapes filesystem labels the same way udev does when creating
+// the links under /dev/disk/by-label.
+var labelEscaper = strings.NewReplacer("/", `\x2f`, " ", `\x20`)
+
+// errDeviceNotFound indicates that the destination device does not exist.
+var errDeviceNotFound = errors.New("device not found")
+
+// exitCodeError wraps an error with the exit code for its failure category.
+type exitCodeError struct {
+	code int
+	err  error
+}
+
+func (e *exitCodeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitCodeError) Unwrap() error {
+	return e.err
+}
+
+// withExitCode returns err wrapped with the given exit code.
+func withExitCode(code int, err error) error {
+	return &exitCodeError{code: code, err: err}
+}
+
+// ExitCode returns the exit code for err: ExitOK if err is nil, the exit code
+// attached to err (or any error it wraps) by withExitCode, or ExitError if
+// none is present.
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	var e *exitCodeError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return ExitError
+}
+
+// Backup contains information for a given backup instance.
+type Backup struct {
+	config  *config.Config
+	execute execute.Executor
+	dryRun  bool
+	// Function used to wait between retries.
+	sleep func(time.Duration)
+	// Function used to stat devices and the source directory.
+	stat func(string) (os.FileInfo, error)
+	// Base directory for the /dev/disk/by-uuid and by-label links.
+	diskDir string
+	// Function returning the contents of /proc/mounts.
+	mounts func() ([]byte, error)
+	// Close device mappers left behind by a previous (crashed) run.
+	cleanupStale bool
+	// Verify the destination manifest instead of running the backup.
+	verifyManifest bool
+}
+
+// NewBackup creates a new Backup instance.
+func NewBackup(config *config.Config, dryRun bool) *Backup {
+	// Create new Backup and execute.
+	return &Backup{
+		config:  config,
+		execute: execute.New(),
+		dryRun:  dryRun,
+		sleep:   time.Sleep,
+		stat:    os.Stat,
+		diskDir: diskDir,
+		mounts:  readProcMounts}
+}
+
+// readProcMounts returns the contents of /proc/mounts.
+func readProcMounts() ([]byte, error) {
+	return ioutil.ReadFile(procMounts)
+}
+
+// isMounted returns true if the specified directory is mounted, false otherwise.
+// This function needs /proc/mounts to work.
+func isMounted(dirname string) (bool, error) {
+	r, err := os.Open(procMounts)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	return isMountedFrom(r, dirname)
+}
+
+// isMountedFrom reads mounts (in /proc/mounts format) from r and returns true
+// if dirname is a mount point. Paths are compared in their clean form, so
+// trailing slashes in dirname are ignored.
+func isMountedFrom(r io.Reader, dirname string) (bool, error) {
+	dirname = filepath.Clean(dirname)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) > 1 && filepath.Clean(unescapeMount(f[1])) == dirname {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// devicePath returns the path to dev. Devices specified by filesystem UUID
+// or label (UUID=<uuid> or LABEL=<label>) map to the corresponding link under
+// diskdir (usually /dev/disk). Other devices are returned unchanged.
+func devicePath(diskdir string, dev string) string {
+	switch {
+	case strings.HasPrefix(dev, "UUID="):
+		return filepath.Join(diskdir, "by-uuid", strings.TrimPrefix(dev, "UUID="))
+	case strings.HasPrefix(dev, "LABEL="):
+		return filepath.Join(diskdir, "by-label", labelEscaper.Replace(strings.TrimPrefix(dev, "LABEL=")))
+	}
+	return dev
+}
+
+// resolveDevice returns the real device node for dev. Devices specified by
+// UUID or label are resolved using the links under diskdir.
+func resolveDevice(diskdir string, dev string) (string, error) {
+	path := devicePath(diskdir, dev)
+	if path == dev {
+		return dev, nil
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("%w: %q. Is the drive connected?", errDeviceNotFound, dev)
+	}
+	return resolved, err
+}
+
+// checkDevice returns an error if the device does not exist or is not a
+// block device.
+func (b *Backup) checkDevice(dev string) error {
+	fi, err := b.stat(devicePath(b.diskDir, dev))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %q. Is the drive connected?", errDeviceNotFound, dev)
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeDevice == 0 || fi.Mode()&os.ModeCharDevice != 0 {
+		return fmt.Errorf("%q is not a block device", dev)
+	}
+	return nil
+}
+
+// waitDevice checks that the destination device exists, waiting for up to
+// wait_for_device for it to appear (E.g., a removable drive plugged in late).
+func (b *Backup) waitDevice(ctx context.Context, dev string) error {
+	log := logger.LoggerValue(ctx)
+
+	timeout := b.config.Parsed.WaitForDevice
+	elapsed := time.Duration(0)
+	for {
+		err := b.checkDevice(dev)
+		if err == nil || elapsed >= timeout || !errors.Is(err, errDeviceNotFound) {
+			return err
+		}
+		if elapsed == 0 {
+			log.Verbosef(1, "Waiting up to %v for device %q to appear.\n", timeout, dev)
+		}
+		delay := devicePollInterval
+		if delay > timeout-elapsed {
+			delay = timeout - elapsed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b.sleep(delay)
+		elapsed += delay
+	}
+}
+
+// countEntries returns the number of entries in directory dir, reading at
+// most max entries.
+func countEntries(dir string, max int) (int, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(max)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	return len(names), nil
+}
+
+// mountDev mounts the destination device into the mount point specified in
+// the config (created if needed), or a temporary mount point if none was
+// specified, and returns the mount point name.
+func (b *Backup) mountDev(ctx context.Context) (string, error) {
+	tmpdir := b.config.MountPoint
+	if tmpdir != "" {
+		if err := os.MkdirAll(tmpdir, 0755); err != nil {
+			return "", fmt.Errorf("unable to create mount point: %v", err)
+		}
+	} else {
+		var err error
+		if tmpdir, err = ioutil.TempDir("", "netbackup_mount"); err != nil {
+			return "", fmt.Errorf("unable to create temp directory: %v", err)
+		}
+	}
+
+	// We use the mount command instead of the mount syscall as it makes
+	// simpler to specify defaults in /etc/fstab.
+	cmd := []string{mountCmd, b.config.DestDev, tmpdir}
+	if err := execute.RunCommand(ctx, "MOUNT", cmd, b.execute, nil, nil); err != nil {
+		return "", err
+	}
+
+	return tmpdir, nil
+}
+
+// retryCommand runs cmd, retrying failures with an increasing delay until
+// the command succeeds or timeout elapses. Returns the error from the last
+// attempt.
+func (b *Backup) retryCommand(ctx context.Context, prefix string, cmd []string, timeout time.Duration) error {
+	log := logger.LoggerValue(ctx)
+
+	delay := retryInitialDelay
+	elapsed := time.Duration(0)
+	for {
+		err := execute.RunCommand(ctx, prefix, cmd, b.execute, nil, nil)
+		if err == nil || elapsed >= timeout {
+			return err
+		}
+		if delay > timeout-elapsed {
+			delay = timeout - elapsed
+		}
+		log.Verbosef(1, "%s failed (retrying in %v): %v\n", prefix, delay, err)
+		b.sleep(delay)
+		elapsed += delay
+		if delay *= 2; delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
+}
+
+// orDefault returns d, or def if d is zero (not set in the configuration).
+func orDefault(d time.Duration, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+// runPhase runs f with a context limited by timeout, the value of the config
+// option name. A zero timeout means no limit.
+func runPhase(ctx context.Context, name string, timeout time.Duration, f func(context.Context) error) error {
+	if timeout == 0 {
+		return f(ctx)
+	}
+	tctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := f(tctx)
+	if err != nil && ctx.Err() == nil && errors.Is(tctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s (%v) exceeded: %w", name, timeout, err)
+	}
+	return err
+}
+
+// umountDev dismounts the destination device specified in config.DestDev.
+// Right after the transport exits, umount may fail complaining that the
+// filesystem is busy, so failures are retried with an increasing delay until
+// umount succeeds or umount_timeout (default 30s) elapses. If all attempts
+// fail and lazy_umount is set, a lazy umount (umount -l) is attempted to at
+// least detach the filesystem from the mount point. Returns true if the
+// filesystem was lazily unmounted (and may still be busy.)
+func (b *Backup) umountDev(ctx context.Context) (bool, error) {
+	log := logger.LoggerValue(ctx)
+
+	timeout := orDefault(b.config.Parsed.UmountTimeout, defaultUmountTimeout)
+
+	cmd := []string{umountCmd, b.config.DestDev}
+	err := b.retryCommand(ctx, "UMOUNT", cmd, timeout)
+	if err == nil || !b.config.LazyUmount {
+		return false, err
+	}
+	log.Verbosef(1, "Warning: Unable to unmount %q, attempting lazy umount: %v\n", b.config.DestDev, err)
+	lazy := []string{umountCmd, "-l", b.config.DestDev}
+	if err := execute.RunCommand(ctx, "UMOUNT-LAZY", lazy, b.execute, nil, nil); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// openLuks opens the luks destination device into a temporary /dev/mapper
+// device and returns the device mapper name (the /dev/mapper device filename
+// is the name under devMapperDir).
+func (b *Backup) openLuks(ctx context.Context) (string, error) {
+	devname := b.mapperName()
+	devfile := filepath.Join(devMapperDir, devname)
+
+	// Make sure it doesn't already exist, or close it if it was left
+	// behind by a previous run (and we were asked to.)
+	if fi, err := os.Stat(devfile); err == nil {
+		if !b.cleanupStale {
+			return "", fmt.Errorf("device mapper file %q already exists (use --cleanup-stale to close it if left by a crashed run)", devfile)
+		}
+		if err := b.closeStaleMapper(ctx, devname, fi); err != nil {
+			return "", err
+		}
+	}
+
+	if err := execute.RunCommand(ctx, "LUKS_OPEN", b.luksOpenCmd(devname), b.execute, nil, nil); err != nil {
+		return "", err
+	}
+
+	return devname, nil
+}
+
+// luksOpenCmd returns the cryptsetup command to open the luks destination
+// device into the device mapper name devname.
+func (b *Backup) luksOpenCmd(devname string) []string {
+	cmd := []string{cryptSetupCmd}
+	if b.config.LuksKeyFile != "" {
+		cmd = append(cmd, "--key-file="+b.config.LuksKeyFile)
+	}
+	return append(cmd, "luksOpen", b.config.LuksDestDev, devname)
+}
+
+// mapperName returns the name of our temporary /dev/mapper device, based on
+// the config name.
+func (b *Backup) mapperName() string {
+	return "netbackup_" + b.config.Name
+}
+
+// closeStaleMapper closes the device mapper devname (with file information
+// fi) if it was left behind by a previous run. Mappers in use are never
+// touched.
+func (b *Backup) closeStaleMapper(ctx context.Context, devname string, fi os.FileInfo) error {
+	log := logger.LoggerValue(ctx)
+
+	devfile := filepath.Join(devMapperDir, devname)
+	mounts, err := b.mounts()
+	if err != nil {
+		return fmt.Errorf("unable to verify if %q is in use: %v", devfile, err)
+	}
+	if !isStaleMapper(fi, clock.ClockValue(ctx).Now(), mounts, deviceNames(devfile)...) {
+		return fmt.Errorf("device mapper file %q already exists and may be in use (mounted or created less than %v ago)", devfile, staleMapperAge)
+	}
+	log.Verbosef(1, "Closing stale device mapper %q from a previous run\n", devfile)
+	return execute.RunCommand(ctx, "LUKS_CLOSE_STALE", []string{cryptSetupCmd, "luksClose", devname}, b.execute, nil, nil)
+}
+
+// isStaleMapper returns true if the device mapper with file information fi
+// was left behind by a previous run: it was created at least staleMapperAge
+// before now, and none of devs (the mapper file and the device it points to)
+// appear as a mounted device in mounts (in /proc/mounts format.) Younger
+// mappers may belong to a concurrent run that has not mounted them yet.
+func isStaleMapper(fi os.FileInfo, now time.Time, mounts []byte, devs ...string) bool {
+	if now.Sub(fi.ModTime()) < staleMapperAge {
+		return false
+	}
+	_, mounted, _ := deviceMountPoint(bytes.NewReader(mounts), devs...)
+	return !mounted
+}
+
+// deviceMountPoint reads mounts (in /proc/mounts format) from r and returns
+// the mount point of the first entry with any of devs as the mounted device,
+// and true. If none of devs is mounted, it returns false.
+func deviceMountPoint(r io.Reader, devs ...string) (string, bool, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) < 2 {
+			continue
+		}
+		for _, dev := range devs {
+			if f[0] == dev {
+				return unescapeMount(f[1]), true, nil
+			}
+		}
+	}
+	return "", false, scanner.Err()
+}
+
+// deviceNames returns dev and, if dev is a symbolic link (E.g. under
+// /dev/mapper or /dev/disk), the device it points to. The kernel always shows
+// the resolved name in /proc/mounts.
+func deviceNames(dev string) []string {
+	devs := []string{dev}
+	if resolved, err := filepath.EvalSymlinks(dev); err == nil && resolved != dev {
+		devs = append(devs, resolved)
+	}
+	return devs
+}
+
+// unescapeMount decodes the octal escapes used by the kernel for spaces,
+// tabs, newlines, and backslashes in /proc/mounts fields.
+func unescapeMount(s string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(s)
+}
+
+// isDeviceMounted returns the current mount point of dev (or the device it
+// links to) and true, if dev is mounted. The list of mounts comes from
+// b.mounts (usually /proc/mounts.)
+func (b *Backup) isDeviceMounted(dev string) (string, bool, error) {
+	mounts, err := b.mounts()
+	if err != nil {
+		return "", false, fmt.Errorf("unable to verify if %q is mounted: %v", dev, err)
+	}
+	return deviceMountPoint(bytes.NewReader(mounts), deviceNames(dev)...)
+}
+
+// closeLuks closes the LUKS device with the given device mapper name (as
+// returned by openLuks). The device may still be in use for a short time
+// after the umount, so failures are retried with an increasing delay until
+// luks_close_timeout (default 30s) elapses.
+func (b *Backup) closeLuks(ctx context.Context, name string) error {
+	timeout := orDefault(b.config.Parsed.LuksCloseTimeout, defaultLuksCloseTimeout)
+	cmd := []string{cryptSetupCmd, "luksClose", name}
+	return b.retryCommand(ctx, "LUKS_CLOSE", cmd, timeout)
+}
+
+// powerDown powers down (spins down/ejects) the destination drive dev using
+// power_down_command, if set, or udisksctl.
+func (b *Backup) powerDown(ctx context.Context, dev string) error {
+	cmd := []string{udisksctlCmd, "power-off", "-b", dev}
+	if b.config.PowerDownCommand != "" {
+		cmd = execute.WithShell(b.config.Shell, b.config.PowerDownCommand)
+	}
+	return execute.RunCommand(ctx, "POWER-DOWN", cmd, b.execute, nil, nil)
+}
+
+// cleanFilesystem runs fsck to make sure the filesystem under config.dest_dev is
+// intact, and sets the number of times to check to 0 and the last time
+// checked to now. This option should only be used in EXTn filesystems or
+// filesystems that support tunefs.
+func (b *Backup) cleanFilesystem(ctx context.Context) error {
+	cmds := cleanFilesystemCmds(b.config.DestDev)
+	// fsck (read-only check)
+	if err := execute.RunCommand(ctx, "FS_CLEANUP", cmds[0], b.execute, nil, nil); err != nil {
+		return fmt.Errorf("error running %q: %v", cmds[0], err)
+	}
+	// Tunefs
+	return execute.RunCommand(ctx, "FS_CLEANUP", cmds[1], b.execute, nil, nil)
+}
+
+// cleanFilesystemCmds returns the fsck and tunefs commands run by
+// cleanFilesystem on dev.
+func cleanFilesystemCmds(dev string) [][]string {
+	return [][]string{
+		{fsckCmd, "-n", dev},
+		{tunefsCmd, "-C", "0", "-T", "now", dev},
+	}
+}
+
+// planDevice adds the device commands (LUKS, filesystem cleanup, and mount)
+// to the plan in ctx. These commands are not run in dry-run mode, so they
+// never reach RecordCommand. Returns a function that adds the umount and
+// luksClose commands, to be called after all other phases.
+func (b *Backup) planDevice(ctx context.Context) (closing func()) {
+	var (
+		dev    = b.config.DestDev
+		mapper string
+	)
+	if b.config.LuksDestDev != "" {
+		mapper = b.mapperName()
+		dev = filepath.Join(devMapperDir, mapper)
+		execute.PlanCommand(execute.WithPhase(ctx, "luks"), b.luksOpenCmd(mapper))
+	}
+	if b.config.FSCleanup {
+		for _, cmd := range cleanFilesystemCmds(dev) {
+			execute.PlanCommand(execute.WithPhase(ctx, "fsck"), cmd)
+		}
+	}
+	if dev != "" {
+		execute.PlanCommand(execute.WithPhase(ctx, "mount"), []string{mountCmd, dev, b.config.DestDir})
+	}
+	return func() {
+		if dev != "" {
+			execute.PlanCommand(execute.WithPhase(ctx, "umount"), []string{umountCmd, dev})
+		}
+		if mapper != "" {
+			execute.PlanCommand(execute.WithPhase(ctx, "luks-close"), []string{cryptSetupCmd, "luksClose", mapper})
+		}
+	}
+}
+
+// destExcludePattern returns the exclusion pattern for the destination
+// directory dest in a backup of source using transport, or an empty string
+// if dest is not nested under source. Rsync and rclone patterns are anchored
+// at the root of the transfer, tar patterns match the member names (relative
+// to the source), and other transports use absolute paths.
+func destExcludePattern(transport string, source string, dest string, noTrailingSlash bool) string {
+	source, dest = filepath.Clean(source), filepath.Clean(dest)
+	if !filepath.IsAbs(source) || !filepath.IsAbs(dest) {
+		return ""
+	}
+	rel, err := filepath.Rel(source, dest)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return ""
+	}
+	switch transport {
+	case "rsync":
+		// Without the trailing slash, patterns are anchored at the
+		// parent of the source directory.
+		if noTrailingSlash {
+			return "/" + filepath.Join(filepath.Base(source), rel) + "/"
+		}
+		return "/" + rel + "/"
+	case "rclone":
+		return "/" + rel + "/**"
+	case "tar":
+		return "./" + rel
+	}
+	return dest
+}
+
+// autoExcludeDest adds the destination directory to the exclusions (or the
+// filter rules, if set) when it is nested under the source directory, so the
+// backup does not copy itself. Only local sources and destinations are
+// checked.
+func (b *Backup) autoExcludeDest(ctx context.Context) {
+	log := logger.LoggerValue(ctx)
+
+	if b.config.SourceHost != "" || b.config.DestHost != "" {
+		return
+	}
+	pattern := destExcludePattern(b.config.Transport, b.config.SourceDir, b.config.DestDir, b.config.RsyncNoTrailingSlash)
+	if pattern == "" {
+		return
+	}
+	log.Verbosef(1, "Destination %q is inside the source, excluding it (%s)\n", b.config.DestDir, pattern)
+	if len(b.config.Filters) > 0 {
+		b.config.Filters = append([]string{"- " + pattern}, b.config.Filters...)
+		return
+	}
+	b.config.Exclude = append(append([]string{}, b.config.Exclude...), pattern)
+}
+
+// manifest writes the checksum manifest of the destination directory. Remote
+// destinations are skipped with a warning.
+func (b *Backup) manifest(ctx context.Context) error {
+	log := logger.LoggerValue(ctx)
+
+	if b.config.DestHost != "" {
+		log.Verbosef(1, "Warning: Not writing %s on remote destination %q\n", manifestFile, b.config.DestHost)
+		return nil
+	}
+	if b.dryRun {
+		log.Verbosef(1, "Would write %s\n", filepath.Join(b.config.DestDir, manifestFile))
+		return nil
+	}
+	log.Verbosef(2, "Writing %s\n", filepath.Join(b.config.DestDir, manifestFile))
+	return writeManifest(b.config.DestDir)
+}
+
+// verify checks the destination directory against its checksum manifest,
+// logging every file missing or changed since the manifest was written.
+func (b *Backup) verify(ctx context.Context) error {
+	log := logger.LoggerValue(ctx)
+
+	if b.config.DestHost != "" {
+		return withExitCode(ExitConfig, fmt.Errorf("unable to verify %s on remote destination %q", manifestFile, b.config.DestHost))
+	}
+	fname := filepath.Join(b.config.DestDir, manifestFile)
+	if b.dryRun {
+		log.Verbosef(1, "Would verify %s\n", fname)
+		return nil
+	}
+	log.Verbosef(2, "Verifying %s\n", fname)
+	problems, err := verifyManifest(b.config.DestDir)
+	if err != nil {
+		return withExitCode(ExitVerify, err)
+	}
+	for _, p := range problems {
+		log.Printf("%s\n", p)
+	}
+	if len(problems) != 0 {
+		return withExitCode(ExitVerify, fmt.Errorf("%s verification failed: %d problem(s) found", fname, len(problems)))
+	}
+	log.Verbosef(1, "%s verified OK\n", fname)
+	return nil
+}
+
+// hookEnv returns the extra environment variables passed to hook commands.
+// NETBACKUP_DEST_DIR contains the resolved destination directory, which is
+// the temporary mount point when the destination is a device.
+func (b *Backup) hookEnv() []string {
+	return []string{
+		"NETBACKUP_DEST_DIR=" + b.config.DestDir,
+	}
+}
+
+// runHook runs a hook command (pre, post, or fail command) under the shell,
+// using prefix to identify the command in the logs. The command receives the
+// environment in hookEnv, plus any extra variables in env ("key=value"). In
+// dry-run mode, the command is only logged.
+func (b *Backup) runHook(ctx context.Context, prefix string, cmd string, env ...string) error {
+	log := logger.LoggerValue(ctx)
+
+	shellCmd := execute.WithShell(b.config.Shell, cmd)
+	if err := execute.RecordCommand(ctx, shellCmd); err != nil {
+		return err
+	}
+	if b.dryRun {
+		log.Verbosef(1, "%s Command: %q\n", prefix, strings.Join(execute.Redact(ctx, shellCmd), " "))
+		return nil
+	}
+	b.execute.SetEnv(append(b.hookEnv(), env...))
+	defer b.execute.SetEnv(nil)
+	return execute.RunCommand(ctx, prefix, shellCmd, b.execute, nil, nil)
+}
+
+// writeStatus writes the status file for the backup, if configured. Failures
+// are logged, but otherwise ignored.
+func (b *Backup) writeStatus(ctx context.Context, status string, start time.Time) {
+	log := logger.LoggerValue(ctx)
+
+	if b.config.StatusFile == "" || b.dryRun {
+		return
+	}
+	if err := writeStatusFile(b.config.StatusFile, b.config.Transport, status, start, clock.ClockValue(ctx).Now()); err != nil {
+		log.Verbosef(1, "Warning: Unable to write status file: %v\n", err)
+	}
+}
+
+// removeStatus removes the status file for the backup, if configured. The
+// status file is only kept after failures (or crashes), so monitoring can find
+// out what happened. Failures are logged, but otherwise ignored.
+func (b *Backup) removeStatus(ctx context.Context) {
+	log := logger.LoggerValue(ctx)
+
+	if b.config.StatusFile == "" || b.dryRun {
+		return
+	}
+	if err := os.Remove(b.config.StatusFile); err != nil && !os.IsNotExist(err) {
+		log.Verbosef(1, "Warning: Unable to remove status file: %v\n", err)
+	}
+}
+
+// writeMetric saves a record for metric into the node (prometheus) compatible
+// textfile, if requested. Failures are logged, but otherwise ignored.
+func (b *Backup) writeMetric(ctx context.Context, metric string, status string, snapshot string) {
+	log := logger.LoggerValue(ctx)
+
+	if b.config.PromTextFile == "" || b.dryRun {
+		return
+	}
+	log.Verbosef(1, "Writing node-exporter (prometheus) textfile to: %s\n", b.config.PromTextFile)
+	if err := writeNodeTextFile(ctx, b.config.TmpDir, b.config.PromTextFile, promMetric(b.config, metric), b.config.Name, promJob(b.config), status, snapshot, b.config.PromLabels); err != nil {
+		log.Verbosef(1, "Warning: Unable to write node (prometheus) textfile: %v\n", err)
+	}
+}
+
+// Run executes the backup according to the config file and options. If
+// requested, the start of the backup and its final status are saved into the
+// node (prometheus) compatible textfile and the status file. The status file
+// is removed after a successful backup. The ID of the
+// snapshot reported by the transport, if any, is added to the final record.
+func (b *Backup) Run(ctx context.Context) error {
+	// Verifying the manifest is not a backup, so it leaves the status
+	// file and metrics alone.
+	if b.verifyManifest {
+		return b.runDestinations(ctx)
+	}
+
+	start := clock.ClockValue(ctx).Now()
+	b.writeStatus(ctx, statusRunning, start)
+	b.writeMetric(ctx, promStartMetric, "", "")
+
+	// Keep the snapshot ID, passing all events to the original function.
+	var snapshot string
+	parent := ctx
+	ctx = progress.WithFunc(ctx, func(ev progress.Event) {
+		if ev.Kind == progress.Snapshot {
+			snapshot = ev.Snapshot
+		}
+		progress.Report(parent, ev)
+	})
+
+	err := b.runDestinations(ctx)
+
+	status := StatusSuccess
+	if err != nil {
+		status = StatusFailure
+	}
+	b.writeMetric(ctx, promBackupMetric, status, snapshot)
+	if err != nil {
+		b.writeStatus(ctx, status, start)
+	} else {
+		b.removeStatus(ctx)
+	}
+	return err
+}
+
+// forDestination returns a copy of the backup for the i-th destination in
+// a backup with multiple destinations.
+func (b *Backup) forDestination(i int) *Backup {
+	ret := *b
+	ret.config = b.config.ForDestination(i)
+	return &ret
+}
+
+// runDestinations executes the backup once for each destination in the
+// configuration (or only once, if the configuration has a single
+// destination), in order. The backup fails if any destination failed. By
+// default, all destinations are attempted. If dest_fail_fast is set, the
+// first failure skips the remaining destinations.
+func (b *Backup) runDestinations(ctx context.Context) error {
+	log := logger.LoggerValue(ctx)
+
+	ndest := len(b.config.Destinations)
+	if ndest == 0 {
+		return b.run(ctx)
+	}
+
+	var (
+		failed   int
+		firstErr error
+	)
+	for i := 0; i < ndest; i++ {
+		d := b.forDestination(i)
+		log.Verbosef(1, "*** Destination %d/%d: %s\n", i+1, ndest, d.destName())
+		if err := d.run(ctx); err != nil {
+			log.Verbosef(1, "*** Destination %d/%d failed: %v\n", i+1, ndest, err)
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+			if b.config.DestFailFast && i < ndest-1 {
+				log.Verbosef(1, "*** Skipping the remaining %d destination(s) (dest_fail_fast)\n", ndest-i-1)
+				break
+			}
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+	return withExitCode(ExitCode(firstErr), fmt.Errorf("%d of %d destinations failed (first error: %v)", failed, ndest, firstErr))
+}
+
+// destName returns a printable name for the destination of the backup.
+func (b *Backup) destName() string {
+	switch {
+	case b.config.LuksDestDev != "":
+		return b.config.LuksDestDev
+	case b.config.DestDev != "":
+		return b.config.DestDev
+	case b.config.DestHost != "":
+		return b.config.DestHost + ":" + b.config.DestDir
+	}
+	return b.config.DestDir
+}
+
+// detachedContext carries the values of its parent context, but is never
+// canceled.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// withoutCancel returns a copy of ctx that is not canceled when ctx is.
+func withoutCancel(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
+
+// run executes the backup according to the config file and options. A
+// failure to unmount the destination device fails the run, even if the
+// backup itself succeeded.
+func (b *Backup) run(ctx context.Context) (reterr error) {
+	log := logger.LoggerValue(ctx)
+
+	// Device cleanup and the fail-command must run even if ctx is canceled.
+	cleanupCtx := withoutCancel(ctx)
+
+	// If we're running in dry-run mode, we set dummy values for DestDev if
+	// LuksDestDev is present, and for DestDir if DestDev is present. This hack
+	// is necessary because these values won't be set to the appropriate values
+	// in dry-run mode (since we don't want to open the luks destination in
+	// that case) and the transports won't be able to show a full command line
+	// in that case.
+
+	if b.dryRun {
+		if b.config.LuksDestDev != "" {
+			b.config.DestDev = "dummy_dest_dev"
+		}
+		if b.config.DestDev != "" {
+			b.config.DestDir = "dummy_dest_dir"
+			if b.config.MountPoint != "" {
+				b.config.DestDir = b.config.MountPoint
+			}
+		}
+		defer b.planDevice(ctx)()
+	}
+
+	if !b.dryRun {
+		// Verification only reads the destination, so the source checks
+		// are skipped.
+		if !b.verifyManifest {
+			// Make sure sourcedir is a mountpoint, if requested. This
+			// should reduce the risk of backing up an empty (unmounted)
+			// source on top of a full destination.
+			if b.config.SourceIsMountPoint {
+				mounted, err := isMounted(b.config.SourceDir)
+				if err != nil {
+					return withExitCode(ExitDevice, fmt.Errorf("Unable to verify if source_dir is mounted: %v", err))
+				}
+				if !mounted {
+					return withExitCode(ExitDevice, fmt.Errorf("SourceDir (%s) should be a mountpoint, but is not mounted", b.config.SourceDir))
+				}
+			}
+
+			// For local sources, make sure source_dir exists. Otherwise, the
+			// transport fails with a confusing error.
+			if b.config.SourceHost == "" {
+				if _, err := b.stat(b.config.SourceDir); err != nil {
+					if os.IsNotExist(err) {
+						return withExitCode(ExitDevice, fmt.Errorf("source directory does not exist: %s", b.config.SourceDir))
+					}
+					return withExitCode(ExitDevice, fmt.Errorf("Unable to verify source directory: %v", err))
+				}
+				// Refuse to back up an (almost) empty source, if requested.
+				if n := b.config.MinSourceEntries; n > 0 {
+					count, err := countEntries(b.config.SourceDir, n)
+					if err != nil {
+						return withExitCode(ExitDevice, fmt.Errorf("Unable to read source directory: %v", err))
+					}
+					if count < n {
+						return withExitCode(ExitDevice, fmt.Errorf("source directory %s has %d entries, fewer than min_source_entries (%d)", b.config.SourceDir, count, n))
+					}
+				}
+			}
+		}
+
+		// Make sure the destination device is present before doing
+		// anything else.
+		dev := b.config.DestDev
+		if b.config.LuksDestDev != "" {
+			dev = b.config.LuksDestDev
+		}
+		if dev != "" {
+			if err := b.waitDevice(ctx, dev); err != nil {
+				return withExitCode(ExitDevice, err)
+			}
+			// Resolve UUID=/LABEL= into the real device.
+			resolved, err := resolveDevice(b.diskDir, dev)
+			if err != nil {
+				return withExitCode(ExitDevice, err)
+			}
+			if resolved != dev {
+				log.Verbosef(2, "Resolved device %q to %q\n", dev, resolved)
+			}
+			if b.config.LuksDestDev != "" {
+				b.config.LuksDestDev = resolved
+			} else {
+				b.config.DestDev = resolved
+			}
+		}
+
+		// Power down the destination drive at the end, but only if it
+		// was cleanly released (unmounted and LUKS closed.) This runs
+		// after all other deferred device operations.
+		released := true
+		if b.config.PowerDownDest {
+			physdev := b.config.DestDev
+			if b.config.LuksDestDev != "" {
+				physdev = b.config.LuksDestDev
+			}
+			defer func() {
+				if !released {
+					log.Verbosef(1, "Warning: Not powering down %q (device not cleanly released)\n", physdev)
+					return
+				}
+				if err := b.powerDown(cleanupCtx, physdev); err != nil {
+					log.Verbosef(1, "Warning: Unable to power down %q: %v\n", physdev, err)
+				}
+			}()
+		}
+
+		// Open LUKS device, if needed
+		if b.config.LuksDestDev != "" {
+			mapperName, err := b.openLuks(ctx)
+			if err != nil {
+				return withExitCode(ExitDevice, fmt.Errorf("Error opening LUKS device %q: %v", b.config.LuksDestDev, err))
+			}
+			// Set the destination device to the /dev/mapper device opened by
+			// LUKS. This should allow the natural processing to mount and
+			// dismount this device.
+			b.config.DestDev = filepath.Join(devMapperDir, mapperName)
+
+			// close luks device at the end, using the mapper name
+			// returned by openLuks (DestDev may change.)
+			defer func() {
+				if err := b.closeLuks(cleanupCtx, mapperName); err != nil {
+					log.Verbosef(1, "Error closing LUKS device %q: %v\n", mapperName, err)
+					released = false
+				}
+			}()
+		}
+
+		// The destination device may already be mounted elsewhere. Use
+		// (and leave mounted) the existing mount, if requested.
+		reused := false
+		if b.config.DestDev != "" {
+			mountpoint, mounted, err := b.isDeviceMounted(b.config.DestDev)
+			if err != nil {
+				return withExitCode(ExitDevice, err)
+			}
+			if mounted {
+				if !b.config.ReuseExistingMount {
+					return withExitCode(ExitDevice, fmt.Errorf("destination device %q is already mounted on %q (set reuse_existing_mount to use it)", b.config.DestDev, mountpoint))
+				}
+				log.Verbosef(1, "Destination device %q already mounted on %q, reusing it\n", b.config.DestDev, mountpoint)
+				b.config.DestDir = mountpoint
+				reused = true
+			}
+		}
+
+		// Run cleanup on fs prior to backup, if requested.
+		if b.config.FSCleanup {
+			if err := b.cleanFilesystem(ctx); err != nil {
+				return withExitCode(ExitDevice, fmt.Errorf("Error performing pre-backup cleanup on %q: %v", b.config.DestDev, err))
+			}
+		}
+
+		// Mount destination device, if needed.
+		if b.config.DestDev != "" && !reused {
+			tmpdir, err := b.mountDev(ctx)
+			if err != nil {
+				return withExitCode(ExitDevice, fmt.Errorf("Error opening destination device %q: %v", b.config.DestDev, err))
+			}
+			// After we mount the destination device, we set Destdir to that location
+			// so the backup will proceed seamlessly.
+			b.config.DestDir = tmpdir
+
+			// umount destination filesystem and remove temp mount point.
+			defer func() {
+				lazy, err := b.umountDev(cleanupCtx)
+				if lazy {
+					// The filesystem may still be in use.
+					released = false
+				}
+				if err != nil {
+					released = false
+					log.Verbosef(1, "Error unmounting destination device %q: %v\n", b.config.DestDev, err)
+					if reterr == nil {
+						reterr = withExitCode(ExitDevice, fmt.Errorf("Error unmounting destination device %q (device may still be mounted): %v", b.config.DestDev, err))
+					}
+					return
+				}
+				// Only remove temporary mount points.
+				if b.config.MountPoint == "" {
+					os.Remove(b.config.DestDir)
+				}
+			}()
+		}
+	}
+
+	// Keep the backup from copying itself, if requested.
+	if b.config.AutoExcludeDest {
+		b.autoExcludeDest(ctx)
+	}
+
+	// Verify the manifest on the (now mounted) destination instead of
+	// running the backup, if requested.
+	if b.verifyManifest {
+		return b.verify(ctx)
+	}
+
+	// Create new transport based on config.Transport
+	newTransport, ok := transports.Lookup(b.config.Transport)
+	if !ok {
+		return withExitCode(ExitConfig, fmt.Errorf("Unknown transport %q", b.config.Transport))
+	}
+	transp, err := newTransport(b.config, b.execute, b.dryRun)
+	if err != nil {
+		return withExitCode(ExitConfig, fmt.Errorf("Error creating %s transport: %v", b.config.Transport, err))
+	}
+
+	// Run the transport as another user, if requested. Everything else
+	// (mount, LUKS, hooks) still runs as the current user.
+	var (
+		cred       *syscall.Credential
+		transpHome string
+	)
+	if b.config.RunAsUser != "" {
+		if cred, transpHome, err = execute.LookupUser(b.config.RunAsUser); err != nil {
+			return withExitCode(ExitConfig, err)
+		}
+	}
+
+	preCmdPresent := (b.config.PreCommand != "")
+	failCmdPresent := (b.config.FailCommand != "")
+	postCmdPresent := (b.config.PostCommand != "")
+
+	// Progress steps: pre-command (optional), transport, and post-command
+	// (optional).
+	step, steps := 0, 1
+	if preCmdPresent {
+		steps++
+	}
+	if postCmdPresent {
+		steps++
+	}
+	nextStep := func(name string) {
+		step++
+		progress.Report(ctx, progress.Event{Kind: progress.Step, Name: name, Step: step, Steps: steps})
+	}
+
+	// Execute pre-commands, if any. The standard output of the pre-command
+	// is passed to the transport and later hooks in NETBACKUP_PRE_OUTPUT.
+	var env []string
+	if preCmdPresent {
+		nextStep("PRE-COMMAND")
+		var preOutput []string
+		pctx := execute.WithOutputParser(execute.WithPhase(ctx, "pre"), func(line string) {
+			preOutput = append(preOutput, line)
+		})
+		err := runPhase(pctx, "pre_command_timeout", b.config.Parsed.PreCommandTimeout, func(ctx context.Context) error {
+			return b.runHook(ctx, "PRE-COMMAND", b.config.PreCommand)
+		})
+		if err != nil {
+			return withExitCode(ExitHook, fmt.Errorf("Error running pre-command: %v", err))
+		}
+		env = append(env, "NETBACKUP_PRE_OUTPUT="+strings.Join(preOutput, "\n"))
+	}
+
+	// Ignore interrupt signals and run the backup transport. If the user hits
+	// Ctrl-C at this point (for example), both this process and the spawned
+	// transport will receive SIGINT, and this will cause the transport to fail
+	// and report error, but this program to be interrupted before it has a
+	// chance to run FailCommand. The last lines of the transport's standard
+	// error are kept for the fail-command.
+	nextStep("TRANSPORT")
+	errTail := execute.NewTail(errorTailLines)
+	tctx := execute.WithErrorParser(execute.WithPhase(ctx, "transport"), errTail.Add)
+	// The progress file receives the standard output of the transport.
+	if b.config.ProgressFile != "" && !b.dryRun {
+		pf, err := os.Create(b.config.ProgressFile)
+		if err != nil {
+			return withExitCode(ExitError, fmt.Errorf("unable to create progress file: %v", err))
+		}
+		defer pf.Close()
+		tctx = execute.WithOutputCopy(tctx, pf)
+	}
+	transpEnv := env
+	if cred != nil {
+		log.Verbosef(2, "Running transport as user %q (uid=%d, gid=%d)\n", b.config.RunAsUser, cred.Uid, cred.Gid)
+		tctx = execute.WithCredential(tctx, cred)
+		transpEnv = append(append([]string{}, env...), "HOME="+transpHome)
+	}
+	signal.Ignore(syscall.SIGINT, syscall.SIGTERM)
+	b.execute.SetEnv(transpEnv)
+	err = runPhase(tctx, "transport_timeout", b.config.Parsed.TransportTimeout, transp.Run)
+	b.execute.SetEnv(nil)
+	signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+
+	// Execute post-commands if OK, or fail-command in case of failure.
+	if err != nil {
+		errbackup := err
+
+		log.Verbosef(1, "Error running backup: %v\n", err)
+
+		if failCmdPresent {
+			log.Verbosef(1, "Running fail-command on backup error: %q\n", b.config.FailCommand)
+			tail := "NETBACKUP_ERROR_TAIL=" + strings.Join(execute.Redact(ctx, errTail.Lines()), "\n")
+			if err := b.runHook(execute.WithPhase(cleanupCtx, "fail"), "FAIL-COMMAND", b.config.FailCommand, append(env, tail)...); err != nil {
+				log.Verbosef(1, "Error running fail-command: %v\n", err)
+			}
+		}
+		return withExitCode(ExitTransport, errbackup)
+	}
+
+	// Write the checksum manifest of the destination, if requested.
+	if b.config.WriteManifest {
+		if err := b.manifest(ctx); err != nil {
+			return withExitCode(ExitError, err)
+		}
+	}
+
+	// No errors.
+	if postCmdPresent {
+		nextStep("POST-COMMAND")
+		err := runPhase(execute.WithPhase(ctx, "post"), "post_command_timeout", b.config.Parsed.PostCommandTimeout, func(ctx context.Context) error {
+			return b.runHook(ctx, "POST-COMMAND", b.config.PostCommand, env...)
+		})
+		if err != nil {
+			if !b.config.PostCommandOptional {
+				return withExitCode(ExitHook, fmt.Errorf("Error running post-command (possible backup failure): %v", err))
+			}
+			log.Verbosef(1, "Warning: Optional post-command failed (ignored): %v\n", err)
+		}
+	}
+
+	// The transport never fails in dry-run mode, so show the fail-command
+	// that would run in case of failure.
+	if failCmdPresent && b.dryRun {
+		if err := b.runHook(execute.WithPhase(ctx, "fail"), "FAIL-COMMAND (on failure)", b.config.FailCommand); err != nil {
+			return withExitCode(ExitHook, err)
+		}
+	}
+
+	return nil
+}
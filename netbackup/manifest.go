@@ -0,0 +1,143 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package netbackup
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// manifestFile is the name of the checksum manifest, at the top of the
+// destination directory.
+const manifestFile = "MANIFEST.sha256"
+
+// hashFile returns the hex encoded SHA-256 checksum of the file fname.
+func hashFile(fname string) (string, error) {
+	r, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashTree returns the manifest lines for all regular files under dir, in
+// lexical order. Each line contains the checksum and the path relative to
+// dir, in the format used by sha256sum. The manifest itself is skipped.
+func hashTree(dir string) ([]string, error) {
+	var lines []string
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == manifestFile {
+			return nil
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, sum+"  "+filepath.ToSlash(rel))
+		return nil
+	})
+	return lines, err
+}
+
+// writeManifest atomically writes the checksum manifest (manifestFile) of all
+// regular files under dir into dir. The manifest can be checked with
+// "sha256sum -c MANIFEST.sha256" from inside dir.
+func writeManifest(dir string) error {
+	lines, err := hashTree(dir)
+	if err != nil {
+		return fmt.Errorf("unable to generate manifest: %v", err)
+	}
+
+	// Write to a temporary file and rename, so a crash never leaves a
+	// partial manifest behind.
+	tmp, err := ioutil.TempFile(dir, "."+manifestFile+".")
+	if err != nil {
+		return fmt.Errorf("unable to create manifest: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	contents := ""
+	if len(lines) != 0 {
+		contents = strings.Join(lines, "\n") + "\n"
+	}
+	if _, err := tmp.WriteString(contents); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write manifest: %v", err)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write manifest: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write manifest: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, manifestFile)); err != nil {
+		return fmt.Errorf("unable to write manifest: %v", err)
+	}
+	return nil
+}
+
+// verifyManifest checks the files under dir against the checksums in the
+// manifest (manifestFile) in dir. Returns a list of problems (files missing,
+// unreadable, or with a different checksum), or an error if the manifest
+// itself cannot be read.
+func verifyManifest(dir string) ([]string, error) {
+	r, err := os.Open(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read manifest: %v", err)
+	}
+	defer r.Close()
+
+	var problems []string
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, "  ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid line %d in manifest: %q", n, line)
+		}
+		want, name := fields[0], fields[1]
+		got, err := hashFile(filepath.Join(dir, filepath.FromSlash(name)))
+		switch {
+		case os.IsNotExist(err):
+			problems = append(problems, "missing: "+name)
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("unreadable: %s: %v", name, err))
+		case got != want:
+			problems = append(problems, "checksum mismatch: "+name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read manifest: %v", err)
+	}
+	return problems, nil
+}
@@ -0,0 +1,148 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package netbackup
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/marcopaganini/netbackup/config"
+)
+
+// Test that the manifest lists all regular files with their checksums, and
+// never includes itself.
+func TestWriteManifest(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a":         "hello\n",
+		"sub/b":     "",
+		"sub/dir/c": "netbackup",
+	}
+	for name, contents := range files {
+		fname := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fname, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("a", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Run twice to make sure the previous manifest is not included.
+	for i := 0; i < 2; i++ {
+		if err := writeManifest(dir); err != nil {
+			t.Fatalf("writeManifest failed: %v", err)
+		}
+	}
+	got, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Checksums generated with sha256sum.
+	want := "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03  a\n" +
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  sub/b\n" +
+		"fb94e503b27f2985ece2f7fcf9062d5b097bc6001be1506abc02b7c3f53400e9  sub/dir/c\n"
+	if string(got) != want {
+		t.Errorf("manifest: got %q, want %q", got, want)
+	}
+
+	// No temporary files left behind.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Errorf("got %d entries in %s, want 4 (a, sub, link, %s)", len(entries), dir, manifestFile)
+	}
+}
+
+// Test that changes to the destination after the manifest was written are
+// detected, and fail the verification with ExitVerify.
+func TestVerifyManifest(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeManifest(dir); err != nil {
+		t.Fatalf("writeManifest failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	ctx := newTestLogger(&buf)
+	cfg := &config.Config{
+		Name:      "fake",
+		SourceDir: dir,
+		DestDir:   dir,
+		Transport: "rsync",
+	}
+	verify := func() error {
+		b := NewBackup(cfg, false)
+		b.verifyManifest = true
+		fake := &fakeExecute{}
+		b.execute = fake
+		err := b.Run(ctx)
+		if len(fake.cmds) != 0 {
+			t.Errorf("verify ran commands: %q", fake.cmds)
+		}
+		return err
+	}
+
+	if err := verify(); err != nil {
+		t.Fatalf("verify on untouched destination: got error %v, want nil", err)
+	}
+
+	// Tamper with one file and remove another.
+	if err := os.WriteFile(filepath.Join(dir, "a"), []byte("A"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "c")); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := verifyManifest(dir)
+	if err != nil {
+		t.Fatalf("verifyManifest failed: %v", err)
+	}
+	want := []string{"checksum mismatch: a", "missing: c"}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("problems: got %q, want %q", problems, want)
+	}
+	if got := ExitCode(verify()); got != ExitVerify {
+		t.Errorf("verify on tampered destination: got exit code %d, want %d", got, ExitVerify)
+	}
+}
+
+// Test that the source checks are skipped when verifying the manifest, since
+// the source is not used.
+func TestVerifyManifestSkipsSource(t *testing.T) {
+	dir := t.TempDir()
+	if err := writeManifest(dir); err != nil {
+		t.Fatalf("writeManifest failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	ctx := newTestLogger(&buf)
+	cfg := &config.Config{
+		Name:             "fake",
+		SourceDir:        filepath.Join(dir, "nonexistent"),
+		DestDir:          dir,
+		Transport:        "rsync",
+		MinSourceEntries: 10,
+	}
+	b := NewBackup(cfg, false)
+	b.verifyManifest = true
+	b.execute = &fakeExecute{}
+	if err := b.Run(ctx); err != nil {
+		t.Errorf("verify with missing source: got error %v, want nil", err)
+	}
+}
@@ -0,0 +1,184 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+// Package netbackup runs backups described by a netbackup configuration. It
+// contains all the backup orchestration (devices, hooks, transports, and
+// metrics) and can be used to embed netbackup in other Go programs. The
+// netbackup command is a thin wrapper around this package.
+//
+// The logger and clock used by the backup are taken from the context (see
+// logger.WithLogger and clock.WithClock).
+package netbackup
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marcopaganini/netbackup/clock"
+	"github.com/marcopaganini/netbackup/config"
+	"github.com/marcopaganini/netbackup/execute"
+	"github.com/marcopaganini/netbackup/progress"
+)
+
+// Backup status values.
+const (
+	StatusSuccess = "success"
+	StatusFailure = "failure"
+)
+
+// Options contains the options for a backup run.
+type Options struct {
+	// DryRun shows the commands instead of executing them.
+	DryRun bool
+	// CleanupStale closes the LUKS device mapper left behind by a previous
+	// (crashed) run of the same backup, if not in use.
+	CleanupStale bool
+	// Executor runs all external commands (transports, hooks, mount, etc.)
+	// If nil, commands are executed normally.
+	Executor execute.Executor
+	// Progress, if set, receives progress events during the backup.
+	Progress ProgressFunc
+	// VerifyManifest checks the destination against the checksum manifest
+	// written by write_manifest, instead of running the backup. The hooks
+	// do not run, but the destination device is mounted (and LUKS opened)
+	// as usual.
+	VerifyManifest bool
+}
+
+// ProgressFunc receives progress events (see package progress).
+type ProgressFunc = progress.Func
+
+// Result contains the outcome of a backup run.
+type Result struct {
+	// Name of the backup.
+	Name string
+	// Status is StatusSuccess or StatusFailure.
+	Status string
+	// Duration is the total (wall clock) duration of the backup.
+	Duration time.Duration
+	// Bytes is the number of bytes transferred, when reported by the
+	// transport (currently rsync and restic). Zero if unknown.
+	Bytes int64
+	// Files is the number of files processed, when reported by the
+	// transport (currently restic only). Zero if unknown.
+	Files int64
+	// Snapshot is the ID of the snapshot created by the backup, when
+	// reported by the transport (currently restic only). Empty if unknown.
+	Snapshot string
+}
+
+// String returns a one line summary of the result, like "Backup foo: SUCCESS
+// in 12m3s, 4.2 GiB transferred, 120k files, snapshot 1234abcd". Unknown
+// values are omitted.
+func (r Result) String() string {
+	s := fmt.Sprintf("Backup %s: %s in %v", r.Name, strings.ToUpper(r.Status), r.Duration.Round(time.Second))
+	if r.Bytes > 0 {
+		s += ", " + formatBytes(r.Bytes) + " transferred"
+	}
+	if r.Files > 0 {
+		s += ", " + formatCount(r.Files) + " files"
+	}
+	if r.Snapshot != "" {
+		s += ", snapshot " + r.Snapshot
+	}
+	return s
+}
+
+// formatBytes returns n formatted with a binary unit (E.g. "4.2 GiB").
+func formatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	v := float64(n)
+	units := []string{"KiB", "MiB", "GiB", "TiB", "PiB"}
+	i := -1
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", v, units[i])
+}
+
+// formatCount returns n formatted with a decimal suffix (E.g. "120k").
+func formatCount(n int64) string {
+	v := float64(n)
+	suffix := ""
+	switch {
+	case n >= 1000000:
+		v, suffix = v/1000000, "M"
+	case n >= 1000:
+		v, suffix = v/1000, "k"
+	default:
+		return strconv.FormatInt(n, 10)
+	}
+	return strings.TrimSuffix(fmt.Sprintf("%.1f", v), ".0") + suffix
+}
+
+// Run executes the backup described by cfg. The configuration is expected to
+// be valid (as returned by config.ParseConfig or config.ParseConfigFile), but
+// Run calls cfg.Normalize itself, so configurations built directly get the
+// same parsed values and defaults. On failure, the returned error carries an
+// exit code that can be retrieved with ExitCode. Canceling ctx kills the
+// running command and stops the backup. Device cleanup (umount, LUKS close)
+// and the fail-command still run. Run works on a copy of cfg, so the caller's
+// configuration is never modified.
+func Run(ctx context.Context, cfg *config.Config, opts Options) (Result, error) {
+	clk := clock.ClockValue(ctx)
+	start := clk.Now()
+
+	c := *cfg
+	c.Exclude = append([]string(nil), cfg.Exclude...)
+	c.Filters = append([]string(nil), cfg.Filters...)
+	cfg = &c
+	if err := cfg.Normalize(); err != nil {
+		return Result{Name: cfg.Name, Status: StatusFailure}, withExitCode(ExitConfig, err)
+	}
+
+	// Keep the last byte and file counts and snapshot ID reported by the
+	// transport.
+	var (
+		bytes, files int64
+		snapshot     string
+	)
+	ctx = progress.WithFunc(ctx, func(ev progress.Event) {
+		switch ev.Kind {
+		case progress.Bytes:
+			bytes = ev.Bytes
+		case progress.Files:
+			files = ev.Files
+		case progress.Snapshot:
+			snapshot = ev.Snapshot
+		}
+		if opts.Progress != nil {
+			opts.Progress(ev)
+		}
+	})
+
+	b := NewBackup(cfg, opts.DryRun)
+	b.cleanupStale = opts.CleanupStale
+	b.verifyManifest = opts.VerifyManifest
+	if opts.Executor != nil {
+		b.execute = opts.Executor
+	}
+	progress.Report(ctx, progress.Event{Kind: progress.Started})
+	err := b.Run(ctx)
+	progress.Report(ctx, progress.Event{Kind: progress.Finished, Err: err})
+
+	res := Result{
+		Name:     cfg.Name,
+		Status:   StatusSuccess,
+		Duration: clk.Now().Sub(start),
+		Bytes:    bytes,
+		Files:    files,
+		Snapshot: snapshot,
+	}
+	if err != nil {
+		res.Status = StatusFailure
+	}
+	return res, err
+}
@@ -0,0 +1,239 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package netbackup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/marcopaganini/netbackup/clock"
+	"github.com/marcopaganini/netbackup/config"
+	"github.com/marcopaganini/netbackup/execute"
+	"github.com/marcopaganini/netbackup/progress"
+)
+
+// slowExecute is a fakeExecute that advances a fake clock on every command.
+type slowExecute struct {
+	fakeExecute
+	clk  *clock.Fake
+	step time.Duration
+}
+
+func (s *slowExecute) Exec(ctx context.Context, a []string) error {
+	s.clk.Advance(s.step)
+	return s.fakeExecute.Exec(ctx, a)
+}
+
+// Test the library API with a fake transport executor.
+func TestRun(t *testing.T) {
+	casetests := []struct {
+		failOn     string
+		wantStatus string
+		wantCode   int
+	}{
+		{wantStatus: StatusSuccess, wantCode: ExitOK},
+		{failOn: "rsync", wantStatus: StatusFailure, wantCode: ExitTransport},
+	}
+
+	for _, tt := range casetests {
+		var buf bytes.Buffer
+		clk := clock.NewFake(time.Unix(1700000000, 0))
+		ctx := clock.WithClock(newTestLogger(&buf), clk)
+
+		fake := &slowExecute{
+			fakeExecute: fakeExecute{failOn: tt.failOn},
+			clk:         clk,
+			step:        time.Minute,
+		}
+		cfg := &config.Config{
+			Name:      "fake",
+			SourceDir: os.TempDir(),
+			DestDir:   "/tmp/b",
+			Transport: "rsync",
+		}
+
+		res, err := Run(ctx, cfg, Options{Executor: fake})
+		if got := ExitCode(err); got != tt.wantCode {
+			t.Errorf("failOn=%q: got exit code %d, want %d", tt.failOn, got, tt.wantCode)
+		}
+		if res.Status != tt.wantStatus {
+			t.Errorf("failOn=%q: got status %q, want %q", tt.failOn, res.Status, tt.wantStatus)
+		}
+		if res.Duration != time.Minute {
+			t.Errorf("failOn=%q: got duration %v, want %v", tt.failOn, res.Duration, time.Minute)
+		}
+		if len(fake.cmds) != 1 || fake.cmds[0][0] != "rsync" {
+			t.Errorf("failOn=%q: got commands %q, want a single rsync command", tt.failOn, fake.cmds)
+		}
+	}
+}
+
+// Test that Run normalizes configurations built directly, so the defaults
+// in Parsed apply, and rejects invalid ones.
+func TestRunNormalize(t *testing.T) {
+	var buf bytes.Buffer
+	ctx := newTestLogger(&buf)
+
+	fake := &fakeExecute{}
+	cfg := &config.Config{
+		Name:      "fake",
+		SourceDir: os.TempDir(),
+		DestDir:   "/tmp/b",
+		Transport: "rdiff-backup",
+	}
+	if _, err := Run(ctx, cfg, Options{Executor: fake}); err != nil {
+		t.Fatalf("Run: got error %v, want no error", err)
+	}
+	if len(fake.cmds) != 1 || !reflect.DeepEqual(fake.cmds[0][1:3], []string{"--verbosity=5", "--terminal-verbosity=5"}) {
+		t.Errorf("got commands %q, want rdiff-backup with the default verbosity", fake.cmds)
+	}
+
+	cfg.TransportTimeout = "bogus"
+	if _, err := Run(ctx, cfg, Options{Executor: &fakeExecute{}}); ExitCode(err) != ExitConfig {
+		t.Errorf("Run with an invalid transport_timeout: got error %v, want exit code %d", err, ExitConfig)
+	}
+}
+
+// Test that Run does not modify the configuration, so it can be run again
+// with the same results.
+func TestRunTwice(t *testing.T) {
+	src := t.TempDir()
+	casetests := []struct {
+		cfg    config.Config
+		dryRun bool
+	}{
+		// Destination inside the source, excluded automatically.
+		{
+			cfg: config.Config{
+				Name:            "fake",
+				SourceDir:       src,
+				DestDir:         filepath.Join(src, "backup"),
+				Transport:       "rsync",
+				Exclude:         []string{"*.tmp"},
+				AutoExcludeDest: true,
+			},
+		},
+		// Device destination in dry-run mode (placeholder destinations).
+		{
+			cfg: config.Config{
+				Name:      "fake",
+				SourceDir: src,
+				DestDev:   "/dev/foo",
+				Transport: "rsync",
+			},
+			dryRun: true,
+		},
+	}
+
+	for _, tt := range casetests {
+		var buf bytes.Buffer
+		ctx := newTestLogger(&buf)
+
+		cfg := tt.cfg
+		orig := tt.cfg
+		orig.Exclude = append([]string(nil), tt.cfg.Exclude...)
+
+		var plans [2]execute.Plan
+		for i := range plans {
+			if _, err := Run(execute.WithPlan(ctx, &plans[i]), &cfg, Options{Executor: &fakeExecute{}, DryRun: tt.dryRun}); err != nil {
+				t.Fatalf("Run %d: got error %v, want no error", i+1, err)
+			}
+			if !reflect.DeepEqual(cfg, orig) {
+				t.Errorf("Run %d modified the configuration:\ngot:  %+v\nwant: %+v", i+1, cfg, orig)
+			}
+		}
+		// Temporary file names differ between runs.
+		tmpfile := regexp.MustCompile(`/(filter|exclude|include)[0-9]+`)
+		first := tmpfile.ReplaceAllString(fmt.Sprint(plans[0]), "/$1")
+		second := tmpfile.ReplaceAllString(fmt.Sprint(plans[1]), "/$1")
+		if first != second {
+			t.Errorf("commands differ between runs:\nfirst:  %s\nsecond: %s", first, second)
+		}
+	}
+}
+
+// Test that a backup run fires the expected sequence of progress events.
+func TestRunProgress(t *testing.T) {
+	var buf bytes.Buffer
+	ctx := newTestLogger(&buf)
+
+	fake := &fakeExecute{
+		stdout: []string{"sent 1,000 bytes  received 24 bytes  2,048.00 bytes/sec"},
+	}
+	cfg := &config.Config{
+		Name:        "fake",
+		SourceDir:   os.TempDir(),
+		DestDir:     "/tmp/b",
+		Transport:   "rsync",
+		PreCommand:  "pre",
+		PostCommand: "post",
+	}
+
+	var got []progress.Event
+	res, err := Run(ctx, cfg, Options{
+		Executor: fake,
+		Progress: func(ev progress.Event) { got = append(got, ev) },
+	})
+	if err != nil {
+		t.Fatalf("Run: got error %v, want no error", err)
+	}
+
+	want := []progress.Event{
+		{Kind: progress.Started},
+		{Kind: progress.Step, Name: "PRE-COMMAND", Step: 1, Steps: 3},
+		{Kind: progress.Step, Name: "TRANSPORT", Step: 2, Steps: 3},
+		{Kind: progress.Bytes, Bytes: 1024},
+		{Kind: progress.Step, Name: "POST-COMMAND", Step: 3, Steps: 3},
+		{Kind: progress.Finished},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("progress events:\ngot:  %+v\nwant: %+v", got, want)
+	}
+	if res.Bytes != 1024 {
+		t.Errorf("Result.Bytes: got %d, want 1024", res.Bytes)
+	}
+}
+
+// Test the formatting of the result summary.
+func TestResultString(t *testing.T) {
+	casetests := []struct {
+		res  Result
+		want string
+	}{
+		{
+			res:  Result{Name: "foo", Status: StatusSuccess, Duration: 12*time.Minute + 3*time.Second + 400*time.Millisecond, Bytes: 4509715660, Files: 120000},
+			want: "Backup foo: SUCCESS in 12m3s, 4.2 GiB transferred, 120k files",
+		},
+		{
+			res:  Result{Name: "foo", Status: StatusFailure, Duration: 5 * time.Second},
+			want: "Backup foo: FAILURE in 5s",
+		},
+		{
+			res:  Result{Name: "bar", Status: StatusSuccess, Duration: time.Hour, Bytes: 512, Files: 999},
+			want: "Backup bar: SUCCESS in 1h0m0s, 512 B transferred, 999 files",
+		},
+		{
+			res:  Result{Name: "bar", Status: StatusSuccess, Duration: time.Minute, Bytes: 1536, Files: 1500000},
+			want: "Backup bar: SUCCESS in 1m0s, 1.5 KiB transferred, 1.5M files",
+		},
+		{
+			res:  Result{Name: "baz", Status: StatusSuccess, Duration: time.Minute, Snapshot: "1234abcd"},
+			want: "Backup baz: SUCCESS in 1m0s, snapshot 1234abcd",
+		},
+	}
+	for _, tt := range casetests {
+		if got := tt.res.String(); got != tt.want {
+			t.Errorf("String: got %q, want %q", got, tt.want)
+		}
+	}
+}
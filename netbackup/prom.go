@@ -0,0 +1,224 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package netbackup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/marcopaganini/netbackup/clock"
+	"github.com/marcopaganini/netbackup/config"
+)
+
+const (
+	// Prometheus metric names.
+	promBackupMetric  = "backup"
+	promStartMetric   = "netbackup_start_timestamp"
+	promOverranMetric = "netbackup_overran"
+
+	// Default value of the job label (see prometheus_job).
+	promDefaultJob = "netbackup"
+)
+
+// promMetric returns the name of metric, using the metric name prefix in cfg
+// (prometheus_metric_prefix), if any. The prefix replaces the "netbackup_"
+// prefix in the default names (E.g. "backup" becomes "<prefix>_backup", and
+// "netbackup_overran" becomes "<prefix>_overran".)
+func promMetric(cfg *config.Config, metric string) string {
+	if cfg.PromMetricPrefix == "" {
+		return metric
+	}
+	return cfg.PromMetricPrefix + "_" + strings.TrimPrefix(metric, "netbackup_")
+}
+
+// promJob returns the value of the job label for cfg.
+func promJob(cfg *config.Config) string {
+	if cfg.PromJob == "" {
+		return promDefaultJob
+	}
+	return cfg.PromJob
+}
+
+// exists returns true if the file exists, false otherwise.
+func exists(fname string) bool {
+	if _, err := os.Stat(fname); errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+	return true
+}
+
+// lockPath returns the name of the lockfile under lockdir used to serialize
+// writes to textfile. The name is based on a hash of the absolute path of
+// textfile, so different textfiles with the same basename use different
+// lockfiles.
+func lockPath(lockdir string, textfile string) (string, error) {
+	abs, err := filepath.Abs(textfile)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(lockdir, fmt.Sprintf("%s-%x.lock", filepath.Base(abs), sum[:8])), nil
+}
+
+// openLock opens (creating if needed) the lockfile for textfile under lockdir.
+// If that fails, the directory containing textfile is used instead.
+func openLock(lockdir string, textfile string) (*os.File, error) {
+	var lockerr error
+
+	for _, dir := range []string{lockdir, filepath.Dir(textfile)} {
+		lockfile, err := lockPath(dir, textfile)
+		if err != nil {
+			return nil, err
+		}
+		lock, err := os.OpenFile(lockfile, os.O_RDWR|os.O_CREATE, 0755)
+		if err == nil {
+			return lock, nil
+		}
+		lockerr = err
+	}
+	return nil, fmt.Errorf("error opening lockfile: %v", lockerr)
+}
+
+// WriteOverranMetric records in the node (prometheus) compatible textfile in
+// cfg (if any) that the backup took longer than max_duration. The record
+// holds the timestamp of the last overrun.
+func WriteOverranMetric(ctx context.Context, cfg *config.Config) error {
+	if cfg.PromTextFile == "" {
+		return nil
+	}
+	return writeNodeTextFile(ctx, cfg.TmpDir, cfg.PromTextFile, promMetric(cfg, promOverranMetric), cfg.Name, promJob(cfg), "", "", cfg.PromLabels)
+}
+
+// promEscape escapes a label value for the prometheus text format.
+func promEscape(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// writeNodeTextFile writes a record in a prometheus node-exporter
+// compatible "textfile" format, timestamped using the clock in ctx. The
+// record is formatted as:
+//
+// <metric>{name="foobar", job="<job>", status="<status>", snapshot="<id>", <extra>} <timestamp>
+//
+// The status and snapshot labels are omitted if empty. The labels in extra
+// are added at the end, sorted by name. Existing lines with the same metric,
+// name, job, status, and extra labels will be overwritten. All other lines
+// will remain intact.
+//
+// The function employs FLock() on a separate lockfile (under lockdir, or the
+// directory containing textfile if lockdir is not writable) to prevent race
+// conditions when modifying to the original file. All writes go into a
+// temporary file that is atomically renamed to the final name once work is
+// done.
+func writeNodeTextFile(ctx context.Context, lockdir string, textfile string, metric string, name string, job string, status string, snapshot string, extra map[string]string) error {
+	dirname, fname := filepath.Split(textfile)
+
+	// Create a lockfile and Flock it.
+	lock, err := openLock(lockdir, textfile)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	data := []byte{}
+	if exists(textfile) {
+		data, err = os.ReadFile(textfile)
+		if err != nil {
+			return fmt.Errorf("error reading textfile: %v", err)
+		}
+	}
+
+	// Format labels.
+	labels := fmt.Sprintf("name=%q, job=%q", name, job)
+	if status != "" {
+		labels += fmt.Sprintf(", status=%q", status)
+	}
+	if snapshot != "" {
+		labels += fmt.Sprintf(", snapshot=%q", snapshot)
+	}
+	keys := make([]string, 0, len(extra))
+	for k := range extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		labels += fmt.Sprintf(", %s=\"%s\"", k, promEscape(extra[k]))
+	}
+
+	// Rebuild output without any previous lines with the same metric, name,
+	// job, status, and extra labels, and the new line added with the current
+	// unix timestamp.
+	re := `^` + regexp.QuoteMeta(metric) + `[\s]*{.*name="` + regexp.QuoteMeta(name) + `".*job="` + regexp.QuoteMeta(job) + `".*`
+	if status != "" {
+		re += `status="` + regexp.QuoteMeta(status) + `".*`
+	}
+	for _, k := range keys {
+		re += `[{ ]` + regexp.QuoteMeta(k) + `="` + regexp.QuoteMeta(promEscape(extra[k])) + `".*`
+	}
+	matchname, err := regexp.Compile(re)
+	if err != nil {
+		return err
+	}
+
+	output := []byte{}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		// See https://github.com/golang/go/issues/35130
+		// To understand why this BS is needed here.
+		if len(line) == 0 {
+			continue
+		}
+		// Don't copy our own lines.
+		if matchname.Match(line) {
+			continue
+		}
+		output = append(output, line...)
+		output = append(output, byte('\n'))
+	}
+	// Add our line.
+	s := fmt.Sprintf("%s{%s} %d\n", metric, labels, clock.TimestampValue(ctx).Now().Unix())
+	output = append(output, []byte(s)...)
+
+	// Write to temporary file and rename it to the original file name.
+	tempdir := dirname
+	if dirname == "" {
+		tempdir = "./"
+	}
+	temp, err := os.CreateTemp(tempdir, fname)
+	if err != nil {
+		return fmt.Errorf("error creating temp file: %v", err)
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+	if err := os.Chmod(temp.Name(), 0664); err != nil {
+		return err
+	}
+
+	_, err = temp.Write(output)
+	if err != nil {
+		return fmt.Errorf("error writing to temp file: %v", err)
+	}
+	temp.Close()
+
+	if err := os.Rename(temp.Name(), textfile); err != nil {
+		return fmt.Errorf("error renaming temp file: %v", err)
+	}
+
+	return nil
+}
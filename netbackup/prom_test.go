@@ -0,0 +1,371 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package netbackup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcopaganini/netbackup/clock"
+	"github.com/marcopaganini/netbackup/config"
+)
+
+// Number of records to create/test.
+const numRecords = 20
+
+// generate creates multiple node compatible backup records in parallel.
+func generate(lockdir string, tmpfile string, ch chan error) {
+	// Generate multiple backup records.
+	for i := 0; i < numRecords; i++ {
+		go func(ch chan error, name string) {
+			err := writeNodeTextFile(context.Background(), lockdir, tmpfile, promBackupMetric, name, promDefaultJob, "success", "", nil)
+			ch <- err
+		}(ch, fmt.Sprintf("backup%03.3d", i))
+	}
+}
+
+// errcheck returns the first error found in a slice of error channels.
+func errcheck(ch chan error) error {
+	var saved error
+	for i := 0; i < numRecords; i++ {
+		err := <-ch
+		if err != nil && saved == nil {
+			saved = err
+		}
+	}
+	return saved
+}
+
+// filecheck parses the generated file and makes sure we have exactly
+// numRecords properly formatted records.
+func filecheck(t *testing.T, tmpfile string) error {
+	data, err := os.ReadFile(tmpfile)
+	if err != nil {
+		return err
+	}
+	lines := bytes.Split(data, []byte("\n"))
+
+	t.Log("Generated file contents")
+	for i, v := range lines {
+		t.Logf("%d: %s\n", i, v)
+	}
+
+	// Make sure we have exactly numRecords lines.
+	numlines := len(lines) - 1 // Skip the last blank line caused by a newline.
+	if numlines != numRecords {
+		return fmt.Errorf("number of lines mismatch: expected %d, found %d", numRecords, numlines)
+	}
+
+	// Fill in the "names" map with all names found in the file.
+	re := regexp.MustCompile(`backup[\s]*{name="([^"]*)", job="netbackup", status="success"} [0-9]+`)
+	names := map[string]bool{}
+	for _, line := range lines {
+		// Skip blank line at the end.
+		if len(line) == 0 {
+			continue
+		}
+		matches := re.FindSubmatch(line)
+		if matches != nil {
+			names[string(matches[1])] = true
+		}
+	}
+
+	// Make sure all names are present.
+	missing := []string{}
+	for i := 0; i < numRecords; i++ {
+		name := fmt.Sprintf("backup%03.3d", i)
+		_, ok := names[name]
+		if !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing backup names in output: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+func TestMulti(t *testing.T) {
+	ch := make(chan error, numRecords)
+
+	tmpfile := filepath.Join(t.TempDir(), "testfile")
+	generate(os.TempDir(), tmpfile, ch)
+
+	if err := errcheck(ch); err != nil {
+		t.Fatalf("TestMulti/errcheck: %v", err)
+	}
+	if err := filecheck(t, tmpfile); err != nil {
+		t.Fatalf("TestMulti/filecheck: %v", err)
+	}
+}
+
+// Test concurrent writes to different textfiles with the same basename.
+func TestMultiSameBasename(t *testing.T) {
+	ch1 := make(chan error, numRecords)
+	ch2 := make(chan error, numRecords)
+
+	tmpfile1 := filepath.Join(t.TempDir(), "testfile")
+	tmpfile2 := filepath.Join(t.TempDir(), "testfile")
+
+	lock1, err := lockPath("/tmp", tmpfile1)
+	if err != nil {
+		t.Fatalf("lockPath failed: %v", err)
+	}
+	lock2, err := lockPath("/tmp", tmpfile2)
+	if err != nil {
+		t.Fatalf("lockPath failed: %v", err)
+	}
+	if lock1 == lock2 {
+		t.Fatalf("textfiles %q and %q share the same lockfile %q", tmpfile1, tmpfile2, lock1)
+	}
+	defer os.Remove(lock1)
+	defer os.Remove(lock2)
+
+	generate("/tmp", tmpfile1, ch1)
+	generate("/tmp", tmpfile2, ch2)
+
+	for _, ch := range []chan error{ch1, ch2} {
+		if err := errcheck(ch); err != nil {
+			t.Fatalf("TestMultiSameBasename/errcheck: %v", err)
+		}
+	}
+	for _, tmpfile := range []string{tmpfile1, tmpfile2} {
+		if err := filecheck(t, tmpfile); err != nil {
+			t.Fatalf("TestMultiSameBasename/filecheck: %v", err)
+		}
+	}
+}
+
+// Test that the lockfile falls back to the textfile directory when the lock
+// directory is not writable.
+func TestLockDirFallback(t *testing.T) {
+	ch := make(chan error, numRecords)
+
+	tmpdir := t.TempDir()
+	tmpfile := filepath.Join(tmpdir, "testfile")
+	lockdir := filepath.Join(tmpdir, "nonexistent")
+
+	generate(lockdir, tmpfile, ch)
+
+	if err := errcheck(ch); err != nil {
+		t.Fatalf("TestLockDirFallback/errcheck: %v", err)
+	}
+	if err := filecheck(t, tmpfile); err != nil {
+		t.Fatalf("TestLockDirFallback/filecheck: %v", err)
+	}
+	lockfile, err := lockPath(tmpdir, tmpfile)
+	if err != nil {
+		t.Fatalf("lockPath failed: %v", err)
+	}
+	if !exists(lockfile) {
+		t.Errorf("lockfile %q not created in the textfile directory", lockfile)
+	}
+}
+
+// Test that start lines are written and later joined by the end lines.
+func TestStartAndEnd(t *testing.T) {
+	tmpfile := filepath.Join(t.TempDir(), "testfile")
+	lockdir := t.TempDir()
+
+	// Other backup, must remain intact.
+	if err := writeNodeTextFile(context.Background(), lockdir, tmpfile, promBackupMetric, "other", promDefaultJob, "success", "", nil); err != nil {
+		t.Fatalf("writeNodeTextFile failed: %v", err)
+	}
+
+	startRe := regexp.MustCompile(`^netbackup_start_timestamp{name="foo", job="netbackup"} [0-9]+$`)
+	successRe := regexp.MustCompile(`^backup{name="foo", job="netbackup", status="success"} [0-9]+$`)
+	failureRe := regexp.MustCompile(`^backup{name="foo", job="netbackup", status="failure"} [0-9]+$`)
+	otherRe := regexp.MustCompile(`^backup{name="other", job="netbackup", status="success"} [0-9]+$`)
+
+	// count returns the number of lines in tmpfile matching re.
+	count := func(re *regexp.Regexp) int {
+		data, err := os.ReadFile(tmpfile)
+		if err != nil {
+			t.Fatalf("error reading textfile: %v", err)
+		}
+		n := 0
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			if re.Match(line) {
+				n++
+			}
+		}
+		return n
+	}
+
+	steps := []struct {
+		metric string
+		status string
+		// Expected number of start, success, and failure lines after this step.
+		start, success, failure int
+	}{
+		{metric: promStartMetric, start: 1},
+		{metric: promBackupMetric, status: "success", start: 1, success: 1},
+		{metric: promStartMetric, start: 1, success: 1},
+		{metric: promBackupMetric, status: "failure", start: 1, success: 1, failure: 1},
+	}
+
+	for i, st := range steps {
+		if err := writeNodeTextFile(context.Background(), lockdir, tmpfile, st.metric, "foo", promDefaultJob, st.status, "", nil); err != nil {
+			t.Fatalf("writeNodeTextFile failed: %v", err)
+		}
+		if n := count(startRe); n != st.start {
+			t.Errorf("step %d: got %d start lines, want %d", i, n, st.start)
+		}
+		if n := count(successRe); n != st.success {
+			t.Errorf("step %d: got %d success lines, want %d", i, n, st.success)
+		}
+		if n := count(failureRe); n != st.failure {
+			t.Errorf("step %d: got %d failure lines, want %d", i, n, st.failure)
+		}
+		if n := count(otherRe); n != 1 {
+			t.Errorf("step %d: got %d lines for other backup, want 1", i, n)
+		}
+	}
+}
+
+// Test that writeNodeTextFile uses the clock for timestamps.
+func TestFakeClockTimestamp(t *testing.T) {
+	ctx := clock.WithClock(context.Background(), clock.NewFake(time.Unix(1700000000, 0)))
+
+	tmpfile := filepath.Join(t.TempDir(), "testfile")
+	if err := writeNodeTextFile(ctx, t.TempDir(), tmpfile, promBackupMetric, "foo", promDefaultJob, "success", "", nil); err != nil {
+		t.Fatalf("writeNodeTextFile failed: %v", err)
+	}
+	data, err := os.ReadFile(tmpfile)
+	if err != nil {
+		t.Fatalf("error reading textfile: %v", err)
+	}
+	want := "backup{name=\"foo\", job=\"netbackup\", status=\"success\"} 1700000000\n"
+	if string(data) != want {
+		t.Errorf("textfile contents: got %q, want %q", string(data), want)
+	}
+}
+
+// Test that the snapshot label is written, when present.
+func TestSnapshotLabel(t *testing.T) {
+	ctx := clock.WithClock(context.Background(), clock.NewFake(time.Unix(1700000000, 0)))
+
+	tmpfile := filepath.Join(t.TempDir(), "testfile")
+	lockdir := t.TempDir()
+	for _, snapshot := range []string{"", "1234abcd"} {
+		if err := writeNodeTextFile(ctx, lockdir, tmpfile, promBackupMetric, "foo", promDefaultJob, "success", snapshot, nil); err != nil {
+			t.Fatalf("writeNodeTextFile failed: %v", err)
+		}
+	}
+	data, err := os.ReadFile(tmpfile)
+	if err != nil {
+		t.Fatalf("error reading textfile: %v", err)
+	}
+	want := "backup{name=\"foo\", job=\"netbackup\", status=\"success\", snapshot=\"1234abcd\"} 1700000000\n"
+	if string(data) != want {
+		t.Errorf("textfile contents: got %q, want %q", string(data), want)
+	}
+}
+
+// Test that the overrun metric is only written with a textfile configured.
+func TestWriteOverranMetric(t *testing.T) {
+	ctx := clock.WithClock(context.Background(), clock.NewFake(time.Unix(1700000000, 0)))
+
+	cfg := &config.Config{Name: "foo", TmpDir: t.TempDir()}
+	if err := WriteOverranMetric(ctx, cfg); err != nil {
+		t.Errorf("WriteOverranMetric without textfile: got error %v, want no error", err)
+	}
+
+	cfg.PromTextFile = filepath.Join(t.TempDir(), "testfile")
+	if err := WriteOverranMetric(ctx, cfg); err != nil {
+		t.Fatalf("WriteOverranMetric failed: %v", err)
+	}
+	data, err := os.ReadFile(cfg.PromTextFile)
+	if err != nil {
+		t.Fatalf("error reading textfile: %v", err)
+	}
+	want := "netbackup_overran{name=\"foo\", job=\"netbackup\"} 1700000000\n"
+	if string(data) != want {
+		t.Errorf("textfile contents: got %q, want %q", string(data), want)
+	}
+}
+
+// Test that the metric name prefix and job label are used in the records,
+// and that lines from other jobs are left alone.
+func TestMetricPrefixAndJob(t *testing.T) {
+	ctx := clock.WithClock(context.Background(), clock.NewFake(time.Unix(1700000000, 0)))
+
+	tmpfile := filepath.Join(t.TempDir(), "testfile")
+	lockdir := t.TempDir()
+
+	// Record from the default job, must remain intact.
+	if err := writeNodeTextFile(ctx, lockdir, tmpfile, "myorg_netbackup_backup", "foo", promDefaultJob, "success", "", nil); err != nil {
+		t.Fatalf("writeNodeTextFile failed: %v", err)
+	}
+
+	cfg := &config.Config{Name: "foo", PromMetricPrefix: "myorg_netbackup", PromJob: "backups"}
+	records := []struct{ metric, status string }{
+		{promStartMetric, ""},
+		{promBackupMetric, "success"},
+		{promBackupMetric, "success"},
+	}
+	for _, r := range records {
+		if err := writeNodeTextFile(ctx, lockdir, tmpfile, promMetric(cfg, r.metric), cfg.Name, promJob(cfg), r.status, "", nil); err != nil {
+			t.Fatalf("writeNodeTextFile failed: %v", err)
+		}
+	}
+	data, err := os.ReadFile(tmpfile)
+	if err != nil {
+		t.Fatalf("error reading textfile: %v", err)
+	}
+	want := "myorg_netbackup_backup{name=\"foo\", job=\"netbackup\", status=\"success\"} 1700000000\n" +
+		"myorg_netbackup_start_timestamp{name=\"foo\", job=\"backups\"} 1700000000\n" +
+		"myorg_netbackup_backup{name=\"foo\", job=\"backups\", status=\"success\"} 1700000000\n"
+	if string(data) != want {
+		t.Errorf("textfile contents: got %q, want %q", string(data), want)
+	}
+
+	// Metric names without a prefix are unchanged.
+	cfg.PromMetricPrefix = ""
+	for _, metric := range []string{promBackupMetric, promStartMetric, promOverranMetric} {
+		if got := promMetric(cfg, metric); got != metric {
+			t.Errorf("promMetric(%q) without prefix: got %q, want %q", metric, got, metric)
+		}
+	}
+}
+
+// Test that extra labels are added (sorted and escaped), and that lines are
+// replaced only for the same name and extra labels.
+func TestExtraLabels(t *testing.T) {
+	ctx := clock.WithClock(context.Background(), clock.NewFake(time.Unix(1700000000, 0)))
+
+	tmpfile := filepath.Join(t.TempDir(), "testfile")
+	lockdir := t.TempDir()
+
+	writes := []map[string]string{
+		{"tier": "gold", "host": "a\"b\\c"},
+		{"tier": "silver", "host": "a\"b\\c"},
+		// Replaces the first line.
+		{"host": "a\"b\\c", "tier": "gold"},
+	}
+	for _, extra := range writes {
+		if err := writeNodeTextFile(ctx, lockdir, tmpfile, promBackupMetric, "foo", promDefaultJob, "success", "", extra); err != nil {
+			t.Fatalf("writeNodeTextFile failed: %v", err)
+		}
+	}
+	data, err := os.ReadFile(tmpfile)
+	if err != nil {
+		t.Fatalf("error reading textfile: %v", err)
+	}
+	want := `backup{name="foo", job="netbackup", status="success", host="a\"b\\c", tier="silver"} 1700000000` + "\n" +
+		`backup{name="foo", job="netbackup", status="success", host="a\"b\\c", tier="gold"} 1700000000` + "\n"
+	if string(data) != want {
+		t.Errorf("textfile contents: got %q, want %q", string(data), want)
+	}
+}
@@ -0,0 +1,56 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package netbackup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Status of a running backup, as shown in the status file.
+const statusRunning = "running"
+
+// writeStatusFile atomically writes the status file for a backup. The file
+// contains one "key=value" pair per line with the PID of the netbackup
+// process, the start time of the backup, the transport, and the status
+// (running, success, or failure). The end time is added once the backup
+// finishes (status other than running.) The directory containing the file is
+// created if needed.
+func writeStatusFile(fname string, transport string, status string, start time.Time, end time.Time) error {
+	dir := filepath.Dir(fname)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	contents := fmt.Sprintf("pid=%d\nstart=%s\ntransport=%s\nstatus=%s\n", os.Getpid(), start.Format(time.RFC3339), transport, status)
+	if status != statusRunning {
+		contents += fmt.Sprintf("end=%s\n", end.Format(time.RFC3339))
+	}
+
+	// Write to a temporary file and rename, so readers never see a partial
+	// status file.
+	tmp, err := ioutil.TempFile(dir, filepath.Base(fname)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fname)
+}
@@ -0,0 +1,88 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+// Package progress delivers structured progress events about a running
+// backup to a callback function stored in the context.
+package progress
+
+import (
+	"context"
+)
+
+// Kind is the type of a progress event.
+type Kind int
+
+// Progress event kinds.
+const (
+	// Started is sent once, when the backup starts.
+	Started Kind = iota
+	// Step is sent when a step (pre_command, transport, post_command)
+	// starts. Event.Step and Event.Steps hold the step number (starting
+	// at one) and the number of steps.
+	Step
+	// Bytes is sent when the transport reports the number of bytes
+	// transferred so far, in Event.Bytes.
+	Bytes
+	// Files is sent when the transport reports the number of files
+	// processed so far, in Event.Files.
+	Files
+	// Finished is sent once, when the backup finishes. Event.Err holds the
+	// backup error, if any.
+	Finished
+	// Snapshot is sent when the transport reports the ID of the snapshot
+	// created by the backup, in Event.Snapshot.
+	Snapshot
+)
+
+// String returns the name of the event kind.
+func (k Kind) String() string {
+	switch k {
+	case Started:
+		return "started"
+	case Step:
+		return "step"
+	case Bytes:
+		return "bytes"
+	case Files:
+		return "files"
+	case Finished:
+		return "finished"
+	case Snapshot:
+		return "snapshot"
+	}
+	return "unknown"
+}
+
+// Event is a progress event.
+type Event struct {
+	Kind Kind
+	// Name of the step (PRE-COMMAND, TRANSPORT, POST-COMMAND).
+	Name  string
+	Step  int
+	Steps int
+	Bytes int64
+	Files int64
+	Err   error
+	// Snapshot ID (restic only).
+	Snapshot string
+}
+
+// Func receives progress events.
+type Func func(Event)
+
+// funcKey is the context key for the progress function.
+type funcKey struct{}
+
+// WithFunc returns a copy of ctx that causes Report to send events to f.
+func WithFunc(ctx context.Context, f Func) context.Context {
+	return context.WithValue(ctx, funcKey{}, f)
+}
+
+// Report sends ev to the progress function in ctx, if any.
+func Report(ctx context.Context, ev Event) {
+	if f, ok := ctx.Value(funcKey{}).(Func); ok && f != nil {
+		f(ev)
+	}
+}
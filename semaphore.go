@@ -0,0 +1,103 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	// Default directory for the global semaphore slot files.
+	defaultGlobalLockDir = "/var/lock/netbackup"
+
+	// How often to check for a free slot when waiting.
+	semPollInterval = 5 * time.Second
+)
+
+// errNoSlots is returned when all global semaphore slots are in use.
+var errNoSlots = errors.New("maximum number of concurrent netbackup jobs reached")
+
+// globalSemaphore is a counting semaphore shared by independent netbackup
+// processes. It's implemented as a directory containing one lockfile per
+// slot. A process holds a slot while it holds an exclusive flock on the
+// corresponding file. Locks are released by the kernel when the process
+// exits, so a crashed job never keeps a slot busy.
+type globalSemaphore struct {
+	dir   string
+	slots int
+	lock  *os.File
+}
+
+// newGlobalSemaphore returns a new globalSemaphore with the given number of
+// slots, using dir to hold the slot files.
+func newGlobalSemaphore(dir string, slots int) *globalSemaphore {
+	return &globalSemaphore{dir: dir, slots: slots}
+}
+
+// tryAcquire attempts to acquire a free slot without blocking. Returns true
+// if a slot was acquired, false if all slots are in use.
+func (s *globalSemaphore) tryAcquire() (bool, error) {
+	if s.lock != nil {
+		return false, fmt.Errorf("semaphore slot already held")
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return false, fmt.Errorf("unable to create semaphore dir %q: %v", s.dir, err)
+	}
+	for i := 0; i < s.slots; i++ {
+		fname := filepath.Join(s.dir, fmt.Sprintf("slot-%d.lock", i))
+		f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return false, fmt.Errorf("error opening semaphore slot: %v", err)
+		}
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			s.lock = f
+			return true, nil
+		}
+		f.Close()
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			return false, fmt.Errorf("error locking semaphore slot %q: %v", fname, err)
+		}
+	}
+	return false, nil
+}
+
+// acquire acquires a slot in the semaphore. If all slots are in use and wait
+// is false, errNoSlots is returned immediately. Otherwise, acquire checks for
+// a free slot every poll interval until one is available or the context is
+// cancelled.
+func (s *globalSemaphore) acquire(ctx context.Context, wait bool, poll time.Duration) error {
+	for {
+		ok, err := s.tryAcquire()
+		if err != nil || ok {
+			return err
+		}
+		if !wait {
+			return errNoSlots
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(poll):
+		}
+	}
+}
+
+// release releases the slot held by the semaphore, if any.
+func (s *globalSemaphore) release() error {
+	if s.lock == nil {
+		return nil
+	}
+	err := s.lock.Close()
+	s.lock = nil
+	return err
+}
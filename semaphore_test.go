@@ -0,0 +1,68 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Test acquiring and releasing semaphore slots with multiple holders.
+func TestGlobalSemaphore(t *testing.T) {
+	const slots = 3
+	dir := t.TempDir()
+
+	// Fill all slots.
+	var holders []*globalSemaphore
+	for i := 0; i < slots; i++ {
+		s := newGlobalSemaphore(dir, slots)
+		if err := s.acquire(context.Background(), false, time.Millisecond); err != nil {
+			t.Fatalf("acquire %d failed: %v", i, err)
+		}
+		holders = append(holders, s)
+	}
+
+	// No free slots: fail immediately without waiting.
+	extra := newGlobalSemaphore(dir, slots)
+	if err := extra.acquire(context.Background(), false, time.Millisecond); !errors.Is(err, errNoSlots) {
+		t.Fatalf("acquire with all slots in use: got %v, want %v", err, errNoSlots)
+	}
+
+	// No free slots: wait until the context expires.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := extra.acquire(ctx, true, 10*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("waiting acquire with all slots in use: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// Waiting acquire succeeds once a holder releases its slot.
+	done := make(chan error)
+	go func() {
+		done <- extra.acquire(context.Background(), true, 10*time.Millisecond)
+	}()
+	time.Sleep(30 * time.Millisecond)
+	if err := holders[1].release(); err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("waiting acquire failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("waiting acquire did not return after a slot was released")
+	}
+
+	// Releasing twice is harmless.
+	if err := holders[1].release(); err != nil {
+		t.Errorf("second release failed: %v", err)
+	}
+	for _, s := range append(holders, extra) {
+		s.release()
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/marcopaganini/logger"
@@ -25,6 +26,16 @@ type RcloneTransport struct {
 	Transport
 }
 
+func init() {
+	Register("rclone", func(cfg *config.Config, ex execute.Executor, dryRun bool) (Runner, error) {
+		t, err := NewRcloneTransport(cfg, ex, dryRun)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	})
+}
+
 // NewRcloneTransport creates a new Transport object for rclone.
 func NewRcloneTransport(config *config.Config, ex execute.Executor, dryRun bool) (*RcloneTransport, error) {
 	t := &RcloneTransport{}
@@ -45,6 +56,16 @@ func NewRcloneTransport(config *config.Config, ex execute.Executor, dryRun bool)
 	return t, nil
 }
 
+// checkConfig performs rclone specific checks in the configuration.
+func (r *RcloneTransport) checkConfig() error {
+	if r.config.RcloneConfig != "" {
+		if _, err := os.Stat(r.config.RcloneConfig); err != nil {
+			return fmt.Errorf("Config error: rclone_config: %v", err)
+		}
+	}
+	return r.Transport.checkConfig()
+}
+
 // Run forms the command name and executes it, saving the output to the log
 // file requested in the configuration or a default one if none is specified.
 // Temporary files with exclusion and inclusion paths are generated, if needed,
@@ -59,23 +80,64 @@ func (r *RcloneTransport) Run(ctx context.Context) error {
 	if r.config.CustomBin != "" {
 		cmd = strings.Split(r.config.CustomBin, " ")
 	}
-	cmd = append(cmd, "sync", "-v")
+	cmd = append(cmd, "sync")
+
+	// Rclone refuses -v together with --log-level.
+	if r.config.RcloneLogLevel != "" {
+		cmd = append(cmd, "--log-level="+strings.ToUpper(r.config.RcloneLogLevel))
+	} else {
+		cmd = append(cmd, "-v")
+	}
+	if r.config.Parsed.RcloneStats > 0 {
+		cmd = append(cmd, "--stats="+r.config.Parsed.RcloneStats.String())
+	}
+
+	// Alternate (possibly encrypted) rclone configuration.
+	if r.config.RcloneConfig != "" {
+		cmd = append(cmd, fmt.Sprintf("--config=%s", r.config.RcloneConfig))
+	}
+	if r.config.RcloneConfigPassCommand != "" {
+		cmd = append(cmd, fmt.Sprintf("--password-command=%s", r.config.RcloneConfigPassCommand))
+	}
+	if r.config.CacheDir != "" {
+		cmd = append(cmd, fmt.Sprintf("--cache-dir=%s", r.config.CacheDir))
+	}
 
 	// Create filter file, if needed.
-	if len(r.config.Exclude) > 0 || len(r.config.Include) > 0 {
-		filterFile, err := r.createFilterFile(ctx, r.config.Include, r.config.Exclude)
+	if len(r.config.Filters) > 0 || len(r.config.Exclude) > 0 || len(r.config.Include) > 0 {
+		filterFile, err := r.createFilterFile(ctx, r.config.Filters, r.config.Include, r.config.Exclude)
 		if err != nil {
 			return err
 		}
 		defer os.Remove(filterFile)
 		cmd = append(cmd, fmt.Sprintf("--filter-from=%s", filterFile))
 	}
-	cmd = append(cmd, r.config.ExtraArgs...)
+	if r.config.ExcludeCaches {
+		cmd = append(cmd, "--exclude-if-present="+cacheDirTag)
+	}
+	if r.config.Parsed.MaxFileSize > 0 {
+		// Without a suffix, rclone sizes are in KiB.
+		cmd = append(cmd, "--max-size="+strconv.FormatInt(r.config.Parsed.MaxFileSize, 10)+"B")
+	}
+	bwlimit, err := r.bwLimit(ctx)
+	if err != nil {
+		return err
+	}
+	if bwlimit != "" {
+		log.Verbosef(2, "Bandwidth limit from schedule: %s\n", bwlimit)
+		cmd = append(cmd, "--bwlimit="+bwlimit)
+	}
+	warnDuplicateFlags(ctx, r.extraArgs(r.config.RcloneArgs), cmd)
+	cmd = append(cmd, r.extraArgs(r.config.RcloneArgs)...)
 
 	cmd = append(cmd, r.buildSource(":"))
 	cmd = append(cmd, r.buildDest(":"))
 
-	log.Verbosef(1, "Command: %s\n", strings.Join(cmd, " "))
+	r.logDestination(ctx, r.buildDest(":"))
+	log.Verbosef(1, "Command: %s\n", strings.Join(execute.Redact(ctx, cmd), " "))
+	if err := execute.RecordCommand(ctx, cmd); err != nil {
+		return err
+	}
 
 	// Execute the command
 	if !r.dryRun {
@@ -7,6 +7,8 @@ package transports
 
 import (
 	"context"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/marcopaganini/logger"
@@ -15,18 +17,23 @@ import (
 
 func TestRclone(t *testing.T) {
 	casetests := []struct {
-		name       string
-		sourceDir  string
-		sourceHost string
-		destDir    string
-		destHost   string
-		transport  string
-		logfile    string
-		expectCmds []string
-		include    []string
-		exclude    []string
-		dryRun     bool
-		wantError  bool
+		name          string
+		sourceDir     string
+		sourceHost    string
+		destDir       string
+		destHost      string
+		transport     string
+		logfile       string
+		expectCmds    []string
+		include       []string
+		exclude       []string
+		cacheDir      string
+		extraArgs     []string
+		transportArgs []string
+		logLevel      string
+		stats         string
+		dryRun        bool
+		wantError     bool
 	}{
 		// Dry run: No command should be executed
 		{
@@ -108,6 +115,56 @@ func TestRclone(t *testing.T) {
 			logfile:    "/dev/null",
 			expectCmds: []string{"rclone sync -v --filter-from=[^ ]+ /tmp/a /tmp/b"},
 		},
+		// Cache directory.
+		{
+			name:       "fake",
+			sourceDir:  "/tmp/a",
+			destDir:    "/tmp/b",
+			cacheDir:   "/var/cache/rclone",
+			transport:  "rclone",
+			logfile:    "/dev/null",
+			expectCmds: []string{"rclone sync -v --cache-dir=/var/cache/rclone /tmp/a /tmp/b"},
+		},
+		// Generic and transport specific arguments, in order.
+		{
+			name:          "fake",
+			sourceDir:     "/tmp/a",
+			destDir:       "/tmp/b",
+			extraArgs:     []string{"--generic"},
+			transportArgs: []string{"--specific1", "--specific2"},
+			transport:     "rclone",
+			logfile:       "/dev/null",
+			expectCmds:    []string{"rclone sync -v --generic --specific1 --specific2 /tmp/a /tmp/b"},
+		},
+		// Log level (replaces -v) and stats interval.
+		{
+			name:       "fake",
+			sourceDir:  "/tmp/a",
+			destDir:    "/tmp/b",
+			logLevel:   "debug",
+			transport:  "rclone",
+			logfile:    "/dev/null",
+			expectCmds: []string{"rclone sync --log-level=DEBUG /tmp/a /tmp/b"},
+		},
+		{
+			name:       "fake",
+			sourceDir:  "/tmp/a",
+			destDir:    "/tmp/b",
+			stats:      "30s",
+			transport:  "rclone",
+			logfile:    "/dev/null",
+			expectCmds: []string{"rclone sync -v --stats=30s /tmp/a /tmp/b"},
+		},
+		{
+			name:       "fake",
+			sourceDir:  "/tmp/a",
+			destDir:    "/tmp/b",
+			logLevel:   "NOTICE",
+			stats:      "5m",
+			transport:  "rclone",
+			logfile:    "/dev/null",
+			expectCmds: []string{"rclone sync --log-level=NOTICE --stats=5m0s /tmp/a /tmp/b"},
+		},
 		// Test that an empty source dir results in an error
 		{
 			name:      "fake",
@@ -142,7 +199,16 @@ func TestRclone(t *testing.T) {
 			Transport:  tt.transport,
 			Logfile:    tt.logfile,
 			Include:    tt.include,
+			ExtraArgs:  tt.extraArgs,
+			RcloneArgs: tt.transportArgs,
 			Exclude:    tt.exclude,
+			CacheDir:   tt.cacheDir,
+
+			RcloneLogLevel: tt.logLevel,
+			RcloneStats:    tt.stats,
+		}
+		if err := cfg.Normalize(); err != nil {
+			t.Fatalf("Normalize failed: %v", err)
 		}
 
 		// Create a new transport object with our fakeExecute and a sinking outLogWriter.
@@ -176,3 +242,77 @@ func TestRclone(t *testing.T) {
 		}
 	}
 }
+
+// Test the rclone_config and rclone_config_pass_command options.
+func TestRcloneConfig(t *testing.T) {
+	rcloneConf := filepath.Join(t.TempDir(), "rclone.conf")
+	if err := os.WriteFile(rcloneConf, []byte{}, 0600); err != nil {
+		t.Fatalf("error creating rclone config: %v", err)
+	}
+
+	casetests := []struct {
+		rcloneConfig  string
+		rclonePassCmd string
+		expectCmds    []string
+		wantError     bool
+	}{
+		// Config file only.
+		{
+			rcloneConfig: rcloneConf,
+			expectCmds:   []string{"rclone sync -v --config=" + rcloneConf + " /tmp/a /tmp/b"},
+		},
+		// Password command only.
+		{
+			rclonePassCmd: "pass rclone",
+			expectCmds:    []string{"rclone sync -v --password-command=pass rclone /tmp/a /tmp/b"},
+		},
+		// Both.
+		{
+			rcloneConfig:  rcloneConf,
+			rclonePassCmd: "pass rclone",
+			expectCmds:    []string{"rclone sync -v --config=" + rcloneConf + " --password-command=pass rclone /tmp/a /tmp/b"},
+		},
+		// Nonexistent config file.
+		{
+			rcloneConfig: "/nonexistent/rclone.conf",
+			wantError:    true,
+		},
+	}
+
+	for _, tt := range casetests {
+		fakeExecute := NewFakeExecute()
+
+		log := logger.New("")
+		ctx := context.Background()
+		ctx = logger.WithLogger(ctx, log)
+
+		cfg := &config.Config{
+			Name:                    "fake",
+			SourceDir:               "/tmp/a",
+			DestDir:                 "/tmp/b",
+			Transport:               "rclone",
+			RcloneConfig:            tt.rcloneConfig,
+			RcloneConfigPassCommand: tt.rclonePassCmd,
+		}
+		rclone, err := NewRcloneTransport(cfg, fakeExecute, false)
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("NewRcloneTransport: got no error, want error")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("NewRcloneTransport failed: %v", err)
+		}
+		if err := rclone.Run(ctx); err != nil {
+			t.Fatalf("rclone.Run failed: %v", err)
+		}
+		match, err := reMatch(tt.expectCmds, fakeExecute.Cmds())
+		if err != nil {
+			t.Fatalf("Error on regexp match: %v", err)
+		}
+		if !match {
+			t.Errorf("command diff: Got %v, want %v", fakeExecute.Cmds(), tt.expectCmds)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/marcopaganini/logger"
@@ -25,6 +26,16 @@ type RdiffBackupTransport struct {
 	Transport
 }
 
+func init() {
+	Register("rdiff-backup", func(cfg *config.Config, ex execute.Executor, dryRun bool) (Runner, error) {
+		t, err := NewRdiffBackupTransport(cfg, ex, dryRun)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	})
+}
+
 // NewRdiffBackupTransport creates a new Transport object for rdiff-backup.
 func NewRdiffBackupTransport(config *config.Config, ex execute.Executor, dryRun bool) (*RdiffBackupTransport, error) {
 	t := &RdiffBackupTransport{}
@@ -55,8 +66,10 @@ func (r *RdiffBackupTransport) checkConfig() error {
 		return fmt.Errorf("Config error: DestDir is empty")
 	case r.config.SourceHost != "" && r.config.DestHost != "":
 		return fmt.Errorf("Config error: Cannot have source & dest host set")
+	case len(r.config.Filters) != 0:
+		return fmt.Errorf("Config error: Filters is not supported by rdiff-backup transport")
 	}
-	return nil
+	return r.checkCustomBin()
 }
 
 // Run forms the command name and executes it, saving the output to the log
@@ -80,7 +93,7 @@ func (r *RdiffBackupTransport) Run(ctx context.Context) error {
 
 	// Create exclude file list, if needed.
 	if len(r.config.Exclude) != 0 {
-		excludeFile, err = writeList(ctx, "exclude", r.config.Exclude)
+		excludeFile, err = writeList(ctx, r.config.TmpDir, "exclude", r.config.Exclude)
 		if err != nil {
 			return err
 		}
@@ -89,19 +102,27 @@ func (r *RdiffBackupTransport) Run(ctx context.Context) error {
 
 	// Create include file list, if needed.
 	if len(r.config.Include) != 0 {
-		includeFile, err = writeList(ctx, "include", r.config.Include)
+		includeFile, err = writeList(ctx, r.config.TmpDir, "include", r.config.Include)
 		if err != nil {
 			return err
 		}
 		defer os.Remove(includeFile)
 	}
 
-	// Build the full rdiff-backup command line.
-	cmd := []string{rdiffBackupCmd}
+	// Build the full rdiff-backup command line. The expiration commands
+	// use the same binary.
+	bin := []string{rdiffBackupCmd}
 	if r.config.CustomBin != "" {
-		cmd = strings.Split(r.config.CustomBin, " ")
+		bin = strings.Split(r.config.CustomBin, " ")
+	}
+	cmd := append([]string{}, bin...)
+	cmd = append(cmd,
+		fmt.Sprintf("--verbosity=%d", r.config.Parsed.RdiffVerbosity),
+		fmt.Sprintf("--terminal-verbosity=%d", r.config.Parsed.RdiffVerbosity),
+		"--preserve-numerical-ids", "--exclude-sockets")
+	if r.config.Parsed.RdiffForce {
+		cmd = append(cmd, "--force")
 	}
-	cmd = append(cmd, "--verbosity=5", "--terminal-verbosity=5", "--preserve-numerical-ids", "--exclude-sockets", "--force")
 
 	if len(r.config.Exclude) != 0 {
 		cmd = append(cmd, fmt.Sprintf("--exclude-globbing-filelist=%s", excludeFile))
@@ -109,6 +130,13 @@ func (r *RdiffBackupTransport) Run(ctx context.Context) error {
 	if len(r.config.Include) != 0 {
 		cmd = append(cmd, fmt.Sprintf("--include-globbing-filelist=%s", includeFile))
 	}
+	if r.config.ExcludeCaches {
+		cmd = append(cmd, "--exclude-if-present", cacheDirTag)
+	}
+	if r.config.Parsed.MaxFileSize > 0 {
+		cmd = append(cmd, "--max-file-size", strconv.FormatInt(r.config.Parsed.MaxFileSize, 10))
+	}
+	warnDuplicateFlags(ctx, r.config.ExtraArgs, cmd)
 	cmd = append(cmd, r.config.ExtraArgs...)
 
 	// rdiff-backup uses double colons as host/destination separators.
@@ -120,11 +148,18 @@ func (r *RdiffBackupTransport) Run(ctx context.Context) error {
 
 	// Add expiration command, if required.
 	if r.config.ExpireDays != 0 {
-		cmd := []string{
-			rdiffBackupCmd,
+		cmd := append(append([]string{}, bin...),
 			fmt.Sprintf("--remove-older-than=%dD", r.config.ExpireDays),
 			"--force",
-			r.buildDest("::")}
+			r.buildDest("::"))
+		cmds = append(cmds, cmd)
+	}
+	// Keep only the last ExpireCount backups ("NB" means the Nth backup.)
+	if r.config.ExpireCount != 0 {
+		cmd := append(append([]string{}, bin...),
+			fmt.Sprintf("--remove-older-than=%dB", r.config.ExpireCount),
+			"--force",
+			r.buildDest("::"))
 		cmds = append(cmds, cmd)
 	}
 
@@ -138,8 +173,12 @@ func (r *RdiffBackupTransport) Run(ctx context.Context) error {
 		"Updated mirror temp file.* does not match source",
 		"/.gvfs"}
 
+	r.logDestination(ctx, r.buildDest("::"))
 	for i, c := range cmds {
-		log.Verbosef(1, "Command(%d/%d): %s\n", i+1, len(cmds), strings.Join(c, " "))
+		log.Verbosef(1, "Command(%d/%d): %s\n", i+1, len(cmds), strings.Join(execute.Redact(ctx, c), " "))
+		if err := execute.RecordCommand(ctx, c); err != nil {
+			return err
+		}
 	}
 
 	// Execute the command(s)
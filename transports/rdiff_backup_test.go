@@ -30,6 +30,10 @@ func TestRdiffBackup(t *testing.T) {
 		include    []string
 		exclude    []string
 		expireDays int
+		expireCnt  int
+		customBin  string
+		verbosity  *int
+		force      *bool
 		dryRun     bool
 		wantError  bool
 	}{
@@ -51,6 +55,26 @@ func TestRdiffBackup(t *testing.T) {
 			logfile:    "/dev/null",
 			expectCmds: []string{rdiffBackupTestCmd + " /tmp/a /tmp/b"},
 		},
+		// Custom verbosity
+		{
+			name:       "fake",
+			sourceDir:  "/tmp/a",
+			destDir:    "/tmp/b",
+			transport:  "rdiff-backup",
+			logfile:    "/dev/null",
+			verbosity:  intPtr(3),
+			expectCmds: []string{"rdiff-backup --verbosity=3 --terminal-verbosity=3 --preserve-numerical-ids --exclude-sockets --force /tmp/a /tmp/b"},
+		},
+		// No --force
+		{
+			name:       "fake",
+			sourceDir:  "/tmp/a",
+			destDir:    "/tmp/b",
+			transport:  "rdiff-backup",
+			logfile:    "/dev/null",
+			force:      boolPtr(false),
+			expectCmds: []string{"rdiff-backup --verbosity=5 --terminal-verbosity=5 --preserve-numerical-ids --exclude-sockets /tmp/a /tmp/b"},
+		},
 		// Local source, remote destination
 		{
 			name:       "fake",
@@ -127,6 +151,35 @@ func TestRdiffBackup(t *testing.T) {
 				"rdiff-backup --remove-older-than=7D --force /tmp/b",
 			},
 		},
+		// Expiration by number of backups.
+		{
+			name:      "fake",
+			sourceDir: "/tmp/a",
+			destDir:   "/tmp/b",
+			transport: "rdiff-backup",
+			logfile:   "/dev/null",
+			expireCnt: 10,
+			expectCmds: []string{
+				rdiffBackupTestCmd + " /tmp/a /tmp/b",
+				"rdiff-backup --remove-older-than=10B --force /tmp/b",
+			},
+		},
+		// Expiration commands use custom_bin, if set.
+		{
+			name:       "fake",
+			sourceDir:  "/tmp/a",
+			destDir:    "/tmp/b",
+			transport:  "rdiff-backup",
+			logfile:    "/dev/null",
+			customBin:  "sh -c true",
+			expireDays: 7,
+			expireCnt:  10,
+			expectCmds: []string{
+				"sh -c true --verbosity=5 --terminal-verbosity=5 --preserve-numerical-ids --exclude-sockets --force /tmp/a /tmp/b",
+				"sh -c true --remove-older-than=7D --force /tmp/b",
+				"sh -c true --remove-older-than=10B --force /tmp/b",
+			},
+		},
 		// Test that an empty source dir results in an error
 		{
 			name:      "fake",
@@ -153,16 +206,24 @@ func TestRdiffBackup(t *testing.T) {
 		ctx = logger.WithLogger(ctx, log)
 
 		cfg := &config.Config{
-			Name:       tt.name,
-			SourceDir:  tt.sourceDir,
-			SourceHost: tt.sourceHost,
-			DestDir:    tt.destDir,
-			DestHost:   tt.destHost,
-			Transport:  tt.transport,
-			ExpireDays: tt.expireDays,
-			Logfile:    tt.logfile,
-			Include:    tt.include,
-			Exclude:    tt.exclude,
+			Name:        tt.name,
+			SourceDir:   tt.sourceDir,
+			SourceHost:  tt.sourceHost,
+			DestDir:     tt.destDir,
+			DestHost:    tt.destHost,
+			Transport:   tt.transport,
+			ExpireDays:  tt.expireDays,
+			ExpireCount: tt.expireCnt,
+			CustomBin:   tt.customBin,
+			Logfile:     tt.logfile,
+			Include:     tt.include,
+			Exclude:     tt.exclude,
+
+			RdiffVerbosity: tt.verbosity,
+			RdiffForce:     tt.force,
+		}
+		if err := cfg.Normalize(); err != nil {
+			t.Fatalf("Normalize failed: %v", err)
 		}
 
 		// Create a new transport object with our fakeExecute and a sinking outLogWriter.
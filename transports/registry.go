@@ -0,0 +1,70 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package transports
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/marcopaganini/netbackup/config"
+	"github.com/marcopaganini/netbackup/execute"
+)
+
+// Runner is the interface implemented by all transports.
+type Runner interface {
+	Run(context.Context) error
+}
+
+// Factory creates a new transport using the configuration, executor, and
+// dry-run mode passed by the caller.
+type Factory func(cfg *config.Config, ex execute.Executor, dryRun bool) (Runner, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register makes a transport available under the given name (the value of
+// "transport" in the configuration). It is normally called from the init
+// function of the package implementing the transport. Register panics if
+// factory is nil or if the name is already registered.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic(fmt.Sprintf("transports: Register factory for %q is nil", name))
+	}
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("transports: Register called twice for %q", name))
+	}
+	registry[name] = factory
+}
+
+// Lookup returns the factory for the named transport and true, or nil and
+// false if no transport has been registered under that name.
+func Lookup(name string) (Factory, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	f, ok := registry[name]
+	return f, ok
+}
+
+// Names returns a sorted list of the registered transport names.
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	var names []string
+	for k := range registry {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,46 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package transports
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/marcopaganini/netbackup/config"
+	"github.com/marcopaganini/netbackup/execute"
+)
+
+// Test that the builtin transports are registered and that duplicate
+// registrations are refused.
+func TestRegistry(t *testing.T) {
+	want := []string{"rclone", "rdiff-backup", "restic", "rsync", "tar", "test"}
+	if got := Names(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Names: got %q, want %q", got, want)
+	}
+
+	for _, name := range want {
+		f, ok := Lookup(name)
+		if !ok {
+			t.Errorf("Lookup(%q): transport not found", name)
+			continue
+		}
+		cfg := &config.Config{SourceDir: "/tmp/a", DestDir: "/tmp/b"}
+		if _, err := f(cfg, NewFakeExecute(), true); err != nil {
+			t.Errorf("factory for %q: got error %v, want no error", name, err)
+		}
+	}
+
+	if _, ok := Lookup("nonexistent"); ok {
+		t.Errorf("Lookup(nonexistent): got ok, want not found")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Register(rsync) twice: expected panic")
+		}
+	}()
+	Register("rsync", func(*config.Config, execute.Executor, bool) (Runner, error) { return nil, nil })
+}
@@ -7,24 +7,59 @@ package transports
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/marcopaganini/logger"
+	"github.com/marcopaganini/netbackup/clock"
 	"github.com/marcopaganini/netbackup/config"
 	"github.com/marcopaganini/netbackup/execute"
+	"github.com/marcopaganini/netbackup/progress"
 )
 
 const (
 	resticCmd = "restic"
 )
 
+var (
+	// resticAdded matches the amount of data added to the repository, as
+	// printed at the end of restic backup.
+	resticAdded = regexp.MustCompile(`^Added to the repository: ([\d.]+) (B|KiB|MiB|GiB|TiB)\b`)
+	// resticProcessed matches the number of files processed by restic backup.
+	resticProcessed = regexp.MustCompile(`^processed (\d+) files,`)
+	// resticSnapshot matches the ID of the snapshot saved by restic backup.
+	resticSnapshot = regexp.MustCompile(`^snapshot ([0-9a-f]+) saved$`)
+
+	// resticUnits maps the size units used by restic to bytes.
+	resticUnits = map[string]float64{
+		"B":   1,
+		"KiB": 1 << 10,
+		"MiB": 1 << 20,
+		"GiB": 1 << 30,
+		"TiB": 1 << 40,
+	}
+)
+
 // ResticTransport is the main structure for the restic transport.
 type ResticTransport struct {
 	Transport
 }
 
+func init() {
+	Register("restic", func(cfg *config.Config, ex execute.Executor, dryRun bool) (Runner, error) {
+		t, err := NewResticTransport(cfg, ex, dryRun)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	})
+}
+
 // NewResticTransport creates a new Transport object for restic.
 func NewResticTransport(config *config.Config, ex execute.Executor, dryRun bool) (*ResticTransport, error) {
 	t := &ResticTransport{}
@@ -56,10 +91,70 @@ func (r *ResticTransport) checkConfig() error {
 		return fmt.Errorf("config error: DestDir is empty")
 	case len(r.config.Include) != 0:
 		return fmt.Errorf("config error: Include is not supported by restic transport")
+	case len(r.config.Filters) != 0:
+		return fmt.Errorf("config error: Filters is not supported by restic transport")
 	case r.config.SourceHost != "":
 		return fmt.Errorf("config error: Cannot have source host set (push mode only)")
 	}
-	return nil
+	return r.checkCustomBin()
+}
+
+// repo returns the restic repository. If dest_dir is a restic backend URL
+// (E.g. "s3:host/bucket"), it's returned unchanged and dest_host is ignored.
+// Otherwise, the repository is built from dest_host and dest_dir.
+func (r *ResticTransport) repo() string {
+	if config.IsResticBackend(r.config.DestDir) {
+		return r.config.DestDir
+	}
+	return r.buildDest(":")
+}
+
+// repoCmd returns the restic binary followed by the arguments common to all
+// restic commands (cache directory, extra_args, and the repository).
+func (r *ResticTransport) repoCmd() []string {
+	resticBin := resticCmd
+	if r.config.CustomBin != "" {
+		resticBin = r.config.CustomBin
+	}
+	cmd := strings.Split(resticBin, " ")
+	if r.config.CacheDir != "" {
+		cmd = append(cmd, fmt.Sprintf("--cache-dir=%s", r.config.CacheDir))
+	}
+	cmd = append(cmd, r.extraArgs(r.config.ResticArgs)...)
+	return append(cmd, "--repo", r.repo())
+}
+
+// initRepo initializes the restic repository if it has not been initialized
+// yet. A failing "restic cat config" indicates an uninitialized repository.
+// This is safe to run repeatedly, as restic refuses to initialize an existing
+// repository. In dry-run mode, the commands are only logged.
+func (r *ResticTransport) initRepo(ctx context.Context) error {
+	log := logger.LoggerValue(ctx)
+
+	check := append(r.repoCmd(), "cat", "config")
+	init := append(r.repoCmd(), "init")
+
+	// Only record the commands actually executed. The init command is only
+	// executed (and recorded) if the check fails, so never in dry-run mode.
+	if err := execute.RecordCommand(ctx, check); err != nil {
+		return err
+	}
+
+	if r.dryRun {
+		log.Verbosef(1, "Command (check repository): %s\n", strings.Join(execute.Redact(ctx, check), " "))
+		log.Verbosef(1, "Command (initialize repository, if needed): %s\n", strings.Join(execute.Redact(ctx, init), " "))
+		return nil
+	}
+
+	if err := execute.RunCommand(ctx, "RESTIC-CHECK", check, r.execute, nil, nil); err == nil {
+		log.Verbosef(2, "Restic repository already initialized.\n")
+		return nil
+	}
+	log.Verbosef(1, "Restic repository not initialized. Initializing.\n")
+	if err := execute.RecordCommand(ctx, init); err != nil {
+		return err
+	}
+	return execute.RunCommand(ctx, "RESTIC-INIT", init, r.execute, nil, nil)
 }
 
 // Run builds the command name and executes it, saving the output to the log
@@ -75,21 +170,29 @@ func (r *ResticTransport) Run(ctx context.Context) error {
 		cmds [][]string
 
 		excludeFile string
+		err         error
 	)
 
 	log := logger.LoggerValue(ctx)
 
 	// Create exclude file list, if needed.
 	if len(r.config.Exclude) != 0 {
-		excludeFile, err := writeList(ctx, "exclude", r.config.Exclude)
+		excludeFile, err = writeList(ctx, r.config.TmpDir, "exclude", r.config.Exclude)
 		if err != nil {
 			return err
 		}
 		defer os.Remove(excludeFile)
 	}
 
+	// Initialize the repository, if requested.
+	if r.config.InitRepo {
+		if err := r.initRepo(ctx); err != nil {
+			return fmt.Errorf("error initializing restic repository: %v", err)
+		}
+	}
+
 	// Generate restic command-line.
-	// restic -v -v [--exclude-file=<file>] [extra_args] --repo <destination_repo> backup <sourcedir>
+	// restic [-v...] [--exclude-file=<file>] [--exclude-caches] [--exclude-larger-than=<size>] [--cache-dir=<dir>] [extra_args] --repo <destination_repo> backup <sourcedir>
 
 	resticBin := resticCmd
 	if r.config.CustomBin != "" {
@@ -97,37 +200,145 @@ func (r *ResticTransport) Run(ctx context.Context) error {
 	}
 
 	cmd := strings.Split(resticBin, " ")
-	cmd = append(cmd, "-v", "-v")
+	for i := 0; i < r.config.Parsed.ResticVerbosity; i++ {
+		cmd = append(cmd, "-v")
+	}
 
 	if len(r.config.Exclude) != 0 {
 		cmd = append(cmd, fmt.Sprintf("--exclude-file=%s", excludeFile))
 	}
+	if r.config.ExcludeCaches {
+		cmd = append(cmd, "--exclude-caches")
+	}
+	if r.config.Parsed.MaxFileSize > 0 {
+		cmd = append(cmd, "--exclude-larger-than="+strconv.FormatInt(r.config.Parsed.MaxFileSize, 10))
+	}
+	if r.config.CacheDir != "" {
+		cmd = append(cmd, fmt.Sprintf("--cache-dir=%s", r.config.CacheDir))
+	}
 
-	cmd = append(cmd, r.config.ExtraArgs...)
-	cmd = append(cmd, []string{"--repo", r.buildDest(":")}...)
+	warnDuplicateFlags(ctx, r.extraArgs(r.config.ResticArgs), append([]string{"--repo", "-r"}, cmd...))
+	cmd = append(cmd, r.extraArgs(r.config.ResticArgs)...)
+	cmd = append(cmd, []string{"--repo", r.repo()}...)
 	cmd = append(cmd, "backup", r.config.SourceDir)
 
 	// Add to list of commands.
 	cmds = append(cmds, cmd)
 
-	// Create expiration command, if required.
+	// Create expiration command, if required. Pruning only happens if
+	// prune_interval has elapsed since the last prune (or always, if
+	// prune_interval is not set.)
+	prune := false
 	if r.config.ExpireDays != 0 {
-		cmd = append(cmd, []string{"forget", fmt.Sprintf("--keep-within=%dd", r.config.ExpireDays), "--prune"}...)
+		if prune, err = r.pruneDue(ctx); err != nil {
+			return err
+		}
+		cmd := append(r.repoCmd(), "forget", fmt.Sprintf("--keep-within=%dd", r.config.ExpireDays))
+		if prune {
+			cmd = append(cmd, "--prune")
+		}
 		cmds = append(cmds, cmd)
 	}
 
+	r.logDestination(ctx, r.repo())
 	for i, c := range cmds {
-		log.Verbosef(1, "Command(%d/%d): %s\n", i+1, len(cmds), strings.Join(c, " "))
+		log.Verbosef(1, "Command(%d/%d): %s\n", i+1, len(cmds), strings.Join(execute.Redact(ctx, c), " "))
+		if err := execute.RecordCommand(ctx, c); err != nil {
+			return err
+		}
 	}
 
-	// Execute the command(s)
+	// Execute the command(s), reporting the backup statistics from the
+	// output.
 	if !r.dryRun {
+		pctx := execute.WithOutputParser(ctx, func(line string) {
+			reportResticStats(ctx, line)
+		})
 		for _, c := range cmds {
-			err := execute.RunCommand(ctx, "RESTIC", c, r.execute, nil, nil)
+			err := execute.RunCommand(pctx, "RESTIC", c, r.execute, nil, nil)
 			if err != nil {
 				return err
 			}
 		}
+		if prune && r.config.Parsed.PruneInterval != 0 {
+			if err := r.savePruneState(ctx); err != nil {
+				log.Verbosef(1, "Warning: Unable to save prune state: %v\n", err)
+			}
+		}
 	}
 	return nil
 }
+
+// pruneStateFile returns the name of the file used to record the time of the
+// last prune for the current repository.
+func (r *ResticTransport) pruneStateFile() string {
+	sum := sha256.Sum256([]byte(r.repo()))
+	return filepath.Join(r.config.StateDir, fmt.Sprintf("restic-prune-%x", sum[:8]))
+}
+
+// pruneDue returns true if the repository should be pruned in this run. This
+// is always the case when prune_interval is not set. Otherwise, pruning is
+// due if the last prune (the modification time of the prune state file)
+// happened longer than prune_interval ago, according to the clock in ctx.
+func (r *ResticTransport) pruneDue(ctx context.Context) (bool, error) {
+	if r.config.Parsed.PruneInterval == 0 {
+		return true, nil
+	}
+	fi, err := os.Stat(r.pruneStateFile())
+	if err != nil {
+		return true, nil
+	}
+	return clock.ClockValue(ctx).Now().Sub(fi.ModTime()) >= r.config.Parsed.PruneInterval, nil
+}
+
+// savePruneState records the current time (according to the clock in ctx) as
+// the time of the last prune.
+func (r *ResticTransport) savePruneState(ctx context.Context) error {
+	if err := os.MkdirAll(r.config.StateDir, 0755); err != nil {
+		return err
+	}
+	fname := r.pruneStateFile()
+	w, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s\n", r.repo())
+	if err := w.Close(); err != nil {
+		return err
+	}
+	now := clock.ClockValue(ctx).Now()
+	return os.Chtimes(fname, now, now)
+}
+
+// parseResticSnapshot returns the snapshot ID from a restic "snapshot <id>
+// saved" line, and true. If line is not a snapshot line, it returns false.
+func parseResticSnapshot(line string) (string, bool) {
+	m := resticSnapshot.FindStringSubmatch(strings.TrimSpace(line))
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// reportResticStats reports the bytes added to the repository, the number of
+// files processed, and the ID of the saved snapshot, if line contains these
+// statistics.
+func reportResticStats(ctx context.Context, line string) {
+	if id, ok := parseResticSnapshot(line); ok {
+		progress.Report(ctx, progress.Event{Kind: progress.Snapshot, Snapshot: id})
+		return
+	}
+	if m := resticProcessed.FindStringSubmatch(line); m != nil {
+		if n, err := strconv.ParseInt(m[1], 10, 64); err == nil {
+			progress.Report(ctx, progress.Event{Kind: progress.Files, Files: n})
+		}
+		return
+	}
+	if m := resticAdded.FindStringSubmatch(line); m != nil {
+		v, err := strconv.ParseFloat(m[1], 64)
+		if err != nil {
+			return
+		}
+		progress.Report(ctx, progress.Event{Kind: progress.Bytes, Bytes: int64(v * resticUnits[m[2]])})
+	}
+}
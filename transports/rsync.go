@@ -9,22 +9,42 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/marcopaganini/logger"
 	"github.com/marcopaganini/netbackup/config"
 	"github.com/marcopaganini/netbackup/execute"
+	"github.com/marcopaganini/netbackup/progress"
 )
 
 const (
 	rsyncCmd = "rsync"
+
+	// Exit code for "some files vanished before they could be transferred".
+	rsyncVanished = 24
 )
 
+// rsyncSummary matches the transfer summary printed by rsync -v.
+var rsyncSummary = regexp.MustCompile(`^sent ([\d,.]+) bytes\s+received ([\d,.]+) bytes`)
+
 // RsyncTransport is the main structure for the rsync transport.
 type RsyncTransport struct {
 	Transport
 }
 
+func init() {
+	Register("rsync", func(cfg *config.Config, ex execute.Executor, dryRun bool) (Runner, error) {
+		t, err := NewRsyncTransport(cfg, ex, dryRun)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	})
+}
+
 // NewRsyncTransport creates a new Transport object for rsync.
 func NewRsyncTransport(config *config.Config, ex execute.Executor, dryRun bool) (*RsyncTransport, error) {
 	t := &RsyncTransport{}
@@ -56,7 +76,7 @@ func (r *RsyncTransport) checkConfig() error {
 	case r.config.SourceHost != "" && r.config.DestHost != "":
 		return fmt.Errorf("Config error: Cannot have source & dest host set")
 	}
-	return nil
+	return r.checkCustomBin()
 }
 
 // Run builds the command name and executes it, saving the output to the log
@@ -75,9 +95,43 @@ func (r *RsyncTransport) Run(ctx context.Context) error {
 	}
 	cmd = append(cmd, "-avAXH", "--delete", "--numeric-ids")
 
+	// Rsync has no option to skip cache directories, so we find them
+	// and exclude them explicitly. Cache excludes come first in the filter
+	// rules, so they always take precedence.
+	filters, exclude := r.config.Filters, r.config.Exclude
+	if r.config.ExcludeCaches {
+		caches, err := r.cacheDirExcludes(ctx)
+		if err != nil {
+			return err
+		}
+		// Without the trailing slash, patterns are anchored at the
+		// parent of the source directory.
+		if r.config.RsyncNoTrailingSlash {
+			for i, c := range caches {
+				caches[i] = "/" + filepath.Base(r.config.SourceDir) + c
+			}
+		}
+		if len(caches) > 0 {
+			var rules []string
+			for _, c := range caches {
+				rules = append(rules, "- "+c)
+			}
+			// Turn include/exclude into rules after the cache excludes.
+			if len(filters) == 0 {
+				for _, v := range r.config.Include {
+					rules = append(rules, "+ "+v)
+				}
+				for _, v := range exclude {
+					rules = append(rules, "- "+v)
+				}
+			}
+			filters = append(rules, filters...)
+		}
+	}
+
 	// Create filter file, if needed.
-	if len(r.config.Include) > 0 || len(r.config.Exclude) > 0 {
-		filterFile, err := r.createFilterFile(ctx, r.config.Include, r.config.Exclude)
+	if len(filters) > 0 || len(r.config.Include) > 0 || len(exclude) > 0 {
+		filterFile, err := r.createFilterFile(ctx, filters, r.config.Include, exclude)
 		if err != nil {
 			return err
 		}
@@ -85,37 +139,92 @@ func (r *RsyncTransport) Run(ctx context.Context) error {
 		// Merge the filter file in the filter specification.
 		cmd = append(cmd, fmt.Sprintf("--filter=merge %s", filterFile))
 	}
+	// Per-directory exclusions: CVS style (.cvsignore) and filter files.
+	if r.config.RsyncCvsExclude {
+		cmd = append(cmd, "--cvs-exclude")
+	}
+	if r.config.RsyncIgnoreFile != "" {
+		cmd = append(cmd, "--filter=: "+r.config.RsyncIgnoreFile)
+	}
 	if len(r.config.Exclude) > 0 {
 		cmd = append(cmd, "--delete-excluded")
 	}
-	cmd = append(cmd, r.config.ExtraArgs...)
+	if r.config.Parsed.MaxFileSize > 0 {
+		cmd = append(cmd, "--max-size="+strconv.FormatInt(r.config.Parsed.MaxFileSize, 10))
+	}
+	if r.config.RsyncInplace {
+		cmd = append(cmd, "--inplace")
+	}
+	if r.config.RsyncSparse {
+		cmd = append(cmd, "--sparse")
+	}
+	bwlimit, err := r.bwLimit(ctx)
+	if err != nil {
+		return err
+	}
+	if bwlimit != "" {
+		log.Verbosef(2, "Bandwidth limit from schedule: %s\n", bwlimit)
+		cmd = append(cmd, "--bwlimit="+bwlimit)
+	}
+	warnDuplicateFlags(ctx, r.extraArgs(r.config.RsyncArgs), cmd)
+	cmd = append(cmd, r.extraArgs(r.config.RsyncArgs)...)
 
 	// In rsync, the source needs to ends with a slash or the source directory
 	// will be created inside the destination.  The exception are the cases
-	// where the source already ends in a slash (ex: /)
+	// where the source already ends in a slash (ex: /), or when the user
+	// explicitly wants the source directory created in the destination.
 	src := r.buildSource(":")
-	if !strings.HasSuffix(src, "/") {
+	if !strings.HasSuffix(src, "/") && !r.config.RsyncNoTrailingSlash {
 		src = src + "/"
 	}
 	cmd = append(cmd, src)
 	cmd = append(cmd, r.buildDest(":"))
 
-	log.Verbosef(1, "Command: %s\n", strings.Join(cmd, " "))
+	r.logDestination(ctx, r.buildDest(":"))
+	log.Verbosef(1, "Command: %s\n", strings.Join(execute.Redact(ctx, cmd), " "))
+	if err := execute.RecordCommand(ctx, cmd); err != nil {
+		return err
+	}
 
 	if r.dryRun {
 		return nil
 	}
 
-	// Execute the command
-	err := execute.RunCommand(ctx, "RSYNC", cmd, r.execute, nil, nil)
+	// Execute the command, reporting the bytes transferred from the output.
+	pctx := execute.WithOutputParser(ctx, func(line string) {
+		if n, ok := parseRsyncBytes(line); ok {
+			progress.Report(ctx, progress.Event{Kind: progress.Bytes, Bytes: n})
+		}
+	})
+	err = execute.RunCommand(pctx, "RSYNC", cmd, r.execute, nil, nil)
 	if err != nil {
 		// Rsync uses retcode 24 to indicate "some files disappeared during
-		// the transfer" which is immaterial for our purposes. Ignore those
-		// cases.
+		// the transfer" which is immaterial for most purposes. Ignore those
+		// cases, unless rsync_ignore_vanished is false.
 		rc := execute.ExitCode(err)
-		if rc == 24 {
+		if rc == rsyncVanished && r.config.Parsed.RsyncIgnoreVanished {
+			log.Verbosef(1, "Warning: Some files vanished during the transfer (ignored)\n")
 			err = nil
 		}
 	}
 	return err
 }
+
+// parseRsyncBytes returns the total number of bytes transferred (sent plus
+// received) from an rsync summary line, and true. If line is not a summary
+// line, it returns false.
+func parseRsyncBytes(line string) (int64, bool) {
+	m := rsyncSummary.FindStringSubmatch(line)
+	if m == nil {
+		return 0, false
+	}
+	var total int64
+	for _, v := range m[1:] {
+		n, err := strconv.ParseInt(strings.NewReplacer(",", "", ".", "").Replace(v), 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		total += n
+	}
+	return total, true
+}
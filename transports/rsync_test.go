@@ -7,10 +7,17 @@ package transports
 
 import (
 	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/marcopaganini/logger"
 	"github.com/marcopaganini/netbackup/config"
+	"github.com/marcopaganini/netbackup/execute"
 )
 
 const (
@@ -19,18 +26,29 @@ const (
 
 func TestRsync(t *testing.T) {
 	casetests := []struct {
-		name       string
-		sourceDir  string
-		sourceHost string
-		destDir    string
-		destHost   string
-		transport  string
-		logfile    string
-		expectCmds []string
-		include    []string
-		exclude    []string
-		dryRun     bool
-		wantError  bool
+		name          string
+		sourceDir     string
+		sourceHost    string
+		destDir       string
+		destHost      string
+		transport     string
+		logfile       string
+		expectCmds    []string
+		include       []string
+		exclude       []string
+		filters       []string
+		excludeCaches bool
+		maxFileSize   string
+		noSlash       bool
+		inplace       bool
+		sparse        bool
+		cvsExclude    bool
+		ignoreFile    string
+		bwSchedule    []string
+		extraArgs     []string
+		transportArgs []string
+		dryRun        bool
+		wantError     bool
 	}{
 		// Dry run: No command should be executed.
 		{
@@ -121,6 +139,98 @@ func TestRsync(t *testing.T) {
 			logfile:    "/dev/null",
 			expectCmds: []string{rsyncTestCmd + " --filter=merge [^ ]+ --delete-excluded /tmp/a/ /tmp/b"},
 		},
+		// Ordered filter rules.
+		{
+			name:       "fake",
+			sourceDir:  "/tmp/a",
+			destDir:    "/tmp/b",
+			filters:    []string{"+ x/foo", "- x/*", "+ y/bar"},
+			transport:  "rsync",
+			logfile:    "/dev/null",
+			expectCmds: []string{rsyncTestCmd + " --filter=merge [^ ]+ /tmp/a/ /tmp/b"},
+		},
+		// Cache directories are not searched in remote sources.
+		{
+			name:          "fake",
+			sourceHost:    "srchost",
+			sourceDir:     "/tmp/a",
+			destDir:       "/tmp/b",
+			excludeCaches: true,
+			transport:     "rsync",
+			logfile:       "/dev/null",
+			expectCmds:    []string{rsyncTestCmd + " srchost:/tmp/a/ /tmp/b"},
+		},
+		// No trailing slash added to the source.
+		{
+			name:       "fake",
+			sourceDir:  "/tmp/a",
+			destDir:    "/tmp/b",
+			noSlash:    true,
+			transport:  "rsync",
+			logfile:    "/dev/null",
+			expectCmds: []string{rsyncTestCmd + " /tmp/a /tmp/b"},
+		},
+		// In-place updates.
+		{
+			name:       "fake",
+			sourceDir:  "/tmp/a",
+			destDir:    "/tmp/b",
+			inplace:    true,
+			transport:  "rsync",
+			logfile:    "/dev/null",
+			expectCmds: []string{rsyncTestCmd + " --inplace /tmp/a/ /tmp/b"},
+		},
+		// Sparse files.
+		{
+			name:       "fake",
+			sourceDir:  "/tmp/a",
+			destDir:    "/tmp/b",
+			sparse:     true,
+			transport:  "rsync",
+			logfile:    "/dev/null",
+			expectCmds: []string{rsyncTestCmd + " --sparse /tmp/a/ /tmp/b"},
+		},
+		// CVS style exclusions.
+		{
+			name:       "fake",
+			sourceDir:  "/tmp/a",
+			destDir:    "/tmp/b",
+			cvsExclude: true,
+			transport:  "rsync",
+			logfile:    "/dev/null",
+			expectCmds: []string{rsyncTestCmd + " --cvs-exclude /tmp/a/ /tmp/b"},
+		},
+		// Per-directory filter files.
+		{
+			name:       "fake",
+			sourceDir:  "/tmp/a",
+			destDir:    "/tmp/b",
+			ignoreFile: ".rsync-filter",
+			transport:  "rsync",
+			logfile:    "/dev/null",
+			expectCmds: []string{rsyncTestCmd + " --filter=: .rsync-filter /tmp/a/ /tmp/b"},
+		},
+		// Bandwidth limit from the schedule (a single window covering the
+		// whole day.)
+		{
+			name:       "fake",
+			sourceDir:  "/tmp/a",
+			destDir:    "/tmp/b",
+			bwSchedule: []string{"00:00-00:00=2M"},
+			transport:  "rsync",
+			logfile:    "/dev/null",
+			expectCmds: []string{rsyncTestCmd + " --bwlimit=2M /tmp/a/ /tmp/b"},
+		},
+		// Maximum file size.
+		{
+			name:        "fake",
+			sourceDir:   "/tmp/a",
+			destDir:     "/tmp/b",
+			maxFileSize: "2G",
+			transport:   "rsync",
+			logfile:     "/dev/null",
+			expectCmds:  []string{rsyncTestCmd + " --max-size=2147483648 /tmp/a/ /tmp/b"},
+		},
 		// Test that an empty source dir results in error.
 		{
 			name:      "fake",
@@ -137,6 +247,17 @@ func TestRsync(t *testing.T) {
 			logfile:   "/dev/null",
 			wantError: true,
 		},
+		// Generic and transport specific arguments, in order.
+		{
+			name:          "fake",
+			sourceDir:     "/tmp/a",
+			destDir:       "/tmp/b",
+			extraArgs:     []string{"--generic"},
+			transportArgs: []string{"--specific1", "--specific2"},
+			transport:     "rsync",
+			logfile:       "/dev/null",
+			expectCmds:    []string{rsyncTestCmd + " --generic --specific1 --specific2 /tmp/a/ /tmp/b"},
+		},
 	}
 
 	for _, tt := range casetests {
@@ -155,7 +276,23 @@ func TestRsync(t *testing.T) {
 			Transport:  tt.transport,
 			Logfile:    tt.logfile,
 			Include:    tt.include,
+			ExtraArgs:  tt.extraArgs,
+			RsyncArgs:  tt.transportArgs,
 			Exclude:    tt.exclude,
+			Filters:    tt.filters,
+
+			ExcludeCaches: tt.excludeCaches,
+			MaxFileSize:   tt.maxFileSize,
+
+			RsyncNoTrailingSlash: tt.noSlash,
+			RsyncInplace:         tt.inplace,
+			RsyncSparse:          tt.sparse,
+			RsyncCvsExclude:      tt.cvsExclude,
+			RsyncIgnoreFile:      tt.ignoreFile,
+			BandwidthSchedule:    tt.bwSchedule,
+		}
+		if err := cfg.Normalize(); err != nil {
+			t.Fatalf("Normalize failed: %v", err)
 		}
 
 		// Create a new rsync object with our fakeExecute and a sinking outLogWriter.
@@ -189,3 +326,235 @@ func TestRsync(t *testing.T) {
 		}
 	}
 }
+
+// Test that the rsync filter file preserves the order of the rules.
+func TestRsyncFilterFile(t *testing.T) {
+	casetests := []struct {
+		include []string
+		exclude []string
+		filters []string
+		want    []string
+	}{
+		// Includes always come before excludes.
+		{
+			include: []string{"x/foo", "y/bar"},
+			exclude: []string{"x/*"},
+			want:    []string{"+ x/foo", "+ y/bar", "- x/*"},
+		},
+		// Filters are written verbatim, in order.
+		{
+			filters: []string{"+ x/foo", "- x/*", "+ y/bar", "- *"},
+			want:    []string{"+ x/foo", "- x/*", "+ y/bar", "- *"},
+		},
+	}
+
+	log := logger.New("")
+	ctx := context.Background()
+	ctx = logger.WithLogger(ctx, log)
+
+	for _, tt := range casetests {
+		cfg := &config.Config{
+			Name:      "fake",
+			SourceDir: "/tmp/a",
+			DestDir:   "/tmp/b",
+			Transport: "rsync",
+			Include:   tt.include,
+			Exclude:   tt.exclude,
+			Filters:   tt.filters,
+			TmpDir:    t.TempDir(),
+		}
+		rsync, err := NewRsyncTransport(cfg, NewFakeExecute(), false)
+		if err != nil {
+			t.Fatalf("NewRsyncTransport failed: %v", err)
+		}
+		fname, err := rsync.createFilterFile(ctx, cfg.Filters, cfg.Include, cfg.Exclude)
+		if err != nil {
+			t.Fatalf("createFilterFile failed: %v", err)
+		}
+		if filepath.Dir(fname) != cfg.TmpDir {
+			t.Errorf("filter file %q should be under %q", fname, cfg.TmpDir)
+		}
+		contents, err := ioutil.ReadFile(fname)
+		os.Remove(fname)
+		if err != nil {
+			t.Fatalf("Unable to read filter file %q: %v", fname, err)
+		}
+		want := strings.Join(tt.want, "\n") + "\n"
+		if string(contents) != want {
+			t.Errorf("filter file contents should be\n[%s]\n\nbut is\n\n[%s]", want, string(contents))
+		}
+	}
+}
+
+// Test parsing of the rsync transfer summary.
+func TestParseRsyncBytes(t *testing.T) {
+	casetests := []struct {
+		line   string
+		want   int64
+		wantOK bool
+	}{
+		{line: "sent 1,000 bytes  received 24 bytes  2,048.00 bytes/sec", want: 1024, wantOK: true},
+		{line: "sent 95 bytes  received 12 bytes  214.00 bytes/sec", want: 107, wantOK: true},
+		{line: "total size is 1,234  speedup is 11.53", wantOK: false},
+		{line: "foo/bar", wantOK: false},
+	}
+	for _, tt := range casetests {
+		got, ok := parseRsyncBytes(tt.line)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseRsyncBytes(%q): got (%d, %v), want (%d, %v)", tt.line, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+// Test that directories tagged with a valid CACHEDIR.TAG are excluded.
+func TestRsyncExcludeCaches(t *testing.T) {
+	src := t.TempDir()
+	tags := map[string]string{
+		"cache":         cacheDirSignature + "\n# This is a cache directory\n",
+		"a/b/cache":     cacheDirSignature,
+		"notcache":      "Not a valid signature",
+		"cache/subdir":  cacheDirSignature,
+		"nocache/other": "",
+	}
+	for dir, contents := range tags {
+		path := filepath.Join(src, dir)
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatalf("error creating directory: %v", err)
+		}
+		if contents == "" {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(path, cacheDirTag), []byte(contents), 0644); err != nil {
+			t.Fatalf("error creating tag file: %v", err)
+		}
+	}
+
+	log := logger.New("")
+	ctx := logger.WithLogger(context.Background(), log)
+
+	cfg := &config.Config{
+		Name:          "fake",
+		SourceDir:     src,
+		DestDir:       "/tmp/b",
+		Transport:     "rsync",
+		ExcludeCaches: true,
+		TmpDir:        t.TempDir(),
+	}
+	fakeExecute := NewFakeExecute()
+	rsync, err := NewRsyncTransport(cfg, fakeExecute, false)
+	if err != nil {
+		t.Fatalf("NewRsyncTransport failed: %v", err)
+	}
+
+	got, err := rsync.cacheDirExcludes(ctx)
+	if err != nil {
+		t.Fatalf("cacheDirExcludes failed: %v", err)
+	}
+	want := []string{"/a/b/cache/", "/cache/"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("cacheDirExcludes: got %q, want %q", got, want)
+	}
+
+	// Cache excludes come before the include and exclude rules.
+	cfg.Include = []string{"/cache/keep"}
+	cfg.Exclude = []string{"*.tmp"}
+	filterExecute := &filterFileExecute{FakeExecute: fakeExecute}
+	rsync, err = NewRsyncTransport(cfg, filterExecute, false)
+	if err != nil {
+		t.Fatalf("NewRsyncTransport failed: %v", err)
+	}
+	if err := rsync.Run(ctx); err != nil {
+		t.Fatalf("rsync.Run failed: %v", err)
+	}
+	expectCmds := []string{rsyncTestCmd + " --filter=merge [^ ]+ --delete-excluded " + src + "/ /tmp/b"}
+	match, err := reMatch(expectCmds, fakeExecute.Cmds())
+	if err != nil {
+		t.Fatalf("Error on regexp match: %v", err)
+	}
+	if !match {
+		t.Errorf("command diff: Got %v, want %v", fakeExecute.Cmds(), expectCmds)
+	}
+	wantFilter := "- /a/b/cache/\n- /cache/\n+ /cache/keep\n- *.tmp\n"
+	if filterExecute.contents != wantFilter {
+		t.Errorf("filter file contents should be\n[%s]\n\nbut is\n\n[%s]", wantFilter, filterExecute.contents)
+	}
+
+	// Dry-run mode does not search for cache directories.
+	rsync, err = NewRsyncTransport(cfg, NewFakeExecute(), true)
+	if err != nil {
+		t.Fatalf("NewRsyncTransport failed: %v", err)
+	}
+	got, err = rsync.cacheDirExcludes(ctx)
+	if err != nil {
+		t.Fatalf("cacheDirExcludes failed: %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("cacheDirExcludes in dry-run mode: got %q, want none", got)
+	}
+}
+
+// filterFileExecute is a FakeExecute that saves the contents of the rsync
+// filter file, which is removed when Run returns.
+type filterFileExecute struct {
+	*FakeExecute
+	contents string
+}
+
+func (f *filterFileExecute) Exec(ctx context.Context, a []string) error {
+	for _, v := range a {
+		if strings.HasPrefix(v, "--filter=merge ") {
+			buf, err := ioutil.ReadFile(strings.TrimPrefix(v, "--filter=merge "))
+			if err != nil {
+				return err
+			}
+			f.contents = string(buf)
+		}
+	}
+	return f.FakeExecute.Exec(ctx, a)
+}
+
+// Test that rsync's "vanished files" exit code is ignored, unless
+// rsync_ignore_vanished is false.
+func TestRsyncIgnoreVanished(t *testing.T) {
+	// Real exit errors, with the exit codes set.
+	vanished := exec.Command("sh", "-c", "exit 24").Run()
+	other := exec.Command("sh", "-c", "exit 23").Run()
+
+	yes, no := true, false
+	casetests := []struct {
+		ignoreVanished *bool
+		exitErr        error
+		wantError      bool
+	}{
+		{ignoreVanished: nil, exitErr: vanished},
+		{ignoreVanished: &yes, exitErr: vanished},
+		{ignoreVanished: &no, exitErr: vanished, wantError: true},
+		{ignoreVanished: nil, exitErr: other, wantError: true},
+	}
+	for _, tt := range casetests {
+		log := logger.New("")
+		ctx := logger.WithLogger(context.Background(), log)
+
+		cfg := &config.Config{
+			Name:                "fake",
+			SourceDir:           "/tmp/a",
+			DestDir:             "/tmp/b",
+			Transport:           "rsync",
+			RsyncIgnoreVanished: tt.ignoreVanished,
+		}
+		if err := cfg.Normalize(); err != nil {
+			t.Fatalf("Normalize failed: %v", err)
+		}
+		fakeExecute := NewFakeExecute()
+		fakeExecute.FailOn("rsync")
+		fakeExecute.FailWith(tt.exitErr)
+		rsync, err := NewRsyncTransport(cfg, fakeExecute, false)
+		if err != nil {
+			t.Fatalf("NewRsyncTransport failed: %v", err)
+		}
+		err = rsync.Run(ctx)
+		if tt.wantError != (err != nil) {
+			t.Errorf("ignore_vanished=%v, exit code %d: got error %v, want error: %v", cfg.Parsed.RsyncIgnoreVanished, execute.ExitCode(tt.exitErr), err, tt.wantError)
+		}
+	}
+}
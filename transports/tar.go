@@ -0,0 +1,188 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package transports
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/marcopaganini/logger"
+	"github.com/marcopaganini/netbackup/clock"
+	"github.com/marcopaganini/netbackup/config"
+	"github.com/marcopaganini/netbackup/execute"
+)
+
+const (
+	tarCmd = "tar"
+
+	// Default time layout for archive names.
+	tarDateFormat = "20060102-150405"
+)
+
+// tarCompressor describes how tar compresses the archive.
+type tarCompressor struct {
+	// Compression program (must be in the PATH.)
+	bin string
+	// Tar command-line flag.
+	flag string
+	// Archive file extension.
+	ext string
+}
+
+// tarCompressors maps the values of compression to their compressors.
+var tarCompressors = map[string]tarCompressor{
+	"none": {ext: ".tar"},
+	"gzip": {bin: "gzip", flag: "-z", ext: ".tar.gz"},
+	"zstd": {bin: "zstd", flag: "--zstd", ext: ".tar.zst"},
+	"xz":   {bin: "xz", flag: "-J", ext: ".tar.xz"},
+}
+
+// lookPath searches for an executable in the PATH (overridden by tests.)
+var lookPath = exec.LookPath
+
+// TarTransport is the main structure for the tar transport.
+type TarTransport struct {
+	Transport
+}
+
+func init() {
+	Register("tar", func(cfg *config.Config, ex execute.Executor, dryRun bool) (Runner, error) {
+		t, err := NewTarTransport(cfg, ex, dryRun)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	})
+}
+
+// NewTarTransport creates a new Transport object for tar.
+func NewTarTransport(config *config.Config, ex execute.Executor, dryRun bool) (*TarTransport, error) {
+	t := &TarTransport{}
+	t.config = config
+	t.dryRun = dryRun
+
+	// If execute object is nil, create a new one
+	t.execute = ex
+	if t.execute == nil {
+		t.execute = execute.New()
+	}
+
+	// Basic config checking
+	if err := t.checkConfig(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// checkConfig performs tar specific checks in the configuration. The
+// compression program must be installed.
+func (t *TarTransport) checkConfig() error {
+	switch {
+	case t.config.SourceDir == "":
+		return fmt.Errorf("Config error: SourceDir is empty")
+	case t.config.DestDir == "":
+		return fmt.Errorf("Config error: DestDir is empty")
+	case t.config.SourceHost != "" || t.config.DestHost != "":
+		return fmt.Errorf("Config error: source_host and dest_host are not supported by the tar transport")
+	case len(t.config.Filters) != 0 || len(t.config.Include) != 0:
+		return fmt.Errorf("Config error: filters and include are not supported by the tar transport")
+	}
+	c, err := t.compressor()
+	if err != nil {
+		return err
+	}
+	if c.bin != "" {
+		if _, err := lookPath(c.bin); err != nil {
+			return fmt.Errorf("Config error: compression %q requires %s: %v", t.config.Compression, c.bin, err)
+		}
+	}
+	return t.checkCustomBin()
+}
+
+// compressor returns the compressor for the compression in the configuration
+// (none, if not set.)
+func (t *TarTransport) compressor() (tarCompressor, error) {
+	name := t.config.Compression
+	if name == "" {
+		name = "none"
+	}
+	c, ok := tarCompressors[name]
+	if !ok {
+		return tarCompressor{}, fmt.Errorf("Config error: unknown compression %q", t.config.Compression)
+	}
+	return c, nil
+}
+
+// archiveName returns the full path of the archive created by this run, under
+// the destination directory. The name contains the backup name and the
+// current time (according to the clock in ctx), formatted with
+// log_date_format, if set.
+func (t *TarTransport) archiveName(ctx context.Context, c tarCompressor) string {
+	layout := tarDateFormat
+	if t.config.LogDateFormat != "" {
+		layout = t.config.LogDateFormat
+	}
+	ts := clock.ClockValue(ctx).Now().Format(layout)
+	return filepath.Join(t.config.DestDir, t.config.Name+"-"+ts+c.ext)
+}
+
+// Run creates a new archive with the contents of the source directory under
+// the destination directory, using the compression in the configuration. A
+// temporary file with the exclusion patterns is generated, if needed, and
+// removed at the end of execution. If dryRun is set, just output the command
+// to be executed.
+func (t *TarTransport) Run(ctx context.Context) error {
+	log := logger.LoggerValue(ctx)
+
+	c, err := t.compressor()
+	if err != nil {
+		return err
+	}
+
+	cmd := []string{tarCmd}
+	if t.config.CustomBin != "" {
+		cmd = strings.Split(t.config.CustomBin, " ")
+	}
+	archive := t.archiveName(ctx, c)
+	cmd = append(cmd, "--create", "--file="+archive)
+	if c.flag != "" {
+		cmd = append(cmd, c.flag)
+	}
+
+	// Create exclude file list, if needed.
+	if len(t.config.Exclude) != 0 {
+		excludeFile, err := writeList(ctx, t.config.TmpDir, "exclude", t.config.Exclude)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(excludeFile)
+		cmd = append(cmd, "--exclude-from="+excludeFile)
+	}
+	if t.config.ExcludeCaches {
+		cmd = append(cmd, "--exclude-caches")
+	}
+	warnDuplicateFlags(ctx, t.config.ExtraArgs, append([]string{"--directory"}, cmd...))
+	cmd = append(cmd, t.config.ExtraArgs...)
+	cmd = append(cmd, "--directory="+t.config.SourceDir, ".")
+
+	t.logDestination(ctx, archive)
+	log.Verbosef(1, "Command: %s\n", strings.Join(execute.Redact(ctx, cmd), " "))
+	if err := execute.RecordCommand(ctx, cmd); err != nil {
+		return err
+	}
+	if t.dryRun {
+		return nil
+	}
+	// Never overwrite an existing archive.
+	if _, err := os.Lstat(archive); !os.IsNotExist(err) {
+		return fmt.Errorf("archive %q already exists", archive)
+	}
+	return execute.RunCommand(ctx, "TAR", cmd, t.execute, nil, nil)
+}
@@ -0,0 +1,160 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package transports
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/marcopaganini/logger"
+	"github.com/marcopaganini/netbackup/clock"
+	"github.com/marcopaganini/netbackup/config"
+)
+
+func TestTar(t *testing.T) {
+	casetests := []struct {
+		compression string
+		dateFormat  string
+		exclude     []string
+		installed   []string
+		expectCmds  []string
+		wantError   bool
+	}{
+		// No compression.
+		{
+			expectCmds: []string{"tar --create --file=/tmp/b/fake-20240301-020304.tar --directory=/tmp/a ."},
+		},
+		{
+			compression: "none",
+			expectCmds:  []string{"tar --create --file=/tmp/b/fake-20240301-020304.tar --directory=/tmp/a ."},
+		},
+		// Compressors: flag and extension.
+		{
+			compression: "gzip",
+			installed:   []string{"gzip"},
+			expectCmds:  []string{"tar --create --file=/tmp/b/fake-20240301-020304.tar.gz -z --directory=/tmp/a ."},
+		},
+		{
+			compression: "zstd",
+			installed:   []string{"zstd"},
+			expectCmds:  []string{"tar --create --file=/tmp/b/fake-20240301-020304.tar.zst --zstd --directory=/tmp/a ."},
+		},
+		{
+			compression: "xz",
+			installed:   []string{"xz"},
+			expectCmds:  []string{"tar --create --file=/tmp/b/fake-20240301-020304.tar.xz -J --directory=/tmp/a ."},
+		},
+		// Exclude list.
+		{
+			compression: "gzip",
+			exclude:     []string{"x/foo", "*.o"},
+			installed:   []string{"gzip"},
+			expectCmds:  []string{"tar --create --file=/tmp/b/fake-20240301-020304.tar.gz -z --exclude-from=[^ ]+ --directory=/tmp/a ."},
+		},
+		// Archive names use the log date format, if set.
+		{
+			dateFormat: "2006-01-02_15h",
+			expectCmds: []string{"tar --create --file=/tmp/b/fake-2024-03-01_02h.tar --directory=/tmp/a ."},
+		},
+		// Compressor not installed.
+		{
+			compression: "zstd",
+			installed:   []string{"gzip", "xz"},
+			wantError:   true,
+		},
+		// Unknown compressor.
+		{
+			compression: "bzip2",
+			installed:   []string{"bzip2"},
+			wantError:   true,
+		},
+	}
+
+	savedLookPath := lookPath
+	defer func() { lookPath = savedLookPath }()
+
+	for _, tt := range casetests {
+		fakeExecute := NewFakeExecute()
+
+		log := logger.New("")
+		ctx := logger.WithLogger(context.Background(), log)
+		ctx = clock.WithClock(ctx, clock.NewFake(time.Date(2024, 3, 1, 2, 3, 4, 0, time.Local)))
+
+		installed := tt.installed
+		lookPath = func(file string) (string, error) {
+			for _, bin := range installed {
+				if bin == file {
+					return "/usr/bin/" + file, nil
+				}
+			}
+			return "", fmt.Errorf("%s: executable file not found in $PATH", file)
+		}
+
+		cfg := &config.Config{
+			Name:          "fake",
+			SourceDir:     "/tmp/a",
+			DestDir:       "/tmp/b",
+			Transport:     "tar",
+			Exclude:       tt.exclude,
+			Compression:   tt.compression,
+			LogDateFormat: tt.dateFormat,
+		}
+		tar, err := NewTarTransport(cfg, fakeExecute, false)
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("compression=%q: got no error, want error", tt.compression)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("compression=%q: NewTarTransport failed: %v", tt.compression, err)
+		}
+		if err := tar.Run(ctx); err != nil {
+			t.Fatalf("compression=%q: tar.Run failed: %v", tt.compression, err)
+		}
+		match, err := reMatch(tt.expectCmds, fakeExecute.Cmds())
+		if err != nil {
+			t.Fatalf("Error on regexp match: %v", err)
+		}
+		if !match {
+			t.Errorf("compression=%q: command diff: Got %v, want %v", tt.compression, fakeExecute.Cmds(), tt.expectCmds)
+		}
+	}
+}
+
+// Test that tar refuses to overwrite an existing archive.
+func TestTarExistingArchive(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "fake-20240301-020304.tar"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	log := logger.New("")
+	ctx := logger.WithLogger(context.Background(), log)
+	ctx = clock.WithClock(ctx, clock.NewFake(time.Date(2024, 3, 1, 2, 3, 4, 0, time.Local)))
+
+	cfg := &config.Config{
+		Name:      "fake",
+		SourceDir: "/tmp/a",
+		DestDir:   dir,
+		Transport: "tar",
+	}
+	fakeExecute := NewFakeExecute()
+	tar, err := NewTarTransport(cfg, fakeExecute, false)
+	if err != nil {
+		t.Fatalf("NewTarTransport failed: %v", err)
+	}
+	if err := tar.Run(ctx); err == nil {
+		t.Errorf("tar.Run with an existing archive: got no error, want error")
+	}
+	if len(fakeExecute.Cmds()) != 0 {
+		t.Errorf("tar.Run with an existing archive: got commands %v, want none", fakeExecute.Cmds())
+	}
+}
@@ -0,0 +1,93 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package transports
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/marcopaganini/logger"
+	"github.com/marcopaganini/netbackup/config"
+	"github.com/marcopaganini/netbackup/execute"
+	"github.com/marcopaganini/netbackup/progress"
+)
+
+// Bytes "transferred" by the test transport on every progress line.
+const testProgressBytes = 1 << 20
+
+// TestTransport is a transport that copies no data. It waits for test_sleep,
+// optionally printing fake progress lines, and fails if test_exit_code is not
+// zero. It is meant to test the rest of the backup (devices, hooks, metrics)
+// in CI and integration tests.
+type TestTransport struct {
+	Transport
+}
+
+func init() {
+	Register("test", func(cfg *config.Config, ex execute.Executor, dryRun bool) (Runner, error) {
+		t, err := NewTestTransport(cfg, ex, dryRun)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	})
+}
+
+// NewTestTransport creates a new Transport object for the test transport.
+// Configuration files can only use it if enabled in config.ParseOptions.
+func NewTestTransport(config *config.Config, ex execute.Executor, dryRun bool) (*TestTransport, error) {
+	t := &TestTransport{}
+	t.config = config
+	t.dryRun = dryRun
+
+	// If execute object is nil, create a new one
+	t.execute = ex
+	if t.execute == nil {
+		t.execute = execute.New()
+	}
+	return t, nil
+}
+
+// Run waits for test_sleep (or until ctx is done), printing test_progress_lines
+// fake progress lines at regular intervals, and returns an error if
+// test_exit_code is not zero. In dry-run mode, it returns immediately.
+func (t *TestTransport) Run(ctx context.Context) error {
+	log := logger.LoggerValue(ctx)
+
+	sleep := t.config.Parsed.TestSleep
+	lines := t.config.TestProgressLines
+	code := t.config.TestExitCode
+
+	log.Verbosef(1, "Test transport: sleep %v, %d progress line(s), exit code %d\n", sleep, lines, code)
+	if t.dryRun {
+		return nil
+	}
+
+	steps := lines
+	if steps == 0 {
+		steps = 1
+	}
+	for i := 1; i <= steps; i++ {
+		timer := time.NewTimer(sleep / time.Duration(steps))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		if i <= lines {
+			n := int64(i) * testProgressBytes
+			log.Printf("TEST: %d bytes transferred (%d/%d)\n", n, i, lines)
+			progress.Report(ctx, progress.Event{Kind: progress.Bytes, Bytes: n})
+		}
+	}
+
+	if code != 0 {
+		return fmt.Errorf("test transport exited with status %d", code)
+	}
+	return nil
+}
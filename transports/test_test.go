@@ -0,0 +1,81 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package transports
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/marcopaganini/logger"
+	"github.com/marcopaganini/netbackup/config"
+	"github.com/marcopaganini/netbackup/progress"
+)
+
+func TestTestTransport(t *testing.T) {
+	casetests := []struct {
+		sleep     string
+		lines     int
+		exitCode  int
+		dryRun    bool
+		wantBytes []int64
+		wantError string
+	}{
+		// Success, with and without progress lines.
+		{},
+		{sleep: "30ms", lines: 3, wantBytes: []int64{testProgressBytes, 2 * testProgressBytes, 3 * testProgressBytes}},
+		// Configurable exit code.
+		{sleep: "10ms", exitCode: 3, wantError: "exited with status 3"},
+		{lines: 1, exitCode: 24, wantBytes: []int64{testProgressBytes}, wantError: "exited with status 24"},
+		// Nothing happens in dry-run mode.
+		{sleep: "1h", lines: 2, exitCode: 1, dryRun: true},
+	}
+
+	for _, tt := range casetests {
+		log := logger.New("")
+		ctx := logger.WithLogger(context.Background(), log)
+		var gotBytes []int64
+		ctx = progress.WithFunc(ctx, func(ev progress.Event) {
+			if ev.Kind == progress.Bytes {
+				gotBytes = append(gotBytes, ev.Bytes)
+			}
+		})
+
+		cfg := &config.Config{
+			Name:              "fake",
+			SourceDir:         "/tmp/a",
+			DestDir:           "/tmp/b",
+			Transport:         "test",
+			TestSleep:         tt.sleep,
+			TestProgressLines: tt.lines,
+			TestExitCode:      tt.exitCode,
+		}
+		if err := cfg.Normalize(); err != nil {
+			t.Fatalf("Normalize failed: %v", err)
+		}
+
+		fakeExecute := NewFakeExecute()
+		tr, err := NewTestTransport(cfg, fakeExecute, tt.dryRun)
+		if err != nil {
+			t.Fatalf("NewTestTransport failed: %v", err)
+		}
+
+		err = tr.Run(ctx)
+		switch {
+		case tt.wantError == "" && err != nil:
+			t.Errorf("exitCode=%d: got error %v, want no error", tt.exitCode, err)
+		case tt.wantError != "" && (err == nil || !strings.Contains(err.Error(), tt.wantError)):
+			t.Errorf("exitCode=%d: got error %v, want %q", tt.exitCode, err, tt.wantError)
+		}
+		if !reflect.DeepEqual(gotBytes, tt.wantBytes) {
+			t.Errorf("lines=%d: got progress %v, want %v", tt.lines, gotBytes, tt.wantBytes)
+		}
+		if len(fakeExecute.Cmds()) != 0 {
+			t.Errorf("got commands %q, want none", fakeExecute.Cmds())
+		}
+	}
+}
@@ -9,14 +9,28 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/marcopaganini/logger"
+	"github.com/marcopaganini/netbackup/clock"
 	"github.com/marcopaganini/netbackup/config"
 	"github.com/marcopaganini/netbackup/execute"
 )
 
+const (
+	// cacheDirTag is the name of the file marking cache directories, as
+	// defined in https://bford.info/cachedir/
+	cacheDirTag = "CACHEDIR.TAG"
+	// cacheDirSignature is the mandatory header of cacheDirTag.
+	cacheDirSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+)
+
 // Transport represents all transports
 type Transport struct {
 	config  *config.Config
@@ -24,21 +38,29 @@ type Transport struct {
 	dryRun  bool
 }
 
-// writeList writes the desired list of exclusions/inclusions into a file, in a
-// format suitable for this transport. The caller is responsible for deleting
-// the file after use. Returns the name of the file and error.
-func writeList(ctx context.Context, prefix string, patterns []string) (string, error) {
+// writeList writes the desired list of exclusions/inclusions into a file
+// under tmpdir, in a format suitable for this transport. If tmpdir is empty,
+// the default system temporary directory is used. The caller is responsible
+// for deleting the file after use. Returns the name of the file and error.
+func writeList(ctx context.Context, tmpdir string, prefix string, patterns []string) (string, error) {
 	var w *os.File
 	var err error
 	log := logger.LoggerValue(ctx)
 
-	if w, err = ioutil.TempFile("/tmp", prefix); err != nil {
+	if w, err = ioutil.TempFile(tmpdir, prefix); err != nil {
 		return "", fmt.Errorf("Error creating pattern file for %s list: %v", prefix, err)
 	}
 	defer w.Close()
 	for _, v := range patterns {
 		fmt.Fprintln(w, v)
 	}
+	// The transport may run as a different user (run_as_user).
+	if cred := execute.CredentialValue(ctx); cred != nil {
+		if err := w.Chown(int(cred.Uid), int(cred.Gid)); err != nil {
+			os.Remove(w.Name())
+			return "", fmt.Errorf("Error changing owner of %s list: %v", prefix, err)
+		}
+	}
 
 	log.Verbosef(3, "Contents of %q file:\n", prefix)
 	displayFile(ctx, w.Name())
@@ -70,27 +92,48 @@ func (t *Transport) checkConfig() error {
 	case t.config.DestDir == "":
 		return fmt.Errorf("Config error: DestDir is empty")
 	}
+	return t.checkCustomBin()
+}
+
+// checkCustomBin makes sure the first token of custom_bin (if set) resolves
+// to an executable file. The check is skipped in dry-run mode, since the
+// binary may not be present on the machine generating the command-line.
+func (t *Transport) checkCustomBin() error {
+	if t.config.CustomBin == "" || t.dryRun {
+		return nil
+	}
+	bin := strings.Fields(t.config.CustomBin)
+	if len(bin) == 0 {
+		return fmt.Errorf("Config error: custom_bin is blank")
+	}
+	if _, err := exec.LookPath(bin[0]); err != nil {
+		return fmt.Errorf("Config error: custom_bin %q is not an executable: %v", bin[0], err)
+	}
 	return nil
 }
 
-// createFilterFile creates a filter file, in the rsync/rclone style, with the
-// include and exclude patterns and returns the filename.
-func (t *Transport) createFilterFile(ctx context.Context, include, exclude []string) (string, error) {
+// createFilterFile creates a filter file, in the rsync/rclone style, and
+// returns the filename. If filters is set, its rules are written verbatim (in
+// order). Otherwise, the file contains the include patterns followed by the
+// exclude patterns.
+func (t *Transport) createFilterFile(ctx context.Context, filters, include, exclude []string) (string, error) {
 	log := logger.LoggerValue(ctx)
 
-	if len(include) == 0 && len(exclude) == 0 {
+	if len(filters) == 0 && len(include) == 0 && len(exclude) == 0 {
 		return "", nil
 	}
 	// Create filter list.
-	var filter []string
-	for _, v := range include {
-		filter = append(filter, "+ "+v)
-	}
-	for _, v := range exclude {
-		filter = append(filter, "- "+v)
+	filter := filters
+	if len(filter) == 0 {
+		for _, v := range include {
+			filter = append(filter, "+ "+v)
+		}
+		for _, v := range exclude {
+			filter = append(filter, "- "+v)
+		}
 	}
 
-	fname, err := writeList(ctx, "filter", filter)
+	fname, err := writeList(ctx, t.config.TmpDir, "filter", filter)
 	if err != nil {
 		return "", err
 	}
@@ -102,6 +145,130 @@ func (t *Transport) createFilterFile(ctx context.Context, include, exclude []str
 	return fname, nil
 }
 
+// cacheDirExcludes returns exclude patterns (relative to the source
+// directory) for all directories under the source containing a valid cache
+// directory tag. The search does not cross filesystem boundaries and is
+// skipped in dry-run mode. Remote sources cannot be searched, so
+// exclude_caches is ignored (with a warning) for them.
+func (t *Transport) cacheDirExcludes(ctx context.Context) ([]string, error) {
+	log := logger.LoggerValue(ctx)
+
+	if t.config.SourceHost != "" {
+		log.Verbosef(1, "Warning: exclude_caches is not supported with remote sources by this transport (ignored)\n")
+		return nil, nil
+	}
+	if t.dryRun {
+		log.Verbosef(1, "Dry-run mode: not searching for cache directories\n")
+		return nil, nil
+	}
+
+	var excludes []string
+	root := t.config.SourceDir
+	rootfi, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("error searching for cache directories: %v", err)
+	}
+	rootDev := deviceID(rootfi)
+
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// Unreadable files are the transport's problem.
+			return nil
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		// Don't descend into other filesystems (mount points).
+		if deviceID(fi) != rootDev {
+			return filepath.SkipDir
+		}
+		if !isCacheDir(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		excludes = append(excludes, "/"+filepath.ToSlash(rel)+"/")
+		log.Verbosef(2, "Excluding cache directory: %s\n", path)
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error searching for cache directories: %v", err)
+	}
+	return excludes, nil
+}
+
+// deviceID returns the ID of the device containing the file described by fi.
+func deviceID(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev)
+	}
+	return 0
+}
+
+// isCacheDir returns true if dir contains a valid cache directory tag.
+func isCacheDir(dir string) bool {
+	f, err := os.Open(filepath.Join(dir, cacheDirTag))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	buf := make([]byte, len(cacheDirSignature))
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return false
+	}
+	return string(buf) == cacheDirSignature
+}
+
+// bwLimit returns the bandwidth limit in effect at the current time
+// (according to the clock in ctx) from bandwidth_schedule, or an empty string
+// if no limit applies.
+func (t *Transport) bwLimit(ctx context.Context) (string, error) {
+	schedule, err := config.ParseBandwidthSchedule(t.config.BandwidthSchedule)
+	if err != nil {
+		return "", err
+	}
+	return config.BandwidthLimit(schedule, clock.ClockValue(ctx).Now()), nil
+}
+
+// extraArgs returns the generic extra_args followed by the transport
+// specific arguments in args.
+func (t *Transport) extraArgs(args []string) []string {
+	ret := append([]string{}, t.config.ExtraArgs...)
+	return append(ret, args...)
+}
+
+// warnDuplicateFlags logs a warning for each flag in args (the extra
+// arguments from the configuration) already present in managed (the flags
+// set by the transport itself.) Only flag names are compared ("--foo=bar" is
+// "--foo"). The duplicates are still passed to the transport.
+func warnDuplicateFlags(ctx context.Context, args []string, managed []string) {
+	log := logger.LoggerValue(ctx)
+
+	flags := map[string]bool{}
+	for _, m := range managed {
+		if f := flagName(m); f != "" {
+			flags[f] = true
+		}
+	}
+	for _, a := range args {
+		if f := flagName(a); f != "" && flags[f] {
+			log.Verbosef(1, "Warning: extra argument %s duplicates a flag already set by netbackup\n", f)
+		}
+	}
+}
+
+// flagName returns the name of the flag in arg (without any "=value"), or an
+// empty string if arg is not a flag.
+func flagName(arg string) string {
+	if !strings.HasPrefix(arg, "-") || arg == "-" || arg == "--" {
+		return ""
+	}
+	return strings.SplitN(arg, "=", 2)[0]
+}
+
 // buildSource creates the backup source based on the source host and path.
 // The default is [sourcehost<separator>]sourcepath. The default separator
 // is ":".
@@ -124,6 +291,15 @@ func (t *Transport) buildDest(separator string) string {
 	return dst
 }
 
+// logDestination logs the fully resolved destination (including the host
+// prefix, if any) in dry-run mode, where it would otherwise be buried in the
+// command line.
+func (t *Transport) logDestination(ctx context.Context, dest string) {
+	if t.dryRun {
+		logger.LoggerValue(ctx).Printf("Destination: %s\n", execute.Redact(ctx, []string{dest})[0])
+	}
+}
+
 // Run forms the command name and executes it, saving the output to the log
 // file requested in the configuration or a default one if none is specified.
 // Temporary files with exclusion and inclusion paths are generated, if needed,
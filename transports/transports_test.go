@@ -6,14 +6,20 @@
 package transports
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/marcopaganini/logger"
+	"github.com/marcopaganini/netbackup/clock"
+	"github.com/marcopaganini/netbackup/config"
 	"github.com/marcopaganini/netbackup/execute"
 )
 
@@ -23,7 +29,9 @@ import (
 // FakeExecute is a fake implementation of execute.Execute that saves the executed
 // commands for later inspection by the caller.
 type FakeExecute struct {
-	cmds []string
+	cmds     []string
+	failCmds []string
+	failErr  error
 }
 
 func NewFakeExecute() *FakeExecute {
@@ -36,12 +44,35 @@ func (f *FakeExecute) SetStdout(execute.CallbackFunc) {
 func (f *FakeExecute) SetStderr(execute.CallbackFunc) {
 }
 
+func (f *FakeExecute) SetEnv([]string) {
+}
+
 func (f *FakeExecute) Cmds() []string {
 	return f.cmds
 }
 
-func (f *FakeExecute) Exec(a []string) error {
-	f.cmds = append(f.cmds, strings.Join(a, " "))
+// FailOn causes Exec to return an error for commands containing any of the
+// given substrings.
+func (f *FakeExecute) FailOn(s ...string) {
+	f.failCmds = append(f.failCmds, s...)
+}
+
+// FailWith sets the error returned by Exec for the commands in FailOn.
+func (f *FakeExecute) FailWith(err error) {
+	f.failErr = err
+}
+
+func (f *FakeExecute) Exec(ctx context.Context, a []string) error {
+	cmd := strings.Join(a, " ")
+	f.cmds = append(f.cmds, cmd)
+	for _, v := range f.failCmds {
+		if strings.Contains(cmd, v) {
+			if f.failErr != nil {
+				return f.failErr
+			}
+			return fmt.Errorf("fake error running %q", cmd)
+		}
+	}
 	return nil
 }
 
@@ -52,7 +83,7 @@ func TestWriteList(t *testing.T) {
 	ctx = logger.WithLogger(ctx, log)
 
 	items := []string{"aa", "aa/01", "aa/02", "bb"}
-	fname, err := writeList(ctx, "fakename", items)
+	fname, err := writeList(ctx, "", "fakename", items)
 	if err != nil {
 		t.Fatalf("writeList failed: %v", err)
 	}
@@ -67,6 +98,225 @@ func TestWriteList(t *testing.T) {
 	}
 }
 
+// Test that writeList creates files under the requested directory.
+func TestWriteListTmpDir(t *testing.T) {
+	log := logger.New("")
+	ctx := context.Background()
+	ctx = logger.WithLogger(ctx, log)
+
+	tmpdir := t.TempDir()
+	fname, err := writeList(ctx, tmpdir, "fakename", []string{"aa"})
+	if err != nil {
+		t.Fatalf("writeList failed: %v", err)
+	}
+	defer os.Remove(fname)
+	if filepath.Dir(fname) != tmpdir {
+		t.Errorf("writeList created %q, want file under %q", fname, tmpdir)
+	}
+}
+
+// Test that custom_bin is validated by all transports.
+func TestCheckCustomBin(t *testing.T) {
+	casetests := []struct {
+		customBin string
+		dryRun    bool
+		wantError bool
+	}{
+		// Bogus binary should fail.
+		{customBin: "/nonexistent/bogus_binary --foo", wantError: true},
+		// Bogus binary in dry-run mode is not checked.
+		{customBin: "/nonexistent/bogus_binary --foo", dryRun: true},
+		// Valid binary (with arguments).
+		{customBin: "sh -c true"},
+		// No custom binary.
+		{},
+	}
+
+	newFuncs := map[string]func(*config.Config, bool) error{
+		"rclone": func(c *config.Config, d bool) error {
+			_, err := NewRcloneTransport(c, NewFakeExecute(), d)
+			return err
+		},
+		"rdiff-backup": func(c *config.Config, d bool) error {
+			_, err := NewRdiffBackupTransport(c, NewFakeExecute(), d)
+			return err
+		},
+		"restic": func(c *config.Config, d bool) error {
+			_, err := NewResticTransport(c, NewFakeExecute(), d)
+			return err
+		},
+		"rsync": func(c *config.Config, d bool) error {
+			_, err := NewRsyncTransport(c, NewFakeExecute(), d)
+			return err
+		},
+	}
+
+	for transport, newFunc := range newFuncs {
+		for _, tt := range casetests {
+			cfg := &config.Config{
+				Name:      "fake",
+				SourceDir: "/tmp/a",
+				DestDir:   "/tmp/b",
+				Transport: transport,
+				CustomBin: tt.customBin,
+			}
+			err := newFunc(cfg, tt.dryRun)
+			if tt.wantError {
+				if err == nil {
+					t.Errorf("%s: custom_bin %q: got no error, want error", transport, tt.customBin)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s: custom_bin %q: got error %q, want no error", transport, tt.customBin, err)
+			}
+		}
+	}
+}
+
+// Test that sensitive arguments are redacted in the logs, but passed intact
+// to the executed command.
+func TestRedactedCommand(t *testing.T) {
+	var buf bytes.Buffer
+	log := logger.New("")
+	log.SetVerboseLevel(1)
+	log.SetMirrorOutput(&buf)
+	ctx := logger.WithLogger(context.Background(), log)
+	ctx, err := execute.WithRedactPatterns(ctx, []string{`secret[0-9]+`})
+	if err != nil {
+		t.Fatalf("WithRedactPatterns failed: %v", err)
+	}
+
+	cfg := &config.Config{
+		Name:      "fake",
+		SourceDir: "/tmp/a",
+		DestDir:   "/tmp/b",
+		Transport: "rsync",
+		ExtraArgs: []string{"--password=hunter2", "--foo=secret123"},
+	}
+	fakeExecute := NewFakeExecute()
+	rsync, err := NewRsyncTransport(cfg, fakeExecute, false)
+	if err != nil {
+		t.Fatalf("NewRsyncTransport failed: %v", err)
+	}
+	if err := rsync.Run(ctx); err != nil {
+		t.Fatalf("rsync.Run failed: %v", err)
+	}
+
+	for _, secret := range []string{"hunter2", "secret123"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("log output contains %q: %s", secret, buf.String())
+		}
+		if len(fakeExecute.Cmds()) != 1 || !strings.Contains(fakeExecute.Cmds()[0], secret) {
+			t.Errorf("executed command should contain %q: %q", secret, fakeExecute.Cmds())
+		}
+	}
+}
+
+// Test that dry-run mode logs the resolved destination.
+func TestDryRunDestination(t *testing.T) {
+	casetests := []struct {
+		transport string
+		destHost  string
+		destDir   string
+		want      string
+	}{
+		{transport: "rsync", destHost: "desthost", destDir: "/tmp/b", want: "desthost:/tmp/b"},
+		{transport: "rclone", destHost: "remote", destDir: "bucket/b", want: "remote:bucket/b"},
+		{transport: "rdiff-backup", destHost: "desthost", destDir: "/tmp/b", want: "desthost::/tmp/b"},
+		{transport: "restic", destHost: "sftp:desthost", destDir: "/tmp/b", want: "sftp:desthost:/tmp/b"},
+		{transport: "restic", destDir: "s3:host/bucket", want: "s3:host/bucket"},
+		{transport: "tar", destDir: "/tmp/b", want: "/tmp/b/fake-20240301-020000.tar"},
+	}
+	for _, tt := range casetests {
+		var buf bytes.Buffer
+		log := logger.New("")
+		log.SetMirrorOutput(&buf)
+		ctx := logger.WithLogger(context.Background(), log)
+		ctx = clock.WithClock(ctx, clock.NewFake(time.Date(2024, 3, 1, 2, 0, 0, 0, time.Local)))
+
+		cfg := &config.Config{
+			Name:      "fake",
+			SourceDir: "/tmp/a",
+			DestHost:  tt.destHost,
+			DestDir:   tt.destDir,
+			Transport: tt.transport,
+		}
+		factory, ok := Lookup(tt.transport)
+		if !ok {
+			t.Fatalf("transport %q not registered", tt.transport)
+		}
+		tr, err := factory(cfg, NewFakeExecute(), true)
+		if err != nil {
+			t.Fatalf("%s: error creating transport: %v", tt.transport, err)
+		}
+		if err := tr.Run(ctx); err != nil {
+			t.Fatalf("%s: Run failed: %v", tt.transport, err)
+		}
+		if want := "Destination: " + tt.want + "\n"; !strings.Contains(buf.String(), want) {
+			t.Errorf("%s: dry-run output should contain %q: %s", tt.transport, want, buf.String())
+		}
+	}
+}
+
+// Test that extra arguments duplicating flags managed by the transport are
+// logged as warnings, but still passed to the transport.
+func TestWarnDuplicateFlags(t *testing.T) {
+	casetests := []struct {
+		transport string
+		extraArgs []string
+		want      string
+	}{
+		{transport: "rsync", extraArgs: []string{"--delete"}, want: "--delete"},
+		{transport: "rclone", extraArgs: []string{"-v"}, want: "-v"},
+		{transport: "rdiff-backup", extraArgs: []string{"--force"}, want: "--force"},
+		{transport: "restic", extraArgs: []string{"--repo=/tmp/c"}, want: "--repo"},
+		{transport: "tar", extraArgs: []string{"--directory=/tmp/c"}, want: "--directory"},
+		{transport: "rsync", extraArgs: []string{"--checksum"}},
+		{transport: "restic", extraArgs: []string{"--no-scan"}},
+	}
+	for _, tt := range casetests {
+		var buf bytes.Buffer
+		log := logger.New("")
+		log.SetVerboseLevel(1)
+		log.SetMirrorOutput(&buf)
+		ctx := logger.WithLogger(context.Background(), log)
+
+		cfg := &config.Config{
+			Name:      "fake",
+			SourceDir: "/tmp/a",
+			DestDir:   "/tmp/b",
+			Transport: tt.transport,
+			ExtraArgs: tt.extraArgs,
+		}
+		if err := cfg.Normalize(); err != nil {
+			t.Fatalf("Normalize failed: %v", err)
+		}
+		factory, ok := Lookup(tt.transport)
+		if !ok {
+			t.Fatalf("transport %q not registered", tt.transport)
+		}
+		fakeExecute := NewFakeExecute()
+		tr, err := factory(cfg, fakeExecute, true)
+		if err != nil {
+			t.Fatalf("%s: error creating transport: %v", tt.transport, err)
+		}
+		if err := tr.Run(ctx); err != nil {
+			t.Fatalf("%s: Run failed: %v", tt.transport, err)
+		}
+		got := strings.Contains(buf.String(), "Warning: extra argument")
+		if tt.want == "" {
+			if got {
+				t.Errorf("%s %v: got unexpected warning: %s", tt.transport, tt.extraArgs, buf.String())
+			}
+			continue
+		}
+		if want := "Warning: extra argument " + tt.want + " duplicates"; !strings.Contains(buf.String(), want) {
+			t.Errorf("%s %v: output should contain %q: %s", tt.transport, tt.extraArgs, want, buf.String())
+		}
+	}
+}
+
 // reMatch returns true if all all strings in a slice match regular expressions in
 // another slice, 1:1.
 func reMatch(re, s []string) (bool, error) {
@@ -0,0 +1,44 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// versionCmds contains the commands used to retrieve the version of each of
+// the supported transport binaries.
+var versionCmds = [][]string{
+	{"rclone", "version"},
+	{"rdiff-backup", "--version"},
+	{"restic", "version"},
+	{"rsync", "--version"},
+	{"tar", "--version"},
+}
+
+// binaryVersions runs each of the commands in cmds and returns a slice of
+// strings in the format "binary: <first line of output>". Binaries not
+// present in the path are reported as "not found".
+func binaryVersions(cmds [][]string) []string {
+	var ret []string
+
+	for _, cmd := range cmds {
+		if _, err := exec.LookPath(cmd[0]); err != nil {
+			ret = append(ret, fmt.Sprintf("%s: not found", cmd[0]))
+			continue
+		}
+		out, err := exec.Command(cmd[0], cmd[1:]...).Output()
+		if err != nil {
+			ret = append(ret, fmt.Sprintf("%s: error retrieving version: %v", cmd[0], err))
+			continue
+		}
+		line := strings.SplitN(strings.TrimSpace(string(out)), "\n", 2)[0]
+		ret = append(ret, fmt.Sprintf("%s: %s", cmd[0], line))
+	}
+	return ret
+}
@@ -0,0 +1,49 @@
+// This file is part of netbackup, a frontend to simplify periodic backups.
+// For further information, check https://github.com/marcopaganini/netbackup
+//
+// (C) 2015-2024 by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test binaryVersions with fake binaries.
+func TestBinaryVersions(t *testing.T) {
+	tmpdir := t.TempDir()
+
+	// Fake binaries printing multiple lines of output.
+	fakes := map[string]string{
+		"fakersync":  "#!/bin/sh\necho 'fakersync version 1.2.3'\necho 'second line'\n",
+		"fakerestic": "#!/bin/sh\necho \"fakerestic $1 0.1\"\n",
+	}
+	for name, contents := range fakes {
+		if err := os.WriteFile(filepath.Join(tmpdir, name), []byte(contents), 0755); err != nil {
+			t.Fatalf("error creating fake binary: %v", err)
+		}
+	}
+
+	cmds := [][]string{
+		{filepath.Join(tmpdir, "fakersync"), "--version"},
+		{filepath.Join(tmpdir, "fakerestic"), "version"},
+		{filepath.Join(tmpdir, "missing"), "--version"},
+	}
+	want := []string{
+		filepath.Join(tmpdir, "fakersync") + ": fakersync version 1.2.3",
+		filepath.Join(tmpdir, "fakerestic") + ": fakerestic version 0.1",
+		filepath.Join(tmpdir, "missing") + ": not found",
+	}
+
+	got := binaryVersions(cmds)
+	if len(got) != len(want) {
+		t.Fatalf("binaryVersions: got %d lines, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("binaryVersions: got %q, want %q", got[i], want[i])
+		}
+	}
+}